@@ -2,9 +2,13 @@ package app
 
 import (
 	"log"
-	"fmt"
+	"time"
+	"errors"
 	"slices"
+	"github.com/hello-llm-2/history"
 	"github.com/hello-llm-2/providers"
+	"github.com/hello-llm-2/session"
+	"github.com/hello-llm-2/tools"
 )
 
 type NamedPipeFileFailureType int
@@ -17,118 +21,252 @@ const (
 	NamedPipeFailureOther
 )
 
+func NamedPipeFailureToString(failure NamedPipeFileFailureType) string {
+	switch failure {
+	case NamedPipeFailureNone:
+		return ""
+	case NamedPipeFailureAlreadyExists:
+		return "a file that isn't a FIFO is in the way"
+	case NamedPipeFailureNotAllowed:
+		return "permission denied"
+	case NamedPipeFailureNoSuitablePath:
+		return "no runtime directory (XDG_RUNTIME_DIR)"
+	default:
+		return "could not create the FIFO"
+	}
+}
+
 type NamedPipeFile struct {
+	// Name of the context slot fed by this pipe
+	Name string
 	Path string
 	Failure NamedPipeFileFailureType
 }
 
+// Settings of the self hosted OpenAI compatible server
+type LocalServer struct {
+	BaseUrl string
+	Model string
+	ApiKey string
+	// In tokens, for models the catalog doesn't know
+	ContextWindow int
+}
+
+type OutputFormat int
+
+const (
+	OutputFormatText OutputFormat = iota
+	OutputFormatJson
+	// One JSON object per line, per chunk
+	OutputFormatJsonl
+)
+
+func OutputFormatFromString(format string) (OutputFormat, error) {
+	switch format {
+	case "text":
+		return OutputFormatText, nil
+	case "json":
+		return OutputFormatJson, nil
+	case "jsonl":
+		return OutputFormatJsonl, nil
+	default:
+		return 0, errors.New("Unknown output format")
+	}
+}
+
 type AppConfig struct {
 	Provider providers.ProviderType
+	// Tried in order when Provider can't answer, see providers.FallbackProvider
+	Fallback []providers.ProviderType
+	// What happens to the oldest turns when the conversation outgrows the context window
+	ContextStrategy ContextStrategy
 	ModelPreference providers.ModelPreference
+	Models providers.ModelCatalog
+	// Explicit model id, wins over ModelPreference
+	Model string
+	// Response length cap, 0 for the provider's default
+	MaxTokens int
+	// nil for the provider's default
+	Temperature *float64
 	AllowWebSearch bool
+	AllowTools bool
 	UseStdout bool
+	PrintUsage bool
+	OutputFormat OutputFormat
+	// One-shot mode prints chunks as they arrive instead of waiting for the whole response
+	StreamStdout bool
 	UseColor bool
 	NoGreet bool
 	SystemPrompt string
-	NamedPipe NamedPipeFile
+	// One per context slot, the default one comes first
+	NamedPipes []NamedPipeFile
+	Local LocalServer
+	Shell tools.ShellSettings
+	Retry providers.RetryPolicy
+}
+
+// A request that failed and will be sent again at At
+type PendingRetry struct {
+	providers.RetryInfo
+	At time.Time
 }
 
 type AppState struct {
 	FreeScrollMode bool
 	ScrollPosition int
 	UserError string
+	// Short lived feedback, cleared on the next key press
+	Notice string
+	// nil unless a failed request waits to be sent again
+	Retry *PendingRetry
 	ViewAtBottom bool
+	// Index in ui.ChatCodeBlocks, -1 when none is selected
+	SelectedCodeBlock int
 
 	cfg *AppConfig
-	userPromptBuf []rune
-	chatHistory []providers.AgnosticConversationMessage
+	userPrompt LineEditor
+	history *history.History
+	// Entry shown in the prompt, history.Len() when not browsing the history
+	historyIdx int
+	// Prompt being typed before browsing the history
+	historyDraft string
+	historySearch *HistorySearch
+	conversation *conversation
+	// Sent between the system prompt and the conversation
+	attachments []Attachment
+	// Message being edited through /edit, -1 otherwise
+	editedNode int
 	currentLlmResponse string
 	provider providers.Provider
-	pipedContent string
+	contextSlots []*ContextSlot
+	session *session.Session
+	tools *tools.Registry
+	// Tool calls received from the ongoing stream
+	pendingToolCalls []providers.ToolCall
+	// Tool calls sent for execution, waiting for their result
+	runningToolCalls []providers.ToolCall
+	toolConfirmations []*ToolConfirmation
+	sessionUsage providers.Usage
+	sessionCost float64
+	// Set as soon as a single response came from a model missing from the price table
+	sessionCostUnknown bool
+	lastModel string
+	// Empty when it's the configured provider
+	lastProvider string
+	// Of the response being finalized, nil when it was interrupted before the end
+	responseMeta *providers.ResponseMetadata
+	// Replaces the oldest turns in what's sent, nil until they had to be summarized
+	summary *contextSummary
+	// Head of the conversation when summarizing failed, the request is truncated instead
+	summarySkipHead int
 }
 
-func NewAppState(cfg *AppConfig) *AppState {
-	userPromptBuf := make([]rune, 0, 100)
-	userPromptBuf = append(userPromptBuf, '>')
-	userPromptBuf = append(userPromptBuf, ' ')
+// Provider, wrapped with the fallback chain when there is one
+func newProvider(cfg *AppConfig) providers.Provider {
+	if len(cfg.Fallback) == 0 {
+		return providerOfType(cfg, cfg.Provider)
+	}
 
-	chatHistory := []providers.AgnosticConversationMessage{
-		providers.AgnosticConversationMessage{
-			Type: providers.MessageTypeSystem,
-			Content: cfg.SystemPrompt,
-		},
+	chain := []providers.FallbackEntry{{Type: cfg.Provider, Provider: providerOfType(cfg, cfg.Provider)}}
+	for _, providerType := range cfg.Fallback {
+		known := slices.ContainsFunc(chain, func(entry providers.FallbackEntry) bool { return entry.Type == providerType })
+		if !known {
+			chain = append(chain, providers.FallbackEntry{Type: providerType, Provider: providerOfType(cfg, providerType)})
+		}
 	}
+	return &providers.FallbackProvider{Chain: chain}
+}
 
-	var provider providers.Provider
-	switch cfg.Provider {
+func providerOfType(cfg *AppConfig, providerType providers.ProviderType) providers.Provider {
+	models := cfg.Models[providerType]
+
+	switch providerType {
 	case providers.ProviderOpenai:
-		provider = &providers.OpenaiProviderOpenai
+		provider := providers.OpenaiProviderOpenai
+		provider.Models = models
+		return &provider
 	case providers.ProviderGemini:
-		provider = providers.GeminiProvider{}
+		return &providers.GeminiProvider{Models: models}
 	case providers.ProviderGrok:
-		provider = &providers.OpenaiProviderGrok
+		provider := providers.OpenaiProviderGrok
+		provider.Models = models
+		return &provider
 	case providers.ProviderAnthropic:
-		provider = providers.AnthropicProvider{}
+		return &providers.AnthropicProvider{Models: models}
+	case providers.ProviderLocal:
+		// The local model fills in whatever the catalog doesn't specify
+		for pref := providers.ModelPreference(0); pref < providers.ModelPreferenceLast; pref++ {
+			models.SetCurrentSelection(pref)
+			if models.Get() == "" {
+				models.Set(pref, cfg.Local.Model)
+			}
+		}
+		return &providers.ChatCompletionsProvider{
+			BaseUrl: cfg.Local.BaseUrl,
+			Models: models,
+			ApiKey: cfg.Local.ApiKey,
+			KeyName: "api_key of the [local] config table",
+		}
 	default:
-		log.Fatal(cfg.Provider, "Unimplemented provider")
+		log.Fatal(providerType, "Unimplemented provider")
+		return nil
 	}
+}
 
+func NewAppState(cfg *AppConfig) *AppState {
 	return &AppState {
 		FreeScrollMode: false,
 		ScrollPosition: 0,
 		UserError: "",
 		ViewAtBottom: true,
+		SelectedCodeBlock: -1,
 		cfg: cfg,
-		userPromptBuf: userPromptBuf,
-		chatHistory: chatHistory,
+		userPrompt: LineEditor{buf: make([]rune, 0, 100)},
+		history: &history.History{},
+		conversation: newConversation(),
+		editedNode: -1,
+		summarySkipHead: -1,
 		currentLlmResponse: "",
-		provider: provider,
-		pipedContent: "",
+		provider: newProvider(cfg),
+		contextSlots: newContextSlots(cfg.NamedPipes),
+		session: session.New(providers.ProviderTypeToString(cfg.Provider)),
+		tools: tools.NewRegistry(),
 	}
 }
 
+// Returns when the request will be sent again
+func (app *AppState) RetryScheduled(info providers.RetryInfo) time.Time {
+	app.Retry = &PendingRetry{RetryInfo: info, At: time.Now().Add(info.Delay)}
+	return app.Retry.At
+}
+
 func (app *AppState) Cfg() AppConfig {
 	return *app.cfg
 }
 
-func (a *AppState) ContextAppend(extraContext string) {
-	msg := providers.AgnosticConversationMessage {
-		Type: providers.MessageTypeSystem,
-		Content: fmt.Sprintf("Here is some user provided context:\n%s", extraContext),
-	}
+func (a *AppState) UserPromptAppendRune(r rune) {
+	a.userPrompt.Insert(r)
+}
 
-	if len(a.chatHistory) > 1 && a.chatHistory[1].Type == providers.MessageTypeSystem {
-		a.chatHistory[1] = msg
-	} else {
-		a.chatHistory = slices.Insert(a.chatHistory, 1, msg)
-	}
+// Inserts at the cursor, used for pastes
+func (a *AppState) UserPromptInsert(s string) {
+	a.userPrompt.InsertString(s)
 }
 
-func (a *AppState) UserPromptAppendRune(r rune) {
-	a.userPromptBuf = append(a.userPromptBuf, r)
+func (a *AppState) UserPromptEdit(edit LineEdit) {
+	a.userPrompt.Apply(edit)
 }
 
 func (a *AppState) UserPromptSet(val string) {
-	a.UserPromptClear()
-	a.userPromptBuf = append(a.userPromptBuf, []rune(val)...)
+	a.userPrompt.Set(val)
 }
 
 func (a *AppState) UserPromptPop() {
-	// Prefix len is 2, too lazy to make a const
-	// will come in the future
-	if len(a.userPromptBuf) == 2 {
-		return
-	}
-
-	a.userPromptBuf = a.userPromptBuf[:len(a.userPromptBuf)-1]
+	a.userPrompt.Apply(LineEditBackspace)
 }
 
 func (a *AppState) UserPromptClear() {
-	if len(a.userPromptBuf) == 2 {
-		return
-	}
-
-	a.userPromptBuf = a.userPromptBuf[:2]
+	a.userPrompt.Clear()
 }
 
 func (a *AppState) LlmResponsePush(chunk string) {
@@ -140,67 +278,286 @@ func (a *AppState) LlmResponse() string {
 }
 
 func (a *AppState) LlmResponseFinalize() {
+	// The tool calls of the same response still need it
+	if len(a.pendingToolCalls) == 0 {
+		defer func() { a.responseMeta = nil }()
+	}
 	if a.currentLlmResponse == "" {
 		return
 	}
 
-	a.chatHistory = append(
-		a.chatHistory,
-		providers.AgnosticConversationMessage{
-			Type: providers.MessageTypeAssistant,
-			Content: a.currentLlmResponse,
-		})
+	msg := providers.AgnosticConversationMessage{
+		Type: providers.MessageTypeAssistant,
+		Content: a.currentLlmResponse,
+	}
+	a.stampResponse(&msg)
+	a.conversation.append(msg)
 	a.currentLlmResponse = ""
 }
 
+// Records what answered, unknown for a response interrupted before its metadata came
+func (a *AppState) stampResponse(msg *providers.AgnosticConversationMessage) {
+	if a.responseMeta == nil {
+		return
+	}
+	msg.Provider = a.LastProvider()
+	msg.Model = a.responseMeta.Model
+}
+
+// An edited message goes next to the original one, starting a new branch
 func (a *AppState) ChatHistoryAppendUserPrompt() {
-	if a.pipedContent != "" {
-		a.chatHistory = append(
-			a.chatHistory,
-			providers.AgnosticConversationMessage{
-				Type: providers.MessageTypeUserContext,
-				Content: a.pipedContent,
-			})
-		a.pipedContent = ""
-	}
-
-	a.chatHistory = append(
-		a.chatHistory,
-		providers.AgnosticConversationMessage{
-			Type: providers.MessageTypeUser,
-			Content: string(a.UserPromptContent()),
-		})
+	if a.editedNode != -1 {
+		a.conversation.head = a.conversation.nodes[a.editedNode].parent
+		a.editedNode = -1
+	}
+	text, _ := a.ParsePrompt(string(a.UserPromptContent()))
+	a.ChatHistoryAppendPrompt(text)
+}
+
+// For prompts that don't come from the prompt editor, the context slots go with it all the same
+func (a *AppState) ChatHistoryAppendPrompt(prompt string) {
+	for _, slot := range a.contextSlots {
+		if slot.Empty() {
+			continue
+		}
+		a.conversation.append(slot.message())
+		slot.clear()
+	}
+
+	a.conversation.append(providers.AgnosticConversationMessage{
+		Type: providers.MessageTypeUser,
+		Content: prompt,
+	})
 }
 
 func (a *AppState) UserPromptContent() []rune {
-	return a.userPromptBuf[2:]
+	return a.userPrompt.Content()
 }
 
-func (a *AppState) UserPromptPrefixed() string {
-	return string(a.userPromptBuf)
+// Position of the cursor in UserPromptContent
+func (a *AppState) UserPromptCursor() int {
+	return a.userPrompt.Cursor()
 }
 
 func (a *AppState) UserPromptEmpty() bool {
-	return len(a.userPromptBuf) == 2
+	return a.userPrompt.Empty()
 }
 
-// Returns the whole chat history appended with the current user prompt
+// Number of messages ChatHistory puts before the conversation
+func (a *AppState) chatHistoryPrefixLen() int {
+	return 1 + len(a.attachments)
+}
+
+// The active branch of the conversation preceded by the system prompt and the attachments, as sent to providers
 func (a *AppState) ChatHistory() []providers.AgnosticConversationMessage {
-	return a.chatHistory
+	return append(a.chatHistoryPrefix(), a.conversation.messages()...)
+}
+
+// The system prompt and the attachments
+func (a *AppState) chatHistoryPrefix() []providers.AgnosticConversationMessage {
+	prefix := []providers.AgnosticConversationMessage{
+		providers.AgnosticConversationMessage{
+			Type: providers.MessageTypeSystem,
+			Content: a.cfg.SystemPrompt,
+		},
+	}
+	for _, at := range a.attachments {
+		prefix = append(prefix, at.message())
+	}
+	return prefix
+}
+
+// Position of the i-th message of ChatHistory among its alternative versions, count is 1 when it was never edited nor regenerated
+func (a *AppState) ChatHistoryBranch(i int) (index int, count int) {
+	i -= a.chatHistoryPrefixLen()
+	path := a.conversation.path()
+	if i < 0 || i >= len(path) {
+		return 0, 1
+	}
+	return a.conversation.siblingPosition(path[i])
+}
+
+// User messages of the active branch, oldest first
+func (a *AppState) userPromptNodes() []int {
+	prompts := []int{}
+	for _, id := range a.conversation.path() {
+		if a.conversation.nodes[id].msg.Type == providers.MessageTypeUser {
+			prompts = append(prompts, id)
+		}
+	}
+	return prompts
+}
+
+// True while the prompt holds a message picked with /edit
+func (a *AppState) MessageEditing() bool {
+	return a.editedNode != -1
+}
+
+func (a *AppState) MessageEditCancel() {
+	a.editedNode = -1
+	a.userPrompt.Clear()
+}
+
+// Moves to the previous (-1) or next (1) version of the last message that has several, returns false when there is none
+func (a *AppState) BranchSwitch(offset int) bool {
+	fork := a.conversation.lastFork()
+	if fork == -1 {
+		return false
+	}
+	return a.conversation.switchSibling(fork, offset)
 }
 
 func (a *AppState) Provider() providers.Provider {
 	return a.provider
 }
 
-func (a *AppState) NamedPipe() NamedPipeFile {
-	return a.cfg.NamedPipe
+func (a *AppState) NamedPipes() []NamedPipeFile {
+	return a.cfg.NamedPipes
+}
+
+// Replaces the current conversation with the one stored in the session, subsequent saves will go to that session
+func (a *AppState) SessionResume(s *session.Session) {
+	a.session = s
+	a.conversation = conversationFromSession(s)
+	a.attachments = attachmentsFromSession(s.Attachments)
+	a.contextSummaryReset()
+}
+
+// Persists the conversation, does nothing until the user actually said something
+func (a *AppState) SessionSave() error {
+	hasUserPrompt := slices.ContainsFunc(a.conversation.nodes, func(node conversationNode) bool {
+		return node.msg.Type == providers.MessageTypeUser
+	})
+	if !hasUserPrompt {
+		return nil
+	}
+
+	a.session.Provider = providers.ProviderTypeToString(a.cfg.Provider)
+	a.session.Messages = withoutMediaData(a.ChatHistory())
+	a.session.Nodes, a.session.Head = a.conversation.toSession()
+	a.session.Attachments = attachmentsToSession(a.attachments)
+	return a.session.Save()
 }
 
-func (a *AppState) PipedContentSet(content string) {
-	a.pipedContent = content
+// Media is only saved once, in the nodes and the attachments. Messages are rewritten after every answer and
+// are only there for versions that didn't know about nodes, which didn't know about media either
+func withoutMediaData(msgs []providers.AgnosticConversationMessage) []providers.AgnosticConversationMessage {
+	for i, msg := range msgs {
+		if len(msg.Parts) == 0 {
+			continue
+		}
+		parts := make([]providers.MessagePart, len(msg.Parts))
+		for j, part := range msg.Parts {
+			part.Data = nil
+			parts[j] = part
+		}
+		msgs[i].Parts = parts
+	}
+	return msgs
 }
 
-func (a *AppState) PipedContent() string {
-	return a.pipedContent
+func (a *AppState) SessionId() string {
+	return a.session.Id
+}
+
+func (a *AppState) Tools() *tools.Registry {
+	return a.tools
+}
+
+// Tools are only offered to the model when the user allowed them
+func (a *AppState) ToolDefinitions() []providers.ToolDefinition {
+	if !a.cfg.AllowTools {
+		return nil
+	}
+	return a.tools.Definitions()
+}
+
+func (a *AppState) ToolCallPush(call providers.ToolCall) {
+	a.pendingToolCalls = append(a.pendingToolCalls, call)
+}
+
+// Records the calls requested by the finished response in the history and returns them so they can be run
+func (a *AppState) ToolCallsStart() []providers.ToolCall {
+	calls := a.pendingToolCalls
+	a.pendingToolCalls = nil
+
+	for i := range calls {
+		msg := providers.AgnosticConversationMessage{
+			Type: providers.MessageTypeToolCall,
+			ToolCall: &calls[i],
+		}
+		a.stampResponse(&msg)
+		a.conversation.append(msg)
+	}
+	a.responseMeta = nil
+	a.runningToolCalls = append(a.runningToolCalls, calls...)
+	return calls
+}
+
+// Returns true when this was the last result awaited, results of unknown (e.g. aborted) calls are dropped
+func (a *AppState) ToolCallResult(call providers.ToolCall, result string) bool {
+	idx := slices.IndexFunc(a.runningToolCalls, func(running providers.ToolCall) bool {
+		return running.Id == call.Id
+	})
+	if idx == -1 {
+		return false
+	}
+
+	a.runningToolCalls = slices.Delete(a.runningToolCalls, idx, idx+1)
+	a.conversation.append(providers.AgnosticConversationMessage{
+		Type: providers.MessageTypeToolResult,
+		Content: result,
+		ToolCall: &call,
+	})
+	return len(a.runningToolCalls) == 0
+}
+
+// Every call must have a result for the history to be accepted by providers
+func (a *AppState) ToolCallsAbort() {
+	a.pendingToolCalls = nil
+	a.responseMeta = nil
+	a.toolConfirmations = nil
+	for _, call := range a.runningToolCalls {
+		a.conversation.append(providers.AgnosticConversationMessage{
+			Type: providers.MessageTypeToolResult,
+			Content: "The user cancelled this tool call",
+			ToolCall: &call,
+		})
+	}
+	a.runningToolCalls = nil
+}
+
+func (a *AppState) UsageRecord(meta providers.ResponseMetadata) {
+	a.lastModel = meta.Model
+	a.lastProvider = meta.Provider
+	a.responseMeta = &meta
+	a.usageAdd(meta)
+}
+
+// Counts in the session usage and cost, for requests that aren't part of the conversation too
+func (a *AppState) usageAdd(meta providers.ResponseMetadata) {
+	a.sessionUsage = a.sessionUsage.Add(meta.Usage)
+	if cost, known := meta.Usage.Cost(meta.Model); known {
+		a.sessionCost += cost
+	} else {
+		a.sessionCostUnknown = true
+	}
+}
+
+// Cost is only meaningful when known is true
+func (a *AppState) SessionUsage() (usage providers.Usage, cost float64, known bool) {
+	return a.sessionUsage, a.sessionCost, !a.sessionCostUnknown
+}
+
+// Model that produced the last response, empty until one arrived
+func (a *AppState) LastModel() string {
+	return a.lastModel
+}
+
+// Provider that produced the last response, which isn't the configured one when it fell back to another
+func (a *AppState) LastProvider() string {
+	if a.lastProvider == "" {
+		return providers.ProviderTypeToString(a.cfg.Provider)
+	}
+	return a.lastProvider
 }
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"fmt"
+	"errors"
+	"slices"
+	"strconv"
+	"path/filepath"
+
+	"github.com/hello-llm-2/attach"
+	"github.com/hello-llm-2/providers"
+	"github.com/hello-llm-2/session"
+)
+
+// Name of the attachment made of what was piped to hello
+const StdinAttachment string = "<stdin>"
+
+var ErrNoSuchAttachment error = errors.New("No such attachment")
+
+// A file sent as its own context message with every request, until it is detached
+type Attachment struct {
+	Path string
+	Content string
+	// Images and PDFs, Content is empty for them
+	MimeType string
+	Data []byte
+	// Of message(), estimated when attached
+	tokens int
+}
+
+func newAttachment(path string, content string, mimeType string, data []byte) Attachment {
+	at := Attachment{Path: path, Content: content, MimeType: mimeType, Data: data}
+	at.tokens = providers.EstimateMessageTokens(at.message())
+	return at
+}
+
+func (at Attachment) Size() int {
+	return len(at.Content) + len(at.Data)
+}
+
+// Image or document part of some media, name is what the model is told the file is called
+func mediaPart(name string, mimeType string, data []byte) providers.MessagePart {
+	part := providers.MessagePart{Type: providers.PartImage, MimeType: mimeType, Data: data}
+	if attach.IsDocument(mimeType) {
+		part.Type = providers.PartDocument
+		part.Name = filepath.Base(name)
+		if name == "" {
+			part.Name = "document.pdf"
+		}
+	}
+	return part
+}
+
+func (at Attachment) message() providers.AgnosticConversationMessage {
+	if at.MimeType != "" {
+		return providers.AgnosticConversationMessage{
+			Type: providers.MessageTypeUserContext,
+			Content: attach.FormatMedia(at.Path, at.MimeType),
+			Parts: []providers.MessagePart{mediaPart(at.Path, at.MimeType, at.Data)},
+		}
+	}
+	return providers.AgnosticConversationMessage{
+		Type: providers.MessageTypeUserContext,
+		Content: attach.Format(at.Path, at.Content),
+	}
+}
+
+// Attaching a path again replaces its content, that's how a file is refreshed after being edited
+func (a *AppState) attachFile(file attach.File) {
+	at := newAttachment(file.Path, file.Content, file.MimeType, file.Data)
+	idx := slices.IndexFunc(a.attachments, func(other Attachment) bool { return other.Path == at.Path })
+	if idx == -1 {
+		a.attachments = append(a.attachments, at)
+	} else {
+		a.attachments[idx] = at
+	}
+}
+
+// For content that doesn't come from a file, e.g. stdin. Text, images and PDFs are accepted like with Attach
+func (a *AppState) AttachData(path string, data []byte) error {
+	file, err := attach.FromData(path, data)
+	if err != nil {
+		return err
+	}
+	a.attachFile(file)
+	return nil
+}
+
+// Returns how many files were attached and the ones that were skipped
+func (a *AppState) Attach(patterns []string) (int, []attach.Skipped, error) {
+	files, skipped, err := attach.Collect(patterns)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, file := range files {
+		a.attachFile(file)
+	}
+	return len(files), skipped, nil
+}
+
+func (a *AppState) Attachments() []Attachment {
+	return a.attachments
+}
+
+// which is the 1-based position in Attachments, a path or "all". Returns how many were removed
+func (a *AppState) Detach(which string) (int, error) {
+	count := len(a.attachments)
+	if which == "all" {
+		a.attachments = nil
+		return count, nil
+	}
+
+	if n, err := strconv.Atoi(which); err == nil {
+		if n < 1 || n > count {
+			return 0, fmt.Errorf("%w: %d", ErrNoSuchAttachment, n)
+		}
+		a.attachments = slices.Delete(a.attachments, n - 1, n)
+		return 1, nil
+	}
+
+	a.attachments = slices.DeleteFunc(a.attachments, func(at Attachment) bool { return at.Path == which })
+	if len(a.attachments) == count {
+		return 0, fmt.Errorf("%w: %s", ErrNoSuchAttachment, which)
+	}
+	return 1, nil
+}
+
+func attachmentsToSession(attachments []Attachment) []session.Attachment {
+	saved := make([]session.Attachment, 0, len(attachments))
+	for _, at := range attachments {
+		saved = append(saved, session.Attachment{Path: at.Path, Content: at.Content, MimeType: at.MimeType, Data: at.Data})
+	}
+	return saved
+}
+
+func attachmentsFromSession(saved []session.Attachment) []Attachment {
+	attachments := make([]Attachment, 0, len(saved))
+	for _, at := range saved {
+		attachments = append(attachments, newAttachment(at.Path, at.Content, at.MimeType, at.Data))
+	}
+	return attachments
+}
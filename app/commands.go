@@ -0,0 +1,416 @@
+// Slash commands typed in the TUI prompt, they act on the config and the state of a running session
+
+package app
+
+import (
+	"fmt"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hello-llm-2/providers"
+	"github.com/hello-llm-2/session"
+)
+
+var (
+	ErrUnknownCommand error = errors.New("Unknown command, try /help")
+	ErrCommandUsage error = errors.New("Usage")
+	ErrNothingToRetry error = errors.New("Nothing to retry")
+	ErrNothingToEdit error = errors.New("No such message to edit")
+	ErrNoBranch error = errors.New("No other branch in that direction")
+)
+
+type CommandResult struct {
+	// Shown to the user once the command ran
+	Notice string
+	// The conversation should be sent again to the provider, e.g. /retry
+	Resend bool
+}
+
+type Command struct {
+	Name string
+	// e.g. "<cheap|fast|smart|model id>"
+	Usage string
+	Description string
+	// An ongoing response must be cancelled before running it
+	StopsStreaming bool
+	// Candidates for the argument, nil when it can't be completed
+	Complete func(a *AppState) []string
+	Run func(a *AppState, arg string) (CommandResult, error)
+}
+
+func onOff(value string) (bool, error) {
+	switch value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, ErrCommandUsage
+	}
+}
+
+func onOffString(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func completeOnOff(a *AppState) []string {
+	return []string{"on", "off"}
+}
+
+func completeModelPreference(a *AppState) []string {
+	candidates := []string{}
+	for pref := providers.ModelPreference(0); pref < providers.ModelPreferenceLast; pref++ {
+		candidates = append(candidates, providers.ModelPreferenceToString(pref))
+	}
+	return candidates
+}
+
+func completeProvider(a *AppState) []string {
+	candidates := []string{}
+	for provider := providers.ProviderType(0); provider < providers.ProviderLast; provider++ {
+		candidates = append(candidates, providers.ProviderTypeToString(provider))
+	}
+	return candidates
+}
+
+// Filled in init, /help lists the commands
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{
+			Name: "model",
+			Usage: "<cheap|fast|smart|model id>",
+			Description: "Switch the model preference, or use a specific model",
+			Complete: completeModelPreference,
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				if arg == "" {
+					return CommandResult{}, ErrCommandUsage
+				}
+				if pref, err := providers.ModelPreferenceFromString(arg); err == nil {
+					a.cfg.ModelPreference = pref
+					a.cfg.Model = ""
+					return CommandResult{Notice: "Model preference set to " + arg}, nil
+				}
+				a.cfg.Model = arg
+				return CommandResult{Notice: "Using model " + arg}, nil
+			},
+		},
+		{
+			Name: "provider",
+			Usage: "<" + strings.Join(completeProvider(nil), "|") + ">",
+			Description: "Switch provider, the conversation carries over",
+			StopsStreaming: true,
+			Complete: completeProvider,
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				provider, err := providers.ProviderTypeFromString(arg)
+				if err != nil {
+					return CommandResult{}, ErrCommandUsage
+				}
+				a.cfg.Provider = provider
+				// A model id rarely makes sense across providers
+				a.cfg.Model = ""
+				a.provider = newProvider(a.cfg)
+				a.lastProvider = ""
+				return CommandResult{Notice: "Switched to " + arg}, nil
+			},
+		},
+		{
+			Name: "web",
+			Usage: "<on|off>",
+			Description: "Allow the model to search the web",
+			Complete: completeOnOff,
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				allow, err := onOff(arg)
+				if err != nil {
+					return CommandResult{}, err
+				}
+				a.cfg.AllowWebSearch = allow
+				return CommandResult{Notice: "Web search " + onOffString(allow)}, nil
+			},
+		},
+		{
+			Name: "clear",
+			Description: "Start a new conversation, the current one stays saved",
+			StopsStreaming: true,
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				if err := a.SessionSave(); err != nil {
+					return CommandResult{}, err
+				}
+				a.ToolCallsAbort()
+				a.conversation = newConversation()
+				a.contextSummaryReset()
+				a.editedNode = -1
+				a.currentLlmResponse = ""
+				a.SelectedCodeBlock = -1
+				a.session = session.New(providers.ProviderTypeToString(a.cfg.Provider))
+				return CommandResult{Notice: "Conversation cleared"}, nil
+			},
+		},
+		{
+			Name: "save",
+			Description: "Save the conversation now",
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				if err := a.SessionSave(); err != nil {
+					return CommandResult{}, err
+				}
+				return CommandResult{Notice: "Saved as session " + a.SessionId()}, nil
+			},
+		},
+		{
+			Name: "system",
+			Usage: "[text]",
+			Description: "Replace the system prompt, shows it when no text is given",
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				if arg == "" {
+					return CommandResult{Notice: "System prompt: " + a.cfg.SystemPrompt}, nil
+				}
+				a.cfg.SystemPrompt = arg
+				return CommandResult{Notice: "System prompt replaced"}, nil
+			},
+		},
+		{
+			Name: "retry",
+			Description: "Ask for another answer to the last prompt, the previous one stays a branch away",
+			StopsStreaming: true,
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				prompts := a.userPromptNodes()
+				if len(prompts) == 0 {
+					return CommandResult{}, ErrNothingToRetry
+				}
+				// The new answer forks right after the prompt, tool calls included
+				a.ToolCallsAbort()
+				a.currentLlmResponse = ""
+				a.conversation.head = prompts[len(prompts)-1]
+				return CommandResult{Resend: true}, nil
+			},
+		},
+		{
+			Name: "edit",
+			Usage: "[n]",
+			Description: "Edit your n-th last message (default 1) and send it as a new branch",
+			StopsStreaming: true,
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				n := 1
+				if arg != "" {
+					var err error
+					if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+						return CommandResult{}, ErrCommandUsage
+					}
+				}
+				prompts := a.userPromptNodes()
+				if n > len(prompts) {
+					return CommandResult{}, ErrNothingToEdit
+				}
+				a.editedNode = prompts[len(prompts)-n]
+				a.userPrompt.Set(a.conversation.nodes[a.editedNode].msg.Content)
+				return CommandResult{}, nil
+			},
+		},
+		{
+			Name: "branch",
+			Usage: "<prev|next>",
+			Description: "Switch to another version of the last edited or regenerated message (also Alt-Left/Right)",
+			StopsStreaming: true,
+			Complete: func(a *AppState) []string {
+				return []string{"prev", "next"}
+			},
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				offset := 0
+				switch arg {
+				case "prev":
+					offset = -1
+				case "next":
+					offset = 1
+				default:
+					return CommandResult{}, ErrCommandUsage
+				}
+				if !a.BranchSwitch(offset) {
+					return CommandResult{}, ErrNoBranch
+				}
+				return CommandResult{}, nil
+			},
+		},
+		{
+			Name: "attach",
+			Usage: "[path|glob...]",
+			Description: "Attach files to the conversation, lists the attachments when no path is given",
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				if arg == "" {
+					if len(a.attachments) == 0 {
+						return CommandResult{Notice: "No attachment, /attach <path|glob> adds some"}, nil
+					}
+					list := strings.Builder{}
+					for i, at := range a.attachments {
+						if i > 0 {
+							list.WriteByte('\n')
+						}
+						if at.MimeType != "" {
+							list.WriteString(fmt.Sprintf("%d. %s (%s, %d KB)", i + 1, at.Path, at.MimeType, len(at.Data) / 1024))
+						} else {
+							list.WriteString(fmt.Sprintf("%d. %s (%d lines)", i + 1, at.Path, strings.Count(at.Content, "\n") + 1))
+						}
+					}
+					return CommandResult{Notice: list.String()}, nil
+				}
+
+				count, skipped, err := a.Attach(strings.Fields(arg))
+				if err != nil {
+					return CommandResult{}, err
+				}
+				notice := fmt.Sprintf("Attached %d file(s)", count)
+				for _, skip := range skipped {
+					notice += fmt.Sprintf("\nSkipped %s: %s", skip.Path, skip.Reason)
+				}
+				return CommandResult{Notice: notice}, nil
+			},
+		},
+		{
+			Name: "detach",
+			Usage: "<n|path|all>",
+			Description: "Remove an attachment, n is its position in /attach",
+			Complete: func(a *AppState) []string {
+				candidates := []string{"all"}
+				for _, at := range a.attachments {
+					candidates = append(candidates, at.Path)
+				}
+				return candidates
+			},
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				if arg == "" {
+					return CommandResult{}, ErrCommandUsage
+				}
+				count, err := a.Detach(arg)
+				if err != nil {
+					return CommandResult{}, err
+				}
+				return CommandResult{Notice: fmt.Sprintf("Detached %d file(s)", count)}, nil
+			},
+		},
+		{
+			Name: "help",
+			Description: "List the commands",
+			Run: func(a *AppState, arg string) (CommandResult, error) {
+				help := strings.Builder{}
+				for i, cmd := range commands {
+					if i > 0 {
+						help.WriteByte('\n')
+					}
+					help.WriteString(fmt.Sprintf("/%s %s  %s", cmd.Name, cmd.Usage, cmd.Description))
+				}
+				help.WriteString("\nPrompts starting with a path such as /etc/hosts are sent as they are, // sends a single / otherwise")
+				return CommandResult{Notice: help.String()}, nil
+			},
+		},
+	}
+}
+
+// Tells a slash command from a prompt, and gives what is sent for the latter.
+// Command names have no '/', a path such as "/etc/hosts is what?" is a prompt. "//" escapes a leading slash
+func (a *AppState) ParsePrompt(prompt string) (text string, command bool) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(prompt, "/"), " ")
+	if strings.HasPrefix(prompt, "/") && !strings.Contains(name, "/") {
+		return prompt, true
+	}
+	if rest, found := strings.CutPrefix(prompt, "//"); found {
+		return "/" + rest, false
+	}
+	return prompt, false
+}
+
+func (a *AppState) UserPromptIsCommand() bool {
+	_, command := a.ParsePrompt(a.userPrompt.String())
+	return command
+}
+
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Splits "/name arg" and finds the command
+func (a *AppState) ParseCommand(prompt string) (*Command, string, error) {
+	name, arg, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(prompt), "/"), " ")
+	cmd := findCommand(name)
+	if cmd == nil {
+		return nil, "", fmt.Errorf("%w: /%s", ErrUnknownCommand, name)
+	}
+	return cmd, strings.TrimSpace(arg), nil
+}
+
+func (a *AppState) RunCommand(cmd *Command, arg string) (CommandResult, error) {
+	result, err := cmd.Run(a, arg)
+	if errors.Is(err, ErrCommandUsage) {
+		err = fmt.Errorf("%w: /%s %s", ErrCommandUsage, cmd.Name, cmd.Usage)
+	}
+	return result, err
+}
+
+func commonPrefix(candidates []string) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		// Whole runes, names may share the first bytes of one
+		for !strings.HasPrefix(c, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// Tab completion of command names and arguments, returns the candidates when there are several
+func (a *AppState) UserPromptComplete() []string {
+	prompt := a.userPrompt.String()
+	if !a.UserPromptIsCommand() || a.userPrompt.Cursor() != len(a.userPrompt.Content()) {
+		return nil
+	}
+
+	name, arg, hasArg := strings.Cut(strings.TrimPrefix(prompt, "/"), " ")
+	candidates := []string{}
+	if !hasArg {
+		for _, cmd := range commands {
+			if strings.HasPrefix(cmd.Name, name) {
+				candidates = append(candidates, cmd.Name)
+			}
+		}
+	} else if cmd := findCommand(name); cmd != nil && cmd.Complete != nil {
+		for _, candidate := range cmd.Complete(a) {
+			if strings.HasPrefix(candidate, arg) {
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	completed := commonPrefix(candidates)
+	switch {
+	case len(candidates) == 1 && !hasArg:
+		a.userPrompt.Set("/" + completed + " ")
+	case len(candidates) == 1:
+		a.userPrompt.Set("/" + name + " " + completed)
+	case !hasArg:
+		a.userPrompt.Set("/" + completed)
+	default:
+		a.userPrompt.Set("/" + name + " " + completed)
+	}
+
+	if len(candidates) > 1 {
+		return candidates
+	}
+	return nil
+}
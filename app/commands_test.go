@@ -0,0 +1,85 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hello-llm-2/providers"
+)
+
+func testCommandState() *AppState {
+	return NewAppState(&AppConfig{Provider: providers.ProviderLocal, Models: providers.DefaultModelCatalog()})
+}
+
+func TestParsePrompt(t *testing.T) {
+	cases := []struct {
+		prompt string
+		command bool
+		sent string
+	}{
+		{"/help", true, ""},
+		{"/model cheap", true, ""},
+		{"/nope", true, ""},
+		{"/", true, ""},
+		{"hello /help", false, "hello /help"},
+		{"/etc/hosts is what?", false, "/etc/hosts is what?"},
+		{"/usr/bin/env", false, "/usr/bin/env"},
+		{"//help is a command", false, "/help is a command"},
+		{"//", false, "/"},
+		{"///x", false, "//x"},
+	}
+	a := &AppState{}
+	for _, c := range cases {
+		text, command := a.ParsePrompt(c.prompt)
+		if command != c.command {
+			t.Errorf("%q: command %v, want %v", c.prompt, command, c.command)
+		}
+		if !command && text != c.sent {
+			t.Errorf("%q: sent %q, want %q", c.prompt, text, c.sent)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	a := testCommandState()
+	cmd, arg, err := a.ParseCommand("  /model   cheap ")
+	if err != nil || cmd.Name != "model" || arg != "cheap" {
+		t.Errorf("got %v %q %v", cmd, arg, err)
+	}
+	if _, _, err := a.ParseCommand("/nope"); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSlashPromptIsSent(t *testing.T) {
+	a := testCommandState()
+	a.UserPromptSet("//help me")
+	if a.UserPromptIsCommand() {
+		t.Fatal("escaped prompt taken for a command")
+	}
+	a.ChatHistoryAppendUserPrompt()
+	history := a.ChatHistory()
+	if last := history[len(history) - 1]; last.Content != "/help me" {
+		t.Errorf("sent %q", last.Content)
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	cases := []struct {
+		candidates []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"model"}, "model"},
+		{[]string{"model", "models", "mode"}, "mode"},
+		{[]string{"attach", "model"}, ""},
+		// é and è share their first byte
+		{[]string{"café-1", "cafè-2"}, "caf"},
+		{[]string{"日本語", "日本酒"}, "日本"},
+	}
+	for _, c := range cases {
+		if got := commonPrefix(c.candidates); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.candidates, got, c.want)
+		}
+	}
+}
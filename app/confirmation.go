@@ -0,0 +1,57 @@
+package app
+
+import (
+	"slices"
+
+	"github.com/hello-llm-2/providers"
+)
+
+// A tool call waiting for the user's approval
+type ToolConfirmation struct {
+	Call providers.ToolCall
+	Text string
+	Editable bool
+	Editing bool
+
+	original string
+}
+
+func (c *ToolConfirmation) Edited() bool {
+	return c.Text != c.original
+}
+
+func (c *ToolConfirmation) EditAppendRune(r rune) {
+	c.Text += string(r)
+}
+
+func (c *ToolConfirmation) EditPop() {
+	runes := []rune(c.Text)
+	if len(runes) == 0 {
+		return
+	}
+	c.Text = string(runes[:len(runes)-1])
+}
+
+func (a *AppState) ToolConfirmationPush(call providers.ToolCall, text string, editable bool) {
+	a.toolConfirmations = append(a.toolConfirmations, &ToolConfirmation{
+		Call: call,
+		Text: text,
+		Editable: editable,
+		original: text,
+	})
+}
+
+// Returns the confirmation to show to the user, nil if there is none
+func (a *AppState) ToolConfirmation() *ToolConfirmation {
+	if len(a.toolConfirmations) == 0 {
+		return nil
+	}
+	return a.toolConfirmations[0]
+}
+
+func (a *AppState) ToolConfirmationPop() {
+	if len(a.toolConfirmations) == 0 {
+		return
+	}
+	a.toolConfirmations = slices.Delete(a.toolConfirmations, 0, 1)
+}
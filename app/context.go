@@ -0,0 +1,276 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"errors"
+
+	"github.com/hello-llm-2/providers"
+)
+
+type ContextStrategy int
+
+const (
+	// The oldest turns are left out of the request
+	ContextStrategyTruncate ContextStrategy = iota
+	// The oldest turns are replaced by a summary a cheap model writes, truncating when that fails
+	ContextStrategySummarize
+	// Everything is sent, the provider refuses what doesn't fit
+	ContextStrategyOff
+)
+
+func ContextStrategyToString(strategy ContextStrategy) string {
+	switch strategy {
+	case ContextStrategyTruncate:
+		return "truncate"
+	case ContextStrategySummarize:
+		return "summarize"
+	case ContextStrategyOff:
+		return "off"
+	default:
+		return "unknown"
+	}
+}
+
+func ContextStrategyFromString(strategy string) (ContextStrategy, error) {
+	switch strategy {
+	case "truncate":
+		return ContextStrategyTruncate, nil
+	case "summarize":
+		return ContextStrategySummarize, nil
+	case "off":
+		return ContextStrategyOff, nil
+	default:
+		return 0, errors.New("Unknown context strategy")
+	}
+}
+
+// Room kept for the answer when MaxTokens doesn't say
+const maxOutputReserve int = 16384
+
+type contextSummary struct {
+	// Last node it covers, it only applies while that node is on the active path
+	through int
+	text string
+	tokens int
+}
+
+func (s *contextSummary) message() providers.AgnosticConversationMessage {
+	return providers.AgnosticConversationMessage{
+		Type: providers.MessageTypeUserContext,
+		Content: fmt.Sprintf("<summary of the earlier conversation>\n%s\n</summary>", s.text),
+	}
+}
+
+// Messages of the conversation from a user message (and the context sent with it) to the next one
+type contextTurn struct {
+	msgs []providers.AgnosticConversationMessage
+	// Node of the last message, -1 for what wasn't sent yet
+	last int
+	tokens int
+}
+
+// What comes before the turns: the system prompt, the attachments, and the summary if it applies
+type contextPrefix struct {
+	msgs []providers.AgnosticConversationMessage
+	tokens int
+	summarized bool
+}
+
+// Oldest turns to replace with a summary before the request is sent, see ContextSummaryJob
+type SummaryJob struct {
+	// The previous summary comes first when there is one
+	Messages []providers.AgnosticConversationMessage
+	through int
+}
+
+// Estimated size of the next request, gauge of the status line
+type ContextUsage struct {
+	Tokens int
+	// 0 when the model isn't known
+	Window int
+	// Oldest turns left out of the request
+	Dropped int
+	Summarized bool
+}
+
+// Of the model requests go to, 0 when unknown. A local server is assumed to use the same for all its models
+func (a *AppState) ContextWindow() int {
+	window := 0
+	if a.cfg.Model != "" {
+		window = providers.KnownContextWindow(a.cfg.Model)
+	} else {
+		models := a.cfg.Models[a.cfg.Provider]
+		models.SetCurrentSelection(a.cfg.ModelPreference)
+		window = models.ContextWindow()
+	}
+	if window == 0 && a.cfg.Provider == providers.ProviderLocal {
+		window = a.cfg.Local.ContextWindow
+	}
+	return window
+}
+
+// What the request may take, 0 when there's no limit to enforce
+func (a *AppState) contextBudget() int {
+	window := a.ContextWindow()
+	if window == 0 || a.cfg.ContextStrategy == ContextStrategyOff {
+		return 0
+	}
+	reserve := a.cfg.MaxTokens
+	if reserve == 0 {
+		reserve = min(window / 8, maxOutputReserve)
+	}
+	return max(0, window - reserve)
+}
+
+// The prefix, then the turns the summary doesn't cover. pending is what goes with the next prompt, a turn of its own.
+// Only the cached estimates are summed, the system prompt aside: this runs on every redraw for the gauge
+func (a *AppState) contextTurns(pending *contextTurn) (contextPrefix, []contextTurn) {
+	prefix := contextPrefix{msgs: a.chatHistoryPrefix()}
+	// Short and /system may change it at any time
+	prefix.tokens = providers.EstimateMessageTokens(prefix.msgs[0])
+	for _, at := range a.attachments {
+		prefix.tokens += at.tokens
+	}
+	path := a.conversation.path()
+	if a.summary != nil {
+		if idx := slices.Index(path, a.summary.through); idx != -1 {
+			prefix.msgs = append(prefix.msgs, a.summary.message())
+			prefix.tokens += a.summary.tokens
+			prefix.summarized = true
+			path = path[idx + 1:]
+		}
+	}
+
+	isUser := func(msg providers.AgnosticConversationMessage) bool {
+		return msg.Type == providers.MessageTypeUser || msg.Type == providers.MessageTypeUserContext
+	}
+	turns := []contextTurn{}
+	for i, id := range path {
+		node := a.conversation.nodes[id]
+		if len(turns) == 0 || isUser(node.msg) && !isUser(a.conversation.nodes[path[i - 1]].msg) {
+			turns = append(turns, contextTurn{})
+		}
+		turn := &turns[len(turns) - 1]
+		turn.msgs = append(turn.msgs, node.msg)
+		turn.last = id
+		turn.tokens += node.tokens
+	}
+	if pending != nil {
+		turns = append(turns, *pending)
+	}
+	return prefix, turns
+}
+
+// Leaves out the oldest turns until the rest fits, the last one is always kept even if it doesn't fit
+func (a *AppState) fitContext(pending *contextTurn) ([]providers.AgnosticConversationMessage, ContextUsage) {
+	prefix, turns := a.contextTurns(pending)
+	usage := ContextUsage{Tokens: prefix.tokens, Window: a.ContextWindow(), Summarized: prefix.summarized}
+	for _, turn := range turns {
+		usage.Tokens += turn.tokens
+	}
+
+	budget := a.contextBudget()
+	for budget > 0 && usage.Tokens > budget && usage.Dropped < len(turns) - 1 {
+		usage.Tokens -= turns[usage.Dropped].tokens
+		usage.Dropped += 1
+	}
+
+	history := prefix.msgs
+	if usage.Dropped > 0 {
+		note := providers.AgnosticConversationMessage{
+			Type: providers.MessageTypeUserContext,
+			Content: fmt.Sprintf("[%d earlier exchanges were left out to fit the context window]", usage.Dropped),
+		}
+		history = append(history, note)
+		usage.Tokens += providers.EstimateMessageTokens(note)
+	}
+	for _, turn := range turns[usage.Dropped:] {
+		history = append(history, turn.msgs...)
+	}
+	return history, usage
+}
+
+// ChatHistory made to fit the context window, as it is sent to providers
+func (a *AppState) RequestHistory() []providers.AgnosticConversationMessage {
+	history, _ := a.fitContext(nil)
+	return history
+}
+
+// Of the request the next prompt would make, what's in the context slots and the prompt editor included
+func (a *AppState) ContextUsage() ContextUsage {
+	pending := &contextTurn{last: -1}
+	for _, slot := range a.contextSlots {
+		if !slot.Empty() {
+			pending.tokens += slot.tokens
+		}
+	}
+	if !a.UserPromptEmpty() && !a.UserPromptIsCommand() {
+		pending.tokens += providers.EstimateMessageTokens(providers.AgnosticConversationMessage{
+			Type: providers.MessageTypeUser,
+			Content: string(a.UserPromptContent()),
+		})
+	}
+	if pending.tokens == 0 {
+		pending = nil
+	}
+	_, usage := a.fitContext(pending)
+	return usage
+}
+
+// nil unless the strategy is to summarize and the request doesn't fit. Enough turns are taken to get down to
+// half the budget, so that it doesn't happen again on the very next turn
+func (a *AppState) ContextSummaryJob() *SummaryJob {
+	budget := a.contextBudget()
+	if a.cfg.ContextStrategy != ContextStrategySummarize || budget == 0 || a.conversation.head == a.summarySkipHead {
+		return nil
+	}
+
+	prefix, turns := a.contextTurns(nil)
+	tokens := prefix.tokens
+	for _, turn := range turns {
+		tokens += turn.tokens
+	}
+	if tokens <= budget {
+		return nil
+	}
+
+	count := 0
+	for tokens > budget / 2 && count < len(turns) - 1 {
+		tokens -= turns[count].tokens
+		count += 1
+	}
+	if count == 0 {
+		return nil
+	}
+
+	job := &SummaryJob{through: turns[count - 1].last}
+	if prefix.summarized {
+		job.Messages = append(job.Messages, a.summary.message())
+	}
+	for _, turn := range turns[:count] {
+		job.Messages = append(job.Messages, turn.msgs...)
+	}
+	return job
+}
+
+func (a *AppState) ContextSummaryStore(job *SummaryJob, text string, meta providers.ResponseMetadata) {
+	a.usageAdd(meta)
+	if text == "" {
+		a.ContextSummaryFailed()
+		return
+	}
+	a.summary = &contextSummary{through: job.through, text: text}
+	a.summary.tokens = providers.EstimateMessageTokens(a.summary.message())
+}
+
+// Node ids only mean something in the conversation the summary was made for
+func (a *AppState) contextSummaryReset() {
+	a.summary = nil
+	a.summarySkipHead = -1
+}
+
+// Until the conversation moves on, requests are truncated instead
+func (a *AppState) ContextSummaryFailed() {
+	a.summarySkipHead = a.conversation.head
+}
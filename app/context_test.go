@@ -0,0 +1,200 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hello-llm-2/providers"
+)
+
+// System prompt of 4 tokens, all of them overhead. Requests get window - 100 tokens
+func testContextState(window int, strategy ContextStrategy) *AppState {
+	cfg := &AppConfig{
+		Provider: providers.ProviderLocal,
+		Model: "test-model",
+		Models: providers.DefaultModelCatalog(),
+		MaxTokens: 100,
+		ContextStrategy: strategy,
+	}
+	cfg.Local.ContextWindow = window
+	return NewAppState(cfg)
+}
+
+// A message estimated at exactly tokens
+func sizedMessage(msgType providers.MessageType, tokens int) providers.AgnosticConversationMessage {
+	return providers.AgnosticConversationMessage{Type: msgType, Content: strings.Repeat("a", 4 * (tokens - 4))}
+}
+
+// Turns of a user message and an answer, 200 tokens each
+func appendTurns(a *AppState, count int) {
+	for range count {
+		a.conversation.append(sizedMessage(providers.MessageTypeUser, 100))
+		a.conversation.append(sizedMessage(providers.MessageTypeAssistant, 100))
+	}
+}
+
+func TestFitContext(t *testing.T) {
+	cases := []struct {
+		name string
+		window int
+		strategy ContextStrategy
+		turns int
+		pending int
+		wantDropped int
+	}{
+		{"fits", 1000, ContextStrategyTruncate, 4, 0, 0},
+		{"oldest dropped", 1000, ContextStrategyTruncate, 6, 0, 2},
+		{"pending counts", 1000, ContextStrategyTruncate, 4, 150, 1},
+		{"last turn always kept", 150, ContextStrategyTruncate, 3, 0, 2},
+		{"pending turn always kept", 150, ContextStrategyTruncate, 3, 500, 3},
+		{"strategy off", 1000, ContextStrategyOff, 6, 0, 0},
+		{"unknown window", 0, ContextStrategyTruncate, 6, 0, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := testContextState(c.window, c.strategy)
+			appendTurns(a, c.turns)
+			var pending *contextTurn
+			if c.pending > 0 {
+				pending = &contextTurn{last: -1, tokens: c.pending}
+			}
+
+			history, usage := a.fitContext(pending)
+			if usage.Dropped != c.wantDropped {
+				t.Fatalf("dropped %d turns, want %d", usage.Dropped, c.wantDropped)
+			}
+			want := 1 + 2 * (c.turns - min(c.wantDropped, c.turns))
+			if c.wantDropped > 0 {
+				want += 1
+				if !strings.Contains(history[1].Content, "left out") {
+					t.Errorf("no note of what was left out: %q", history[1].Content)
+				}
+			}
+			if len(history) != want {
+				t.Errorf("%d messages, want %d", len(history), want)
+			}
+			turns := c.turns
+			if pending != nil {
+				turns += 1
+			}
+			if budget := a.contextBudget(); budget > 0 && usage.Tokens > budget && usage.Dropped < turns - 1 {
+				t.Errorf("%d tokens over a budget of %d with turns left to drop", usage.Tokens, budget)
+			}
+		})
+	}
+}
+
+func TestFitContextKeepsToolCallsWithResults(t *testing.T) {
+	a := testContextState(800, ContextStrategyTruncate)
+	appendTurns(a, 1)
+	// A single turn, the tool result isn't a user message
+	a.conversation.append(sizedMessage(providers.MessageTypeUser, 100))
+	call := sizedMessage(providers.MessageTypeToolCall, 50)
+	call.ToolCall = &providers.ToolCall{Id: "call_1", Name: "t"}
+	a.conversation.append(call)
+	result := sizedMessage(providers.MessageTypeToolResult, 200)
+	result.ToolCall = &providers.ToolCall{Id: "call_1", Name: "t"}
+	a.conversation.append(result)
+	a.conversation.append(sizedMessage(providers.MessageTypeAssistant, 100))
+	appendTurns(a, 1)
+
+	// 4 + 200 + 450 + 200 over a budget of 700, only the first turn goes
+	history, usage := a.fitContext(nil)
+	if usage.Dropped != 1 {
+		t.Fatalf("dropped %d turns, want 1", usage.Dropped)
+	}
+	types := []providers.MessageType{}
+	for _, msg := range history[2:] {
+		types = append(types, msg.Type)
+	}
+	want := []providers.MessageType{
+		providers.MessageTypeUser, providers.MessageTypeToolCall, providers.MessageTypeToolResult, providers.MessageTypeAssistant,
+		providers.MessageTypeUser, providers.MessageTypeAssistant,
+	}
+	if len(types) != len(want) {
+		t.Fatalf("got %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("got %v, want %v", types, want)
+		}
+	}
+
+	// Smaller than the tool turn alone, the call and its result still go together
+	a.cfg.Local.ContextWindow = 300
+	history, usage = a.fitContext(nil)
+	if usage.Dropped != 2 || len(history) != 1 + 1 + 2 {
+		t.Errorf("dropped %d turns, %d messages", usage.Dropped, len(history))
+	}
+	for i, msg := range history {
+		if msg.Type == providers.MessageTypeToolResult && (i == 0 || history[i - 1].Type != providers.MessageTypeToolCall) {
+			t.Errorf("tool result without its call at %d", i)
+		}
+	}
+}
+
+func TestContextSummaryJob(t *testing.T) {
+	a := testContextState(1000, ContextStrategySummarize)
+	appendTurns(a, 3)
+	if job := a.ContextSummaryJob(); job != nil {
+		t.Fatalf("job for a conversation that fits: %+v", job)
+	}
+
+	// 4 + 6 * 200 over a budget of 900, down to 450 takes the 4 oldest turns
+	appendTurns(a, 3)
+	job := a.ContextSummaryJob()
+	if job == nil {
+		t.Fatal("no job")
+	}
+	if len(job.Messages) != 8 || job.through != 7 {
+		t.Fatalf("%d messages through %d, want 8 through 7", len(job.Messages), job.through)
+	}
+
+	a.ContextSummaryStore(job, "Summary", providers.ResponseMetadata{})
+	history, usage := a.fitContext(nil)
+	if !usage.Summarized || usage.Dropped != 0 {
+		t.Errorf("usage %+v", usage)
+	}
+	if len(history) != 1 + 1 + 4 || !strings.Contains(history[1].Content, "Summary") {
+		t.Errorf("%d messages, second one %q", len(history), history[1].Content)
+	}
+	if job := a.ContextSummaryJob(); job != nil {
+		t.Errorf("job right after summarizing: %+v", job)
+	}
+
+	// The previous summary is summarized along with the turns
+	appendTurns(a, 3)
+	job = a.ContextSummaryJob()
+	if job == nil || !strings.Contains(job.Messages[0].Content, "Summary") {
+		t.Fatalf("job %+v", job)
+	}
+}
+
+func TestContextSummaryFailed(t *testing.T) {
+	a := testContextState(1000, ContextStrategySummarize)
+	appendTurns(a, 6)
+	job := a.ContextSummaryJob()
+	if job == nil {
+		t.Fatal("no job")
+	}
+
+	// Truncated instead, until the conversation moves on
+	a.ContextSummaryStore(job, "", providers.ResponseMetadata{})
+	if job := a.ContextSummaryJob(); job != nil {
+		t.Errorf("job after a failure: %+v", job)
+	}
+	if _, usage := a.fitContext(nil); usage.Summarized || usage.Dropped == 0 {
+		t.Errorf("usage %+v", usage)
+	}
+	appendTurns(a, 1)
+	if job := a.ContextSummaryJob(); job == nil {
+		t.Error("no job once the conversation moved on")
+	}
+
+	a = testContextState(1000, ContextStrategyTruncate)
+	appendTurns(a, 6)
+	if job := a.ContextSummaryJob(); job != nil {
+		t.Errorf("job when truncating: %+v", job)
+	}
+}
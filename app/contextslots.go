@@ -0,0 +1,128 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/hello-llm-2/fifo"
+	"github.com/hello-llm-2/providers"
+)
+
+// Context received on a FIFO, sent along with the next prompt then emptied
+type ContextSlot struct {
+	Name string
+	Path string
+	Failure NamedPipeFileFailureType
+	// Where the content comes from, given by the writer
+	Label string
+	Content string
+	// Images and PDFs written to the slot
+	Parts []providers.MessagePart
+	// Of message(), updated whenever something is written to the slot. Parts are only estimated as they come
+	tokens int
+	partTokens int
+}
+
+func newContextSlots(pipes []NamedPipeFile) []*ContextSlot {
+	slots := make([]*ContextSlot, 0, len(pipes))
+	for _, pipe := range pipes {
+		slots = append(slots, &ContextSlot{Name: pipe.Name, Path: pipe.Path, Failure: pipe.Failure})
+	}
+	return slots
+}
+
+func (slot *ContextSlot) clear() {
+	slot.Label = ""
+	slot.Content = ""
+	slot.Parts = nil
+	slot.tokens = 0
+	slot.partTokens = 0
+}
+
+func (slot *ContextSlot) Empty() bool {
+	return slot.Content == "" && len(slot.Parts) == 0
+}
+
+func (slot *ContextSlot) Size() int {
+	size := len(slot.Content)
+	for _, part := range slot.Parts {
+		size += len(part.Data)
+	}
+	return size
+}
+
+// The content as the model sees it, with where it comes from
+func (slot *ContextSlot) message() providers.AgnosticConversationMessage {
+	msg := providers.AgnosticConversationMessage{
+		Type: providers.MessageTypeUserContext,
+		Content: slot.Content,
+		Parts: slot.Parts,
+	}
+	if slot.Label != "" {
+		msg.Content = fmt.Sprintf("Context from %s:\n%s", slot.Label, slot.Content)
+	}
+	return msg
+}
+
+// Empty when the slot is listening
+func (slot *ContextSlot) FailureReason() string {
+	return NamedPipeFailureToString(slot.Failure)
+}
+
+func (a *AppState) contextSlot(name string) *ContextSlot {
+	for _, slot := range a.contextSlots {
+		if slot.Name == name {
+			return slot
+		}
+	}
+	return nil
+}
+
+func (a *AppState) ContextSlotExists(name string) bool {
+	return a.contextSlot(name) != nil
+}
+
+func (a *AppState) ContextSlots() []ContextSlot {
+	slots := make([]ContextSlot, 0, len(a.contextSlots))
+	for _, slot := range a.contextSlots {
+		slots = append(slots, *slot)
+	}
+	return slots
+}
+
+// Applies what was written to the FIFO of the slot, file payloads must have been resolved already
+func (a *AppState) ContextSlotReceive(name string, msg fifo.Message) {
+	slot := a.contextSlot(name)
+	if slot == nil {
+		return
+	}
+
+	switch {
+	case msg.Type == fifo.PayloadClear:
+		slot.clear()
+		return
+	case msg.Mode == fifo.ModeReplace:
+		slot.Content = ""
+		slot.Parts = nil
+		slot.partTokens = 0
+	}
+	if msg.MimeType != "" {
+		part := mediaPart(msg.Label, msg.MimeType, msg.Data)
+		slot.Parts = append(slot.Parts, part)
+		slot.partTokens += providers.EstimatePartTokens(part)
+	} else {
+		slot.Content += msg.Body
+	}
+	if msg.Label != "" {
+		slot.Label = msg.Label
+	}
+	text := slot.message()
+	text.Parts = nil
+	slot.tokens = providers.EstimateMessageTokens(text) + slot.partTokens
+}
+
+// The listener of the slot gave up, nothing will come from it anymore
+func (a *AppState) ContextSlotFailed(name string) {
+	if slot := a.contextSlot(name); slot != nil {
+		slot.Failure = NamedPipeFailureOther
+	}
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"slices"
+
+	"github.com/hello-llm-2/providers"
+	"github.com/hello-llm-2/session"
+)
+
+type conversationNode struct {
+	msg providers.AgnosticConversationMessage
+	// -1 for messages starting the conversation
+	parent int
+	children []int
+	// Child followed when coming back down to this node, i.e. the last branch visited
+	activeChild int
+	// Estimated once, the context gauge sums them on every redraw
+	tokens int
+}
+
+// Every message ever exchanged in a session, editing or regenerating a message adds a sibling instead of replacing it.
+// The conversation sent to the provider is the path from the root to head
+type conversation struct {
+	nodes []conversationNode
+	// Messages with no parent
+	roots []int
+	activeRoot int
+	// Last message of the active path, -1 when the path is empty
+	head int
+}
+
+func newConversation() *conversation {
+	return &conversation{head: -1}
+}
+
+// Children of parent, the roots when parent is -1
+func (c *conversation) children(parent int) []int {
+	if parent == -1 {
+		return c.roots
+	}
+	return c.nodes[parent].children
+}
+
+func (c *conversation) setActiveChild(parent int, child int) {
+	idx := slices.Index(c.children(parent), child)
+	if parent == -1 {
+		c.activeRoot = idx
+	} else {
+		c.nodes[parent].activeChild = idx
+	}
+}
+
+// Adds msg as a child of parent and moves head to it
+func (c *conversation) appendTo(parent int, msg providers.AgnosticConversationMessage) int {
+	id := len(c.nodes)
+	c.nodes = append(c.nodes, conversationNode{msg: msg, parent: parent, tokens: providers.EstimateMessageTokens(msg)})
+	if parent == -1 {
+		c.roots = append(c.roots, id)
+	} else {
+		c.nodes[parent].children = append(c.nodes[parent].children, id)
+	}
+	c.setActiveChild(parent, id)
+	c.head = id
+	return id
+}
+
+func (c *conversation) append(msg providers.AgnosticConversationMessage) int {
+	return c.appendTo(c.head, msg)
+}
+
+// Node ids from the root to head
+func (c *conversation) path() []int {
+	ids := []int{}
+	for id := c.head; id != -1; id = c.nodes[id].parent {
+		ids = append(ids, id)
+	}
+	slices.Reverse(ids)
+	return ids
+}
+
+func (c *conversation) messages() []providers.AgnosticConversationMessage {
+	ids := c.path()
+	msgs := make([]providers.AgnosticConversationMessage, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, c.nodes[id].msg)
+	}
+	return msgs
+}
+
+// Follows the last visited branches down from id
+func (c *conversation) descend(id int) int {
+	for len(c.nodes[id].children) > 0 {
+		node := c.nodes[id]
+		id = node.children[node.activeChild]
+	}
+	return id
+}
+
+// Position of id among its siblings
+func (c *conversation) siblingPosition(id int) (index int, count int) {
+	siblings := c.children(c.nodes[id].parent)
+	return slices.Index(siblings, id), len(siblings)
+}
+
+// Moves head to the branch next to the one of id (offset -1 or 1), returns false when there is none
+func (c *conversation) switchSibling(id int, offset int) bool {
+	parent := c.nodes[id].parent
+	siblings := c.children(parent)
+	idx := slices.Index(siblings, id) + offset
+	if idx < 0 || idx >= len(siblings) {
+		return false
+	}
+	c.setActiveChild(parent, siblings[idx])
+	c.head = c.descend(siblings[idx])
+	return true
+}
+
+// Deepest message of the active path that has siblings, -1 when the conversation never forked
+func (c *conversation) lastFork() int {
+	ids := c.path()
+	for i := len(ids) - 1; i >= 0; i-- {
+		if _, count := c.siblingPosition(ids[i]); count > 1 {
+			return ids[i]
+		}
+	}
+	return -1
+}
+
+func (c *conversation) toSession() ([]session.Node, int) {
+	nodes := make([]session.Node, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, session.Node{Message: node.msg, Parent: node.parent})
+	}
+	return nodes, c.head
+}
+
+// Nodes are stored in creation order so a parent always comes before its children
+func conversationFromSession(s *session.Session) *conversation {
+	c := newConversation()
+	if len(s.Nodes) == 0 {
+		// Sessions saved before the tree only have the flat history, system messages included
+		for _, msg := range s.Messages {
+			if msg.Type != providers.MessageTypeSystem {
+				c.append(msg)
+			}
+		}
+		return c
+	}
+
+	for _, node := range s.Nodes {
+		parent := node.Parent
+		if parent >= len(c.nodes) {
+			parent = -1
+		}
+		c.appendTo(parent, node.Message)
+	}
+	if s.Head >= -1 && s.Head < len(c.nodes) {
+		c.head = s.Head
+		// Siblings visited last are the ones of the saved head
+		for id := c.head; id != -1; id = c.nodes[id].parent {
+			c.setActiveChild(c.nodes[id].parent, id)
+		}
+	}
+	return c
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"slices"
+	"unicode"
+)
+
+type LineEdit int
+
+const (
+	LineEditCursorLeft LineEdit = iota
+	LineEditCursorRight
+	LineEditWordLeft
+	LineEditWordRight
+	// Home and End work on the line the cursor is on, the buffer may hold several
+	LineEditHome
+	LineEditEnd
+	LineEditBackspace
+	LineEditDelete
+	LineEditKillToEnd
+	LineEditKillToStart
+	LineEditKillWordBack
+	LineEditNewLine
+	// Keep the column when possible
+	LineEditLineUp
+	LineEditLineDown
+)
+
+// An editable buffer with a cursor, cursor is an index in runes and may be equal to len(buf)
+type LineEditor struct {
+	buf []rune
+	cursor int
+}
+
+func (e *LineEditor) Insert(r rune) {
+	e.buf = slices.Insert(e.buf, e.cursor, r)
+	e.cursor += 1
+}
+
+func (e *LineEditor) InsertString(s string) {
+	runes := []rune(s)
+	e.buf = slices.Insert(e.buf, e.cursor, runes...)
+	e.cursor += len(runes)
+}
+
+// Replaces the content and puts the cursor at the end
+func (e *LineEditor) Set(s string) {
+	e.buf = []rune(s)
+	e.cursor = len(e.buf)
+}
+
+func (e *LineEditor) Clear() {
+	e.buf = e.buf[:0]
+	e.cursor = 0
+}
+
+func (e *LineEditor) Content() []rune {
+	return e.buf
+}
+
+func (e *LineEditor) String() string {
+	return string(e.buf)
+}
+
+func (e *LineEditor) Empty() bool {
+	return len(e.buf) == 0
+}
+
+func (e *LineEditor) Cursor() int {
+	return e.cursor
+}
+
+func (e *LineEditor) lineStart() int {
+	i := e.cursor
+	for i > 0 && e.buf[i-1] != '\n' {
+		i -= 1
+	}
+	return i
+}
+
+func (e *LineEditor) lineEnd() int {
+	i := e.cursor
+	for i < len(e.buf) && e.buf[i] != '\n' {
+		i += 1
+	}
+	return i
+}
+
+// Start of the word before the cursor, like readline's Alt-b
+func (e *LineEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && !isWordRune(e.buf[i-1]) {
+		i -= 1
+	}
+	for i > 0 && isWordRune(e.buf[i-1]) {
+		i -= 1
+	}
+	return i
+}
+
+func (e *LineEditor) wordEnd() int {
+	i := e.cursor
+	for i < len(e.buf) && !isWordRune(e.buf[i]) {
+		i += 1
+	}
+	for i < len(e.buf) && isWordRune(e.buf[i]) {
+		i += 1
+	}
+	return i
+}
+
+func (e *LineEditor) OnFirstLine() bool {
+	return !slices.Contains(e.buf[:e.cursor], '\n')
+}
+
+func (e *LineEditor) OnLastLine() bool {
+	return !slices.Contains(e.buf[e.cursor:], '\n')
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// Removes buf[from:to] and leaves the cursor at from
+func (e *LineEditor) cut(from int, to int) {
+	e.buf = slices.Delete(e.buf, from, to)
+	e.cursor = from
+}
+
+func (e *LineEditor) Apply(edit LineEdit) {
+	switch edit {
+	case LineEditCursorLeft:
+		e.cursor = max(0, e.cursor - 1)
+	case LineEditCursorRight:
+		e.cursor = min(len(e.buf), e.cursor + 1)
+	case LineEditWordLeft:
+		e.cursor = e.wordStart()
+	case LineEditWordRight:
+		e.cursor = e.wordEnd()
+	case LineEditHome:
+		e.cursor = e.lineStart()
+	case LineEditEnd:
+		e.cursor = e.lineEnd()
+	case LineEditBackspace:
+		if e.cursor > 0 {
+			e.cut(e.cursor - 1, e.cursor)
+		}
+	case LineEditDelete:
+		if e.cursor < len(e.buf) {
+			e.cut(e.cursor, e.cursor + 1)
+		}
+	case LineEditKillToEnd:
+		// Like readline, killing at the end of a line joins it with the next one
+		end := e.lineEnd()
+		if end == e.cursor && end < len(e.buf) {
+			end += 1
+		}
+		e.cut(e.cursor, end)
+	case LineEditKillToStart:
+		e.cut(e.lineStart(), e.cursor)
+	case LineEditKillWordBack:
+		e.cut(e.wordStart(), e.cursor)
+	case LineEditNewLine:
+		e.Insert('\n')
+	case LineEditLineUp:
+		start := e.lineStart()
+		if start == 0 {
+			return
+		}
+		column := e.cursor - start
+		e.cursor = start - 1
+		e.cursor = min(e.lineStart() + column, start - 1)
+	case LineEditLineDown:
+		end := e.lineEnd()
+		if end == len(e.buf) {
+			return
+		}
+		column := e.cursor - e.lineStart()
+		e.cursor = end + 1
+		e.cursor = min(e.cursor + column, e.lineEnd())
+	}
+}
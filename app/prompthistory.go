@@ -0,0 +1,133 @@
+package app
+
+import (
+	"github.com/hello-llm-2/history"
+)
+
+// State of an ongoing Ctrl-R search
+type HistorySearch struct {
+	Query []rune
+	// Index in the history, -1 when nothing matches
+	Match int
+	// Prompt before the search started, restored when it is cancelled
+	draft string
+}
+
+func (a *AppState) HistorySet(h *history.History) {
+	a.history = h
+	a.historyIdx = h.Len()
+}
+
+// Records a submitted prompt and stops browsing the history
+func (a *AppState) HistoryAppend(prompt string) error {
+	err := a.history.Append(prompt)
+	a.historyIdx = a.history.Len()
+	a.historyDraft = ""
+	return err
+}
+
+func (a *AppState) HistoryPrev() {
+	if a.historyIdx == 0 {
+		return
+	}
+	// What was being typed is kept so coming back down gives it back
+	if a.historyIdx == a.history.Len() {
+		a.historyDraft = a.userPrompt.String()
+	}
+	a.historyIdx -= 1
+	a.userPrompt.Set(a.history.At(a.historyIdx))
+}
+
+func (a *AppState) HistoryNext() {
+	if a.historyIdx >= a.history.Len() {
+		return
+	}
+	a.historyIdx += 1
+	if a.historyIdx == a.history.Len() {
+		a.userPrompt.Set(a.historyDraft)
+	} else {
+		a.userPrompt.Set(a.history.At(a.historyIdx))
+	}
+}
+
+// Up moves inside a multi-line prompt and only goes through the history from its first line
+func (a *AppState) UserPromptUp() {
+	if a.userPrompt.OnFirstLine() {
+		a.HistoryPrev()
+	} else {
+		a.userPrompt.Apply(LineEditLineUp)
+	}
+}
+
+func (a *AppState) UserPromptDown() {
+	if a.userPrompt.OnLastLine() {
+		a.HistoryNext()
+	} else {
+		a.userPrompt.Apply(LineEditLineDown)
+	}
+}
+
+// nil when no search is ongoing
+func (a *AppState) HistorySearch() *HistorySearch {
+	return a.historySearch
+}
+
+// Starts a search, or looks for an older match when one is already ongoing
+func (a *AppState) HistorySearchStart() {
+	if a.historySearch == nil {
+		a.historySearch = &HistorySearch{Match: -1, draft: a.userPrompt.String()}
+		return
+	}
+
+	search := a.historySearch
+	if search.Match == -1 || len(search.Query) == 0 {
+		return
+	}
+	if older := a.history.SearchBackward(string(search.Query), search.Match); older != -1 {
+		search.Match = older
+	}
+}
+
+func (a *AppState) historySearchUpdate() {
+	search := a.historySearch
+	if len(search.Query) == 0 {
+		search.Match = -1
+		return
+	}
+	search.Match = a.history.SearchBackward(string(search.Query), a.history.Len())
+}
+
+func (a *AppState) HistorySearchAppendRune(r rune) {
+	a.historySearch.Query = append(a.historySearch.Query, r)
+	a.historySearchUpdate()
+}
+
+func (a *AppState) HistorySearchPop() {
+	if len(a.historySearch.Query) > 0 {
+		a.historySearch.Query = a.historySearch.Query[:len(a.historySearch.Query)-1]
+	}
+	a.historySearchUpdate()
+}
+
+// Text of the current match, empty when there is none
+func (a *AppState) HistorySearchMatch() string {
+	if a.historySearch == nil || a.historySearch.Match == -1 {
+		return ""
+	}
+	return a.history.At(a.historySearch.Match)
+}
+
+// Puts the match in the prompt, where it can be edited before being submitted
+func (a *AppState) HistorySearchAccept() {
+	if a.historySearch.Match != -1 {
+		a.historyIdx = a.historySearch.Match
+		a.historyDraft = a.historySearch.draft
+		a.userPrompt.Set(a.history.At(a.historySearch.Match))
+	}
+	a.historySearch = nil
+}
+
+func (a *AppState) HistorySearchCancel() {
+	a.userPrompt.Set(a.historySearch.draft)
+	a.historySearch = nil
+}
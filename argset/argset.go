@@ -11,6 +11,8 @@ const (
 	argTypeBool = iota
 	argTypeInt
 	argTypeString
+	// Can be given several times, each value is appended
+	argTypeStringList
 )
 
 type argDef struct {
@@ -20,18 +22,21 @@ type argDef struct {
 	short rune
 	long string
 	description string
+	// Given on the command line, as opposed to left to its default
+	set bool
 }
 
 type ArgSet struct {
 	args []argDef
 	ignoredArgs []string
 	description string
+	usage string
 }
 
 var ErrHelp = errors.New("help requested")
 
 func NewArgSet() ArgSet {
-	return ArgSet{}
+	return ArgSet{usage: "hello [OPTIONS] [PROMPT...]"}
 }
 
 func (a *ArgSet) Args() []string {
@@ -42,6 +47,17 @@ func (a *ArgSet) Description(description string) {
 	a.description = description
 }
 
+// e.g. "hello ctx [OPTIONS]", shown after "Usage: "
+func (a *ArgSet) Usage(usage string) {
+	a.usage = usage
+}
+
+// Whether the argument was given, so that it can win over settings that come from elsewhere, e.g. a config file
+func (a *ArgSet) IsSet(long string) bool {
+	def := a.tryFindDef(long, '\x00')
+	return def != nil && def.set
+}
+
 func (a *ArgSet) AddFlag(retValue *bool, short rune, long string, defaultValue bool, description string) {
 	a.args = append(a.args, argDef{retValue: retValue, argType: argTypeBool, value: defaultValue, short: short, long: long, description: description})
 }
@@ -54,12 +70,16 @@ func (a *ArgSet) AddString(retValue *string, short rune, long string, defaultVal
 	a.args = append(a.args, argDef{retValue: retValue, argType: argTypeString, value: defaultValue, short: short, long: long, description: description})
 }
 
+func (a *ArgSet) AddStringList(retValue *[]string, short rune, long string, description string) {
+	a.args = append(a.args, argDef{retValue: retValue, argType: argTypeStringList, value: nil, short: short, long: long, description: description})
+}
+
 func (a *ArgSet) PrintHelp() {
 	if a.description != "" {
 		fmt.Println(a.description)
 		fmt.Println()
 	}
-	fmt.Println("Usage: hello [OPTIONS] [PROMPT...]")
+	fmt.Println("Usage:", a.usage)
 	fmt.Println()
 	fmt.Println("Options:")
 	for _, def := range a.args {
@@ -69,6 +89,8 @@ func (a *ArgSet) PrintHelp() {
 			typeHint = " <int>"
 		case argTypeString:
 			typeHint = " <string>"
+		case argTypeStringList:
+			typeHint = " <string>..."
 		}
 		if (def.short != '\x00') {
 			fmt.Printf("  -%c, --%-20s %s\n", def.short, def.long+typeHint, def.description)
@@ -77,6 +99,8 @@ func (a *ArgSet) PrintHelp() {
 		}
 	}
 	fmt.Printf("  -%c, --%-20s %s\n", 'h', "help", "Show this help message")
+	fmt.Println()
+	fmt.Println("Flags take --<flag>=false or --no-<flag> to turn off what the config file turned on.")
 }
 
 func (a *ArgSet) tryFindDef(long string, short rune) *argDef {
@@ -94,9 +118,12 @@ func (a *ArgSet) tryFindDef(long string, short rune) *argDef {
 
 func readValueInNextArgs(arg string, cursor *int, args []string) (string, error) {
 	*cursor += 1
-	if args[*cursor] == "=" {
+	if *cursor < len(args) && args[*cursor] == "=" {
 		*cursor += 1
 	}
+	if *cursor >= len(args) {
+		return "", errors.New(fmt.Sprintf("%s expects a value", arg))
+	}
 	value := args[*cursor]
 	if strings.HasPrefix(value, "-") {
 		return "", errors.New(fmt.Sprintf("%s: value can't start with '-' or '--'", arg))
@@ -116,6 +143,12 @@ func parseValueToType(arg string, dest any, argType int, value string) error {
 		} else {
 			panic("Expected dest to be an int pointer")
 		}
+	} else if argType == argTypeStringList {
+		if p, ok := dest.(*[]string); ok {
+			*p = append(*p, value)
+		} else {
+			panic("Expected dest to be a string slice pointer")
+		}
 	} else {
 		if p, ok := dest.(*string); ok {
 			*p = value
@@ -143,20 +176,37 @@ func (a *ArgSet) Parse(args []string) error {
 
 		if len(arg) > 2 && arg[:2] == "--" {
 			long, _, _ := strings.Cut(arg[2:], "=")
-			def := a.tryFindDef(long, '0')
+			def := a.tryFindDef(long, '\x00')
+			negated := false
 			if def == nil {
-				return errors.New(fmt.Sprintf("Unknown argument: %s", arg))
+				// --no-<flag>
+				if name, found := strings.CutPrefix(long, "no-"); found {
+					def = a.tryFindDef(name, '\x00')
+					negated = def != nil && def.argType == argTypeBool && !strings.Contains(arg, "=")
+				}
+				if !negated {
+					return errors.New(fmt.Sprintf("Unknown argument: %s", arg))
+				}
 			}
+			def.set = true
 
 			var value string
 			switch def.argType {
 			case argTypeBool:
-				if p, ok := def.retValue.(*bool); ok {
-					*p = !def.value.(bool)
-				} else {
+				p, ok := def.retValue.(*bool)
+				if !ok {
 					panic("Expected a bool pointer")
 				}
-			case argTypeInt, argTypeString:
+				if _, after, found := strings.Cut(arg, "="); found {
+					b, err := strconv.ParseBool(after)
+					if err != nil {
+						return errors.New(fmt.Sprintf("%s expects true or false", arg))
+					}
+					*p = b
+				} else {
+					*p = !negated && !def.value.(bool)
+				}
+			case argTypeInt, argTypeString, argTypeStringList:
 				if _, after, found := strings.Cut(arg, "="); found {
 					value = after
 				} else {
@@ -179,6 +229,7 @@ func (a *ArgSet) Parse(args []string) error {
 				if def == nil {
 					return errors.New(fmt.Sprintf("Unknown argument: -%c", short))
 				}
+				def.set = true
 
 				var value string
 				switch def.argType {
@@ -188,7 +239,7 @@ func (a *ArgSet) Parse(args []string) error {
 					} else {
 						panic("Expected a bool pointer")
 					}
-				case argTypeInt, argTypeString:
+				case argTypeInt, argTypeString, argTypeStringList:
 					if before, after, found := strings.Cut(arg, "="); found {
 						if len(before) > 2 {
 							return errors.New(fmt.Sprintf("Compound arguments cannot be assigned a value: %s\nUse the long version or separate each flag", arg))
@@ -0,0 +1,64 @@
+package argset
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		web bool
+		tools bool
+		model string
+		set []string
+		rest []string
+		wantErr bool
+	}{
+		{name: "nothing", args: []string{"hi"}, rest: []string{"hi"}},
+		{name: "long flag", args: []string{"--web-search"}, web: true, set: []string{"web-search"}},
+		{name: "short flags", args: []string{"-wt"}, web: true, tools: true, set: []string{"web-search", "tools"}},
+		{name: "flag turned off", args: []string{"--no-web-search"}, web: false, set: []string{"web-search"}},
+		{name: "flag set to false", args: []string{"--web-search=false"}, web: false, set: []string{"web-search"}},
+		{name: "flag set to true", args: []string{"--tools=true"}, tools: true, set: []string{"tools"}},
+		{name: "invalid flag value", args: []string{"--tools=maybe"}, wantErr: true},
+		{name: "no- only for flags", args: []string{"--no-model"}, wantErr: true},
+		{name: "no- takes no value", args: []string{"--no-tools=true"}, wantErr: true},
+		{name: "string", args: []string{"--model", "gpt", "hi"}, model: "gpt", set: []string{"model"}, rest: []string{"hi"}},
+		{name: "string with equal sign", args: []string{"--model=gpt"}, model: "gpt", set: []string{"model"}},
+		{name: "unknown", args: []string{"--nope"}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			web, tools, model := false, false, ""
+			args := NewArgSet()
+			args.AddFlag(&web, 'w', "web-search", false, "")
+			args.AddFlag(&tools, 't', "tools", false, "")
+			args.AddString(&model, '\x00', "model", "", "")
+
+			err := args.Parse(c.args)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if web != c.web || tools != c.tools || model != c.model {
+				t.Errorf("got %v %v %q, want %v %v %q", web, tools, model, c.web, c.tools, c.model)
+			}
+			for _, long := range []string{"web-search", "tools", "model"} {
+				if args.IsSet(long) != slices.Contains(c.set, long) {
+					t.Errorf("%s: IsSet %v", long, args.IsSet(long))
+				}
+			}
+			if !slices.Equal(args.Args(), c.rest) {
+				t.Errorf("rest %q, want %q", args.Args(), c.rest)
+			}
+		})
+	}
+}
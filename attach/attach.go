@@ -0,0 +1,253 @@
+// Files given with -f or /attach, expanded from globs and packaged for the model
+//
+// Patterns are paths relative to the working directory and may use the filepath.Match syntax in any segment,
+// "**" matching any number of directories. A directory stands for everything under it.
+// Files found by expanding a pattern skip what .gitignore excludes, a file named explicitly is always read.
+
+package attach
+
+import (
+	"os"
+	"fmt"
+	"html"
+	"bytes"
+	"errors"
+	"strings"
+	"net/http"
+	"unicode/utf8"
+	"path/filepath"
+)
+
+// Text files bigger than that are most likely a mistake, the whole content ends up in the conversation
+const MaxFileSize int64 = 1024 * 1024
+
+// Images and PDFs are sent as they are, providers have their own (bigger) limits
+const MaxMediaSize int64 = 10 * 1024 * 1024
+
+// Guards against "**" at the root of a huge tree
+const MaxFiles int = 200
+
+var (
+	ErrNoMatch error = errors.New("No file matches")
+	ErrTooManyFiles error = errors.New("Too many files")
+	ErrFileTooBig error = errors.New("File is too big")
+	ErrBinary error = errors.New("Binary file that is neither an image nor a PDF")
+)
+
+type File struct {
+	// As given or found, relative to the working directory unless the pattern was absolute
+	Path string
+	// Empty for media
+	Content string
+	// Only set for images and PDFs, see MediaType
+	MimeType string
+	Data []byte
+}
+
+func (f File) IsMedia() bool {
+	return f.MimeType != ""
+}
+
+// MIME type of the content when it's an image or a PDF the providers take as is, empty otherwise
+func MediaType(data []byte) string {
+	mime := http.DetectContentType(data)
+	switch mime {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf":
+		return mime
+	default:
+		return ""
+	}
+}
+
+func IsDocument(mimeType string) bool {
+	return mimeType == "application/pdf"
+}
+
+// A file that matched but won't be attached
+type Skipped struct {
+	Path string
+	Reason string
+}
+
+// Quotes in a path would end the attribute early
+func formatPath(path string) string {
+	return html.EscapeString(path)
+}
+
+// Content with the closing tag in it would end the block early
+var closingTagEscaper = strings.NewReplacer("</file>", "<\\/file>")
+
+// The delimited block the model receives, the same for every attachment
+func Format(path string, content string) string {
+	content = closingTagEscaper.Replace(content)
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return fmt.Sprintf("<file path=\"%s\">\n%s</file>", formatPath(path), content)
+}
+
+// Media go in their own message part, this introduces them
+func FormatMedia(path string, mimeType string) string {
+	return fmt.Sprintf("<file path=\"%s\" type=\"%s\" />", formatPath(path), mimeType)
+}
+
+func hasMeta(segment string) bool {
+	return strings.ContainsAny(segment, "*?[")
+}
+
+// A NUL byte in the first few KB is what git looks at too, invalid UTF-8 is just as useless to the model
+func isBinary(data []byte) bool {
+	head := data[:min(len(data), 8000)]
+	return bytes.IndexByte(head, 0) != -1 || !utf8.Valid(data)
+}
+
+// Text files as text, images and PDFs as data, other binaries are refused
+func ReadFile(path string) (File, error) {
+	stats, err := os.Stat(path)
+	if err != nil {
+		return File{}, err
+	}
+	if stats.Size() > MaxMediaSize {
+		return File{}, fmt.Errorf("%w: more than %d MB", ErrFileTooBig, MaxMediaSize / (1024 * 1024))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return File{}, err
+	}
+	return FromData(path, data)
+}
+
+// Same as ReadFile for content that was read already, e.g. from a FIFO
+func FromData(path string, data []byte) (File, error) {
+	if mime := MediaType(data); mime != "" {
+		if int64(len(data)) > MaxMediaSize {
+			return File{}, fmt.Errorf("%w: more than %d MB", ErrFileTooBig, MaxMediaSize / (1024 * 1024))
+		}
+		return File{Path: path, MimeType: mime, Data: data}, nil
+	}
+	if int64(len(data)) > MaxFileSize {
+		return File{}, fmt.Errorf("%w: more than %d KB of text", ErrFileTooBig, MaxFileSize / 1024)
+	}
+	if isBinary(data) {
+		return File{}, ErrBinary
+	}
+	return File{Path: path, Content: string(data)}, nil
+}
+
+// Matches path segments against pattern segments, "**" eats zero or more of them
+func matchSegments(pattern []string, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// Files under root the rest of the pattern matches, nil rest means every file
+func walk(root string, rest []string, ignore *gitignore) ([]string, error) {
+	found := []string{}
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are not worth failing the whole pattern
+			return nil
+		}
+		if path != root && ignore.ignored(path, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !entry.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if rest == nil || matchSegments(rest, strings.Split(filepath.ToSlash(rel), "/")) {
+			found = append(found, path)
+			if len(found) > MaxFiles {
+				return ErrTooManyFiles
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Paths of the files a pattern stands for
+func expand(pattern string, ignore *gitignore) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	stats, err := os.Stat(pattern)
+	switch {
+	case err == nil && stats.IsDir():
+		return walk(pattern, nil, ignore)
+	case err == nil:
+		return []string{pattern}, nil
+	}
+
+	// Walks from the longest part without wildcards
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	static := 0
+	for static < len(segments) && !hasMeta(segments[static]) {
+		static += 1
+	}
+	if static == len(segments) {
+		return nil, err
+	}
+	root := strings.Join(segments[:static], "/")
+	if root == "" && strings.HasPrefix(pattern, "/") {
+		root = "/"
+	} else if root == "" {
+		root = "."
+	}
+	return walk(filepath.FromSlash(root), segments[static:], ignore)
+}
+
+// Reads the files matching patterns, in order and without duplicates.
+// Unreadable and binary files are reported as skipped, a pattern matching nothing is an error
+func Collect(patterns []string) ([]File, []Skipped, error) {
+	files := []File{}
+	skipped := []Skipped{}
+	seen := map[string]bool{}
+	ignore := newGitignore()
+
+	for _, pattern := range patterns {
+		paths, err := expand(pattern, ignore)
+		if errors.Is(err, ErrTooManyFiles) {
+			return nil, nil, fmt.Errorf("%w: %s matches more than %d files", ErrTooManyFiles, pattern, MaxFiles)
+		} else if errors.Is(err, os.ErrNotExist) || err == nil && len(paths) == 0 {
+			return nil, nil, fmt.Errorf("%w: %s", ErrNoMatch, pattern)
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		for _, path := range paths {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			file, err := ReadFile(path)
+			if err != nil {
+				skipped = append(skipped, Skipped{Path: path, Reason: err.Error()})
+			} else {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, skipped, nil
+}
@@ -0,0 +1,132 @@
+package attach
+
+import (
+	"os"
+	"strings"
+	"path/filepath"
+)
+
+// The parts of the .gitignore syntax people actually use: comments, negation, trailing '/' for directories,
+// patterns anchored by a '/' and "**"
+type gitignoreRule struct {
+	segments []string
+	negate bool
+	dirOnly bool
+	// Matched against the path relative to the .gitignore, otherwise against the name at any depth
+	anchored bool
+}
+
+func (rule gitignoreRule) matches(rel []string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if rule.anchored {
+		return matchSegments(rule.segments, rel)
+	}
+	ok, _ := filepath.Match(rule.segments[0], rel[len(rel)-1])
+	return ok
+}
+
+func parseGitignore(data string) []gitignoreRule {
+	rules := []gitignoreRule{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := gitignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		// \# and \! are literal
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		rule.segments = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Rules of the .gitignore files of the repositories files are found in, loaded as they are needed.
+// Outside of a git repository nothing is ignored, like git
+type gitignore struct {
+	rules map[string][]gitignoreRule
+	// Repository root of each directory looked up, empty when not in one
+	roots map[string]string
+}
+
+func newGitignore() *gitignore {
+	return &gitignore{rules: map[string][]gitignoreRule{}, roots: map[string]string{}}
+}
+
+func (g *gitignore) dirRules(dir string) []gitignoreRule {
+	rules, loaded := g.rules[dir]
+	if !loaded {
+		data, _ := os.ReadFile(filepath.Join(dir, ".gitignore"))
+		rules = parseGitignore(string(data))
+		g.rules[dir] = rules
+	}
+	return rules
+}
+
+func (g *gitignore) repoRoot(dir string) string {
+	if root, found := g.roots[dir]; found {
+		return root
+	}
+	root := ""
+	if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+		root = dir
+	} else if parent := filepath.Dir(dir); parent != dir {
+		root = g.repoRoot(parent)
+	}
+	g.roots[dir] = root
+	return root
+}
+
+// Deeper .gitignore files and later rules win, as with git
+func (g *gitignore) ignored(path string, isDir bool) bool {
+	if filepath.Base(path) == ".git" {
+		return true
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	root := g.repoRoot(filepath.Dir(abs))
+	if root == "" {
+		return false
+	}
+
+	dirs := []string{}
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == root {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], abs)
+		if err != nil {
+			continue
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for _, rule := range g.dirRules(dirs[i]) {
+			if rule.matches(segments, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,172 @@
+package attach
+
+import (
+	"os"
+	"testing"
+	"path/filepath"
+)
+
+func TestMatchSegments(t *testing.T) {
+	cases := []struct {
+		pattern []string
+		path []string
+		want bool
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, true},
+		{[]string{"a", "*.go"}, []string{"a", "x.go"}, true},
+		{[]string{"a", "*.go"}, []string{"a", "b", "x.go"}, false},
+		{[]string{"a"}, []string{"a", "b"}, false},
+		{[]string{"**", "x.go"}, []string{"x.go"}, true},
+		{[]string{"**", "x.go"}, []string{"a", "b", "x.go"}, true},
+		{[]string{"a", "**", "b"}, []string{"a", "b"}, true},
+		{[]string{"a", "**", "b"}, []string{"a", "x", "y", "b"}, true},
+		{[]string{"a", "**", "b"}, []string{"a", "x", "c"}, false},
+		{[]string{"a", "**"}, []string{"a"}, true},
+		{[]string{"a", "**"}, []string{"a", "x", "y"}, true},
+		{[]string{"**"}, []string{}, true},
+		{[]string{"[ab]", "?.go"}, []string{"b", "x.go"}, true},
+	}
+	for _, c := range cases {
+		if got := matchSegments(c.pattern, c.path); got != c.want {
+			t.Errorf("%q against %q: got %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+// Makes a repository in a temporary directory, files maps paths to their content, a trailing '/' makes a directory
+func testRepo(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(full), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if path[len(path)-1] == '/' {
+			if err := os.MkdirAll(full, 0700); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(full, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestGitignore(t *testing.T) {
+	cases := []struct {
+		name string
+		files map[string]string
+		// Path relative to the repository, a trailing '/' for directories
+		ignored map[string]bool
+	}{
+		{
+			name: "unanchored",
+			files: map[string]string{".gitignore": "*.log\n"},
+			ignored: map[string]bool{"a.log": true, "sub/deep/b.log": true, "a.txt": false},
+		},
+		{
+			name: "negation",
+			files: map[string]string{".gitignore": "*.log\n!keep.log\n"},
+			ignored: map[string]bool{"a.log": true, "keep.log": false, "sub/keep.log": false},
+		},
+		{
+			name: "later rule wins",
+			files: map[string]string{".gitignore": "!keep.log\n*.log\n"},
+			ignored: map[string]bool{"keep.log": true},
+		},
+		{
+			name: "dir-only",
+			files: map[string]string{".gitignore": "build/\n"},
+			ignored: map[string]bool{"build/": true, "sub/build/": true, "build": false, "sub/build": false},
+		},
+		{
+			name: "anchored by a leading slash",
+			files: map[string]string{".gitignore": "/todo.txt\n"},
+			ignored: map[string]bool{"todo.txt": true, "sub/todo.txt": false},
+		},
+		{
+			name: "anchored by a middle slash",
+			files: map[string]string{".gitignore": "doc/*.txt\n"},
+			ignored: map[string]bool{"doc/a.txt": true, "doc/sub/a.txt": false, "x/doc/a.txt": false},
+		},
+		{
+			name: "anchored to its own directory",
+			files: map[string]string{"sub/.gitignore": "/gen.go\n"},
+			ignored: map[string]bool{"sub/gen.go": true, "gen.go": false, "sub/x/gen.go": false},
+		},
+		{
+			name: "deeper gitignore wins",
+			files: map[string]string{".gitignore": "*.txt\n", "sub/.gitignore": "!notes.txt\n"},
+			ignored: map[string]bool{"notes.txt": true, "sub/notes.txt": false, "sub/other.txt": true, "sub/x/notes.txt": false},
+		},
+		{
+			name: "deeper gitignore ignores again",
+			files: map[string]string{".gitignore": "!*.txt\n", "sub/.gitignore": "*.txt\n"},
+			ignored: map[string]bool{"a.txt": false, "sub/a.txt": true},
+		},
+		{
+			name: "double star matching zero directories",
+			files: map[string]string{".gitignore": "**/logs\na/**/b.txt\n"},
+			ignored: map[string]bool{"logs/": true, "x/y/logs/": true, "a/b.txt": true, "a/x/y/b.txt": true, "b.txt": false},
+		},
+		{
+			name: "comments and escapes",
+			files: map[string]string{".gitignore": "# not a rule\n\\#hash\n\\!bang\n  \n"},
+			ignored: map[string]bool{"# not a rule": false, "#hash": true, "!bang": true},
+		},
+		{
+			name: "git directory",
+			files: map[string]string{},
+			ignored: map[string]bool{".git/": true, "sub/.git": true},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := testRepo(t, c.files)
+			ignore := newGitignore()
+			for path, want := range c.ignored {
+				isDir := path[len(path)-1] == '/'
+				full := filepath.Join(root, filepath.FromSlash(path))
+				if got := ignore.ignored(full, isDir); got != want {
+					t.Errorf("%s: got %v, want %v", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGitignoreOutsideRepository(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*\n"), 0600)
+	if newGitignore().ignored(filepath.Join(root, "a.txt"), false) {
+		t.Error("ignored outside of a repository")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		path string
+		content string
+		want string
+	}{
+		{"a.go", "package a", "<file path=\"a.go\">\npackage a\n</file>"},
+		{"a.go", "package a\n", "<file path=\"a.go\">\npackage a\n</file>"},
+		{`say "hi".txt`, "hi", "<file path=\"say &#34;hi&#34;.txt\">\nhi\n</file>"},
+		{"a<b>&c", "", "<file path=\"a&lt;b&gt;&amp;c\">\n\n</file>"},
+		{"x.md", "before</file>\nafter", "<file path=\"x.md\">\nbefore<\\/file>\nafter\n</file>"},
+	}
+	for _, c := range cases {
+		if got := Format(c.path, c.content); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+	if got, want := FormatMedia(`a "b".png`, "image/png"), "<file path=\"a &#34;b&#34;.png\" type=\"image/png\" />"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,389 @@
+// Reads $XDG_CONFIG_HOME/hello-llm/config.toml into an app.AppConfig
+//
+// Root keys act as defaults, a [profile.<name>] table overrides any of them when selected.
+// Files written by older versions (key=value in hello-llm/cfg) are migrated on the fly.
+
+package config
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"errors"
+	"slices"
+	"strings"
+	"path/filepath"
+
+	"github.com/hello-llm-2/app"
+	"github.com/hello-llm-2/providers"
+)
+
+var (
+	ErrProfileNotFound error = errors.New("Profile not found")
+)
+
+func Dir() (string, error) {
+	cfgDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cfgDir, "hello-llm"), nil
+}
+
+func Path() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.toml"), nil
+}
+
+// Where versions prior to the TOML format stored their config
+func legacyPath() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cfg"), nil
+}
+
+// A problem the user should know about but that doesn't prevent using the config
+type Warning struct {
+	Line int
+	Msg string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("config.toml:%d: %s", w.Line, w.Msg)
+}
+
+// An invalid value, the config can't be trusted
+type Error struct {
+	Line int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("config.toml:%d: %s", e.Line, e.Msg)
+}
+
+// Returns os.ErrNotExist (wrapped) when there is no config file yet
+func Load(cfg *app.AppConfig, profile string) ([]Warning, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := migrateLegacy(path); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := parseToml(string(data))
+	if err != nil {
+		var tomlErr *tomlError
+		if errors.As(err, &tomlErr) {
+			return nil, &Error{Line: tomlErr.Line, Msg: tomlErr.Msg}
+		}
+		return nil, err
+	}
+
+	return apply(cfg, doc, profile)
+}
+
+func apply(cfg *app.AppConfig, doc *tomlDocument, profile string) ([]Warning, error) {
+	warnings := []Warning{}
+	profileTable := "profile." + profile
+	profileFound := false
+	for _, table := range doc.Tables {
+		if table.Name == profileTable {
+			profileFound = true
+		}
+	}
+
+	// Profile entries are applied last so they win over the root ones
+	profileEntries := []tomlEntry{}
+	for _, entry := range doc.Entries {
+		var err error
+		var known bool
+		switch {
+		case entry.Table == "":
+			known, err = applySetting(cfg, entry)
+		case entry.Table == "local":
+			known, err = applyLocal(cfg, entry)
+		case entry.Table == "shell":
+			known, err = applyShell(cfg, entry)
+		case entry.Table == "retry":
+			known, err = applyRetry(cfg, entry)
+		case strings.HasPrefix(entry.Table, "models."):
+			known, err = applyModel(cfg, entry)
+		case entry.Table == profileTable:
+			profileFound = true
+			profileEntries = append(profileEntries, entry)
+			continue
+		case strings.HasPrefix(entry.Table, "profile."):
+			// Another profile, only check it makes sense
+			known, err = applySetting(&app.AppConfig{}, entry)
+		default:
+			warnings = append(warnings, Warning{Line: entry.Line, Msg: fmt.Sprintf("unknown table [%s]", entry.Table)})
+			continue
+		}
+
+		if err != nil {
+			return warnings, err
+		}
+		if !known {
+			warnings = append(warnings, Warning{Line: entry.Line, Msg: fmt.Sprintf("unknown key %q", entry.Key)})
+		}
+	}
+
+	if profile != "" && !profileFound {
+		return warnings, fmt.Errorf("%w: %s", ErrProfileNotFound, profile)
+	}
+
+	for _, entry := range profileEntries {
+		known, err := applySetting(cfg, entry)
+		if err != nil {
+			return warnings, err
+		}
+		if !known {
+			warnings = append(warnings, Warning{Line: entry.Line, Msg: fmt.Sprintf("unknown key %q", entry.Key)})
+		}
+	}
+
+	slices.SortStableFunc(warnings, func(a, b Warning) int {
+		return a.Line - b.Line
+	})
+	return warnings, nil
+}
+
+func typeError(entry tomlEntry, expected string) error {
+	return &Error{Line: entry.Line, Msg: fmt.Sprintf("%s must be %s", entry.Key, expected)}
+}
+
+func asString(entry tomlEntry) (string, error) {
+	s, ok := entry.Value.(string)
+	if !ok {
+		return "", typeError(entry, "a string")
+	}
+	return s, nil
+}
+
+func asBool(entry tomlEntry) (bool, error) {
+	b, ok := entry.Value.(bool)
+	if !ok {
+		return false, typeError(entry, "true or false")
+	}
+	return b, nil
+}
+
+func asInt(entry tomlEntry) (int, error) {
+	i, ok := entry.Value.(int64)
+	if !ok {
+		return 0, typeError(entry, "an integer")
+	}
+	return int(i), nil
+}
+
+func asFloat(entry tomlEntry) (float64, error) {
+	switch v := entry.Value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	default:
+		return 0, typeError(entry, "a number")
+	}
+}
+
+func asStringArray(entry tomlEntry) ([]string, error) {
+	values, ok := entry.Value.([]any)
+	if !ok {
+		return nil, typeError(entry, "an array of strings")
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, typeError(entry, "an array of strings")
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// Settings allowed both at the root and in profiles
+func applySetting(cfg *app.AppConfig, entry tomlEntry) (bool, error) {
+	var err error
+	switch entry.Key {
+	case "provider":
+		var s string
+		if s, err = asString(entry); err == nil {
+			cfg.Provider, err = providers.ProviderTypeFromString(s)
+		}
+	case "model_preference":
+		var s string
+		if s, err = asString(entry); err == nil {
+			cfg.ModelPreference, err = providers.ModelPreferenceFromString(s)
+		}
+	case "model":
+		cfg.Model, err = asString(entry)
+	case "fallback":
+		var names []string
+		if names, err = asStringArray(entry); err == nil {
+			cfg.Fallback = nil
+			for _, name := range names {
+				var provider providers.ProviderType
+				if provider, err = providers.ProviderTypeFromString(name); err != nil {
+					break
+				}
+				cfg.Fallback = append(cfg.Fallback, provider)
+			}
+		}
+	case "context_strategy":
+		var s string
+		if s, err = asString(entry); err == nil {
+			cfg.ContextStrategy, err = app.ContextStrategyFromString(s)
+		}
+	case "system_prompt":
+		cfg.SystemPrompt, err = asString(entry)
+	case "web_search":
+		cfg.AllowWebSearch, err = asBool(entry)
+	case "tools":
+		cfg.AllowTools, err = asBool(entry)
+	case "color":
+		cfg.UseColor, err = asBool(entry)
+	case "max_tokens":
+		cfg.MaxTokens, err = asInt(entry)
+		if err == nil && cfg.MaxTokens <= 0 {
+			err = typeError(entry, "a positive integer")
+		}
+	case "temperature":
+		var t float64
+		if t, err = asFloat(entry); err == nil {
+			cfg.Temperature = &t
+		}
+	default:
+		return false, nil
+	}
+
+	if err != nil {
+		var cfgErr *Error
+		if !errors.As(err, &cfgErr) {
+			err = &Error{Line: entry.Line, Msg: fmt.Sprintf("%s: %s", entry.Key, err)}
+		}
+	}
+	return true, err
+}
+
+func applyLocal(cfg *app.AppConfig, entry tomlEntry) (bool, error) {
+	var err error
+	switch entry.Key {
+	case "base_url":
+		cfg.Local.BaseUrl, err = asString(entry)
+	case "model":
+		cfg.Local.Model, err = asString(entry)
+	case "api_key":
+		cfg.Local.ApiKey, err = asString(entry)
+	case "context_window":
+		if cfg.Local.ContextWindow, err = asInt(entry); err == nil && cfg.Local.ContextWindow <= 0 {
+			err = typeError(entry, "a positive number of tokens")
+		}
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func applyShell(cfg *app.AppConfig, entry tomlEntry) (bool, error) {
+	var err error
+	switch entry.Key {
+	case "allowlist":
+		cfg.Shell.Allowlist, err = asStringArray(entry)
+	case "timeout":
+		var seconds int
+		if seconds, err = asInt(entry); err == nil {
+			if seconds <= 0 {
+				return true, typeError(entry, "a positive number of seconds")
+			}
+			cfg.Shell.Timeout = time.Duration(seconds) * time.Second
+		}
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// Delays are in seconds and may have a fractional part
+func applyRetry(cfg *app.AppConfig, entry tomlEntry) (bool, error) {
+	var err error
+	switch entry.Key {
+	case "attempts":
+		var attempts int
+		if attempts, err = asInt(entry); err == nil {
+			if attempts <= 0 {
+				return true, typeError(entry, "a positive number of attempts")
+			}
+			cfg.Retry.MaxAttempts = attempts
+		}
+	case "base_delay", "max_delay":
+		var seconds float64
+		if seconds, err = asFloat(entry); err == nil {
+			if seconds < 0 {
+				return true, typeError(entry, "a number of seconds")
+			}
+			delay := time.Duration(seconds * float64(time.Second))
+			if entry.Key == "base_delay" {
+				cfg.Retry.BaseDelay = delay
+			} else {
+				cfg.Retry.MaxDelay = delay
+			}
+		}
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// [models.<provider>] tables, one key per model preference
+func applyModel(cfg *app.AppConfig, entry tomlEntry) (bool, error) {
+	providerStr := strings.TrimPrefix(entry.Table, "models.")
+	provider, err := providers.ProviderTypeFromString(providerStr)
+	if err != nil {
+		return true, &Error{Line: entry.Line, Msg: fmt.Sprintf("unknown provider %q", providerStr)}
+	}
+	// e.g. smart_context = 128000
+	if prefStr, found := strings.CutSuffix(entry.Key, "_context"); found {
+		pref, err := providers.ModelPreferenceFromString(prefStr)
+		if err != nil {
+			return false, nil
+		}
+		tokens, err := asInt(entry)
+		if err == nil && tokens <= 0 {
+			err = typeError(entry, "a positive number of tokens")
+		}
+		if err != nil {
+			return true, err
+		}
+		cfg.Models[provider].SetContextWindow(pref, tokens)
+		return true, nil
+	}
+
+	pref, err := providers.ModelPreferenceFromString(entry.Key)
+	if err != nil {
+		return false, nil
+	}
+
+	model, err := asString(entry)
+	if err != nil {
+		return true, err
+	}
+	cfg.Models[provider].Set(pref, model)
+	return true, nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"strings"
+
+	"github.com/hello-llm-2/app"
+	"github.com/hello-llm-2/providers"
+)
+
+// Asks the user the bare minimum and writes the first config file
+func Init(cfg *app.AppConfig) error {
+	fmt.Println("You are seeing this screen because we need to build the default config for 'hello-llm'")
+	fmt.Println("Please select your preferred default LLM provider:")
+	fmt.Println("\t1. OpenAI (Uses OPENAI_API_KEY environment variable)")
+	fmt.Println("\t2. Anthropic (Uses ANTHROPIC_API_KEY environment variable)")
+	fmt.Println("\t3. Google (Uses GEMINI_API_KEY environment variable)")
+	fmt.Println("\t4. xAI (Uses XAI_API_KEY environment variable)")
+	fmt.Println("\t5. Local server (Any OpenAI compatible server such as Ollama, llama.cpp or vLLM)")
+
+	for {
+		var choice int
+		fmt.Print("> ")
+		n, err := fmt.Scan(&choice)
+		if err == io.EOF {
+			return fmt.Errorf("no provider chosen: %w", err)
+		}
+		if err != nil || n != 1 {
+			fmt.Println("Please enter a single number matching the selected provider")
+			fmt.Scanln()
+		}
+
+		switch choice {
+		case 1:
+			cfg.Provider = providers.ProviderOpenai
+		case 2:
+			cfg.Provider = providers.ProviderAnthropic
+		case 3:
+			cfg.Provider = providers.ProviderGemini
+		case 4:
+			cfg.Provider = providers.ProviderGrok
+		case 5:
+			cfg.Provider = providers.ProviderLocal
+		}
+		break
+	}
+
+	if cfg.Provider == providers.ProviderLocal {
+		// fmt.Scan already took the newline after the choice
+		fmt.Printf("Server base URL (default: %s)\n> ", cfg.Local.BaseUrl)
+		baseUrl, err := readLine()
+		if err != nil {
+			return fmt.Errorf("no server base URL: %w", err)
+		}
+		if baseUrl = strings.TrimSpace(baseUrl); baseUrl != "" {
+			cfg.Local.BaseUrl = baseUrl
+		}
+
+		for cfg.Local.Model == "" {
+			fmt.Print("Model name\n> ")
+			model, err := readLine()
+			if err != nil {
+				return fmt.Errorf("no model name: %w", err)
+			}
+			cfg.Local.Model = strings.TrimSpace(model)
+		}
+	}
+
+	fmt.Println("Please select your default model preference:")
+	fmt.Println("\t1. Cheap (Model with a small cost, may not be the cheapest of all though)")
+	fmt.Println("\t2. Fast (Generally same as cheap but if a faster more costly alternative exist it will be favored)")
+	fmt.Println("\t3. Smart (More advanced models, generally higher cost)")
+
+	for {
+		var choice int
+		fmt.Print("> ")
+		n, err := fmt.Scan(&choice)
+		if err == io.EOF {
+			return fmt.Errorf("no model preference chosen: %w", err)
+		}
+		if err != nil || n != 1 {
+			fmt.Println("Please enter a single number matching the selected model preference")
+			fmt.Scanln()
+		}
+
+		switch choice {
+		case 1:
+			cfg.ModelPreference = providers.ModelPreferenceCheap
+		case 2:
+			cfg.ModelPreference = providers.ModelPreferenceFast
+		case 3:
+			cfg.ModelPreference = providers.ModelPreferenceSmart
+		}
+		break
+	}
+
+	return writeInitial(cfg)
+}
+
+// Byte by byte so that nothing is read ahead of what fmt.Scan gets next. io.EOF when stdin ends before the line started
+func readLine() (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
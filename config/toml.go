@@ -0,0 +1,459 @@
+// A small TOML subset, enough for a config file written by humans:
+// tables, dotted and quoted keys, strings (basic, literal, multi-line), integers, floats, booleans and arrays.
+// No inline tables, arrays of tables nor dates
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+	"unicode/utf8"
+)
+
+type tomlEntry struct {
+	// Dotted name of the table the key belongs to, empty for the root table
+	Table string
+	Key string
+	// string, int64, float64, bool or []any
+	Value any
+	Line int
+}
+
+// A table header, kept so empty tables (e.g. a profile without settings) are known to exist
+type tomlTable struct {
+	Name string
+	Line int
+}
+
+type tomlDocument struct {
+	Entries []tomlEntry
+	Tables []tomlTable
+}
+
+type tomlParser struct {
+	src string
+	pos int
+	line int
+}
+
+type tomlError struct {
+	Line int
+	Msg string
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return &tomlError{Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *tomlParser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos += 1
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		p.pos += 1
+	}
+}
+
+// Spaces, comments and newlines, as allowed inside arrays
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos += 1
+		case '\n':
+			p.pos += 1
+			p.line += 1
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// Nothing but a comment may follow a key/value pair or a table header
+func (p *tomlParser) expectEndOfLine() error {
+	p.skipSpaces()
+	p.skipComment()
+	if p.peek() == '\r' {
+		p.pos += 1
+	}
+	if p.eof() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return p.errorf("unexpected %q after value", p.peek())
+	}
+	p.pos += 1
+	p.line += 1
+	return nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+// Parses a possibly dotted key such as profile."my work".model
+func (p *tomlParser) parseKey() ([]string, error) {
+	parts := []string{}
+	for {
+		p.skipSpaces()
+		var part string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		case c == '\'':
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		case isBareKeyChar(c):
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos += 1
+			}
+			part = p.src[start:p.pos]
+		default:
+			return nil, p.errorf("expected a key")
+		}
+		parts = append(parts, part)
+
+		p.skipSpaces()
+		if p.peek() != '.' {
+			return parts, nil
+		}
+		p.pos += 1
+	}
+}
+
+func (p *tomlParser) parseEscape(out *strings.Builder) error {
+	// Positioned right after the backslash
+	if p.eof() {
+		return p.errorf("unterminated escape sequence")
+	}
+	c := p.peek()
+	p.pos += 1
+	switch c {
+	case 'b':
+		out.WriteByte('\b')
+	case 't':
+		out.WriteByte('\t')
+	case 'n':
+		out.WriteByte('\n')
+	case 'f':
+		out.WriteByte('\f')
+	case 'r':
+		out.WriteByte('\r')
+	case '"':
+		out.WriteByte('"')
+	case '\\':
+		out.WriteByte('\\')
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos + size > len(p.src) {
+			return p.errorf("truncated unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return p.errorf("invalid unicode escape")
+		}
+		out.WriteRune(rune(code))
+		p.pos += size
+	default:
+		return p.errorf("invalid escape sequence \\%c", c)
+	}
+	return nil
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos += 1
+	out := strings.Builder{}
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos += 1
+		switch c {
+		case '"':
+			return out.String(), nil
+		case '\\':
+			if err := p.parseEscape(&out); err != nil {
+				return "", err
+			}
+		default:
+			out.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos += 1
+	start := p.pos
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		if p.peek() == '\'' {
+			s := p.src[start:p.pos]
+			p.pos += 1
+			return s, nil
+		}
+		p.pos += 1
+	}
+}
+
+func (p *tomlParser) parseMultilineString(delim string) (string, error) {
+	p.pos += len(delim)
+	// A newline right after the opening delimiter is trimmed
+	if strings.HasPrefix(p.src[p.pos:], "\r\n") {
+		p.pos += 2
+		p.line += 1
+	} else if p.peek() == '\n' {
+		p.pos += 1
+		p.line += 1
+	}
+
+	out := strings.Builder{}
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated multi-line string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], delim) {
+			p.pos += len(delim)
+			return out.String(), nil
+		}
+
+		c := p.peek()
+		p.pos += 1
+		switch {
+		case c == '\n':
+			p.line += 1
+			out.WriteByte(c)
+		case c == '\\' && delim == `"""`:
+			// Line ending backslash eats the newline and the indentation that follows
+			rest := p.src[p.pos:]
+			trimmed := strings.TrimLeft(rest, " \t\r")
+			if strings.HasPrefix(trimmed, "\n") {
+				p.pos += len(rest) - len(trimmed)
+				for !p.eof() && strings.ContainsRune(" \t\r\n", rune(p.peek())) {
+					if p.peek() == '\n' {
+						p.line += 1
+					}
+					p.pos += 1
+				}
+				continue
+			}
+			if err := p.parseEscape(&out); err != nil {
+				return "", err
+			}
+		default:
+			out.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) parseArray() ([]any, error) {
+	p.pos += 1
+	values := []any{}
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos += 1
+			return values, nil
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos += 1
+		case ']':
+			p.pos += 1
+			return values, nil
+		default:
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseScalar() (any, error) {
+	start := p.pos
+	for !p.eof() && (isBareKeyChar(p.peek()) || strings.ContainsRune("+.", rune(p.peek()))) {
+		p.pos += 1
+	}
+	word := p.src[start:p.pos]
+
+	switch word {
+	case "":
+		return nil, p.errorf("expected a value")
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	number := strings.ReplaceAll(word, "_", "")
+	if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("invalid value %q (strings must be quoted)", word)
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	rest := p.src[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, `"""`):
+		return p.parseMultilineString(`"""`)
+	case strings.HasPrefix(rest, `'''`):
+		return p.parseMultilineString(`'''`)
+	case strings.HasPrefix(rest, `"`):
+		return p.parseBasicString()
+	case strings.HasPrefix(rest, `'`):
+		return p.parseLiteralString()
+	case strings.HasPrefix(rest, `[`):
+		return p.parseArray()
+	default:
+		return p.parseScalar()
+	}
+}
+
+func parseToml(src string) (*tomlDocument, error) {
+	src = strings.TrimPrefix(src, "\uFEFF")
+	p := &tomlParser{src: src, line: 1}
+	doc := &tomlDocument{}
+	table := ""
+
+	for {
+		p.skipSpaces()
+		p.skipComment()
+		if p.eof() {
+			return doc, nil
+		}
+
+		switch p.peek() {
+		case '\r':
+			p.pos += 1
+			continue
+		case '\n':
+			p.pos += 1
+			p.line += 1
+			continue
+		case '[':
+			p.pos += 1
+			parts, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			if p.peek() != ']' {
+				return nil, p.errorf("expected ']' to close the table header")
+			}
+			p.pos += 1
+			table = strings.Join(parts, ".")
+			doc.Tables = append(doc.Tables, tomlTable{Name: table, Line: p.line})
+		default:
+			line := p.line
+			parts, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpaces()
+			if p.peek() != '=' {
+				return nil, p.errorf("expected '=' after key %q", strings.Join(parts, "."))
+			}
+			p.pos += 1
+			p.skipSpaces()
+
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+
+			entryTable := table
+			if len(parts) > 1 {
+				prefix := strings.Join(parts[:len(parts)-1], ".")
+				if entryTable == "" {
+					entryTable = prefix
+				} else {
+					entryTable = entryTable + "." + prefix
+				}
+			}
+			doc.Entries = append(doc.Entries, tomlEntry{
+				Table: entryTable,
+				Key: parts[len(parts)-1],
+				Value: value,
+				Line: line,
+			})
+		}
+
+		if err := p.expectEndOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Quotes a string so it can be written back as a TOML basic string
+func tomlQuote(s string) string {
+	out := strings.Builder{}
+	out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\t':
+			out.WriteString(`\t`)
+		case '\r':
+			out.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				out.WriteString(fmt.Sprintf(`\u%04X`, r))
+			} else {
+				out.WriteRune(r)
+			}
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseToml(t *testing.T) {
+	cases := []struct {
+		name string
+		src string
+		want []tomlEntry
+	}{
+		{
+			name: "basic string",
+			src: `provider = "openai"`,
+			want: []tomlEntry{{Key: "provider", Value: "openai", Line: 1}},
+		},
+		{
+			name: "escapes",
+			src: `prompt = "tab\there \"quoted\" back\\slash\nline \u00e9 \U0001F642"`,
+			want: []tomlEntry{{Key: "prompt", Value: "tab\there \"quoted\" back\\slash\nline é 🙂", Line: 1}},
+		},
+		{
+			name: "literal string",
+			src: `path = 'C:\Users\me'`,
+			want: []tomlEntry{{Key: "path", Value: `C:\Users\me`, Line: 1}},
+		},
+		{
+			name: "multi-line basic string",
+			src: "prompt = \"\"\"\nfirst\nsecond \\\n    continued\"\"\"\nnext = 1",
+			want: []tomlEntry{
+				{Key: "prompt", Value: "first\nsecond continued", Line: 1},
+				{Key: "next", Value: int64(1), Line: 5},
+			},
+		},
+		{
+			name: "multi-line literal string",
+			src: "prompt = '''\nno \\n escape\n'''",
+			want: []tomlEntry{{Key: "prompt", Value: "no \\n escape\n", Line: 1}},
+		},
+		{
+			name: "numbers and booleans",
+			src: "a = 42\nb = -7\nc = 1_000\nd = 0.5\ne = true\nf = false\ng = +3",
+			want: []tomlEntry{
+				{Key: "a", Value: int64(42), Line: 1},
+				{Key: "b", Value: int64(-7), Line: 2},
+				{Key: "c", Value: int64(1000), Line: 3},
+				{Key: "d", Value: 0.5, Line: 4},
+				{Key: "e", Value: true, Line: 5},
+				{Key: "f", Value: false, Line: 6},
+				{Key: "g", Value: int64(3), Line: 7},
+			},
+		},
+		{
+			name: "arrays",
+			src: "a = []\nb = [1, 2,]\nc = [\n  \"x\", # first\n  ['y', true],\n]\nd = 1",
+			want: []tomlEntry{
+				{Key: "a", Value: []any{}, Line: 1},
+				{Key: "b", Value: []any{int64(1), int64(2)}, Line: 2},
+				{Key: "c", Value: []any{"x", []any{"y", true}}, Line: 3},
+				{Key: "d", Value: int64(1), Line: 7},
+			},
+		},
+		{
+			name: "tables",
+			src: "root = 1\n[models.openai]\ncheap = \"a\"\n[profile.\"my work\"]\nmodel = 'b'\n[ spaced . name ]\nx = 1",
+			want: []tomlEntry{
+				{Key: "root", Value: int64(1), Line: 1},
+				{Table: "models.openai", Key: "cheap", Value: "a", Line: 3},
+				{Table: "profile.my work", Key: "model", Value: "b", Line: 5},
+				{Table: "spaced.name", Key: "x", Value: int64(1), Line: 7},
+			},
+		},
+		{
+			name: "dotted keys",
+			src: "local.base_url = \"x\"\n[profile]\nwork.model = \"y\"",
+			want: []tomlEntry{
+				{Table: "local", Key: "base_url", Value: "x", Line: 1},
+				{Table: "profile.work", Key: "model", Value: "y", Line: 3},
+			},
+		},
+		{
+			name: "comments, blank lines and crlf",
+			src: "\uFEFF# header\r\n\r\n  a = 1 # trailing\r\n\t# indented\r\nb = \"# not a comment\"\r\n",
+			want: []tomlEntry{
+				{Key: "a", Value: int64(1), Line: 3},
+				{Key: "b", Value: "# not a comment", Line: 5},
+			},
+		},
+		{
+			name: "empty",
+			src: "# nothing\n\n",
+			want: nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doc, err := parseToml(c.src)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(doc.Entries, c.want) {
+				t.Errorf("got %#v, want %#v", doc.Entries, c.want)
+			}
+		})
+	}
+}
+
+func TestParseTomlTables(t *testing.T) {
+	doc, err := parseToml("[profile.empty]\n\n[profile.work]\nmodel = \"x\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tomlTable{{Name: "profile.empty", Line: 1}, {Name: "profile.work", Line: 3}}
+	if !reflect.DeepEqual(doc.Tables, want) {
+		t.Errorf("got %#v, want %#v", doc.Tables, want)
+	}
+}
+
+func TestParseTomlErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		src string
+		line int
+	}{
+		{"unquoted string", "a = 1\nprovider = openai", 2},
+		{"missing equal sign", "\n\nprovider \"openai\"", 3},
+		{"missing value", "a =\n", 1},
+		{"unterminated string", "a = 1\nb = \"open\nc = 2", 2},
+		{"unterminated literal string", "a = 'open", 1},
+		{"unterminated multi-line string", "a = \"\"\"\nb\nc", 3},
+		{"invalid escape", "# comment\na = \"\\q\"", 2},
+		{"invalid unicode escape", "a = \"\\uZZZZ\"", 1},
+		{"truncated unicode escape", "a = \"\\u12", 1},
+		{"garbage after value", "a = 1 2", 1},
+		{"garbage after table", "[a] b", 1},
+		{"unclosed table", "x = 1\n[a\nb = 1", 2},
+		{"unclosed array", "a = [1, 2\nb = 3", 2},
+		{"array without commas", "a = [\n1\n2]", 3},
+		{"missing key", "= 1", 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseToml(c.src)
+			var tomlErr *tomlError
+			if !errors.As(err, &tomlErr) {
+				t.Fatalf("got %v, want a tomlError", err)
+			}
+			if tomlErr.Line != c.line {
+				t.Errorf("%q on line %d, want %d", tomlErr.Msg, tomlErr.Line, c.line)
+			}
+		})
+	}
+}
+
+func TestTomlQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", "with \"quotes\" and \\", "multi\nline\r\n\ttab", "control \x01 \x7f", "unicode é 🙂"} {
+		quoted := tomlQuote(s)
+		doc, err := parseToml("a = " + quoted)
+		if err != nil {
+			t.Fatalf("%q: %v", quoted, err)
+		}
+		if got := doc.Entries[0].Value; got != s {
+			t.Errorf("%q: got %q back", s, got)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"os"
+	"fmt"
+	"bufio"
+	"errors"
+	"strings"
+	"strconv"
+	"path/filepath"
+
+	"github.com/hello-llm-2/app"
+	"github.com/hello-llm-2/providers"
+)
+
+type tomlTableBuilder struct {
+	name string
+	lines []string
+}
+
+// Builds a config file, root keys first then tables in the order they were first used
+type tomlWriter struct {
+	tables []*tomlTableBuilder
+}
+
+func (w *tomlWriter) table(name string) *tomlTableBuilder {
+	for _, t := range w.tables {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &tomlTableBuilder{name: name}
+	w.tables = append(w.tables, t)
+	return t
+}
+
+func (w *tomlWriter) set(table string, key string, value string) {
+	t := w.table(table)
+	t.lines = append(t.lines, key + " = " + value)
+}
+
+func (w *tomlWriter) comment(table string, comment string) {
+	t := w.table(table)
+	t.lines = append(t.lines, "# " + comment)
+}
+
+func (w *tomlWriter) String() string {
+	out := strings.Builder{}
+	// Root keys must come before any table header
+	for _, t := range w.tables {
+		if t.name == "" {
+			out.WriteString(strings.Join(t.lines, "\n") + "\n")
+		}
+	}
+	for _, t := range w.tables {
+		if t.name == "" {
+			continue
+		}
+		out.WriteString("\n[" + t.name + "]\n")
+		out.WriteString(strings.Join(t.lines, "\n") + "\n")
+	}
+	return out.String()
+}
+
+func tomlStringArray(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, tomlQuote(strings.TrimSpace(v)))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// Never overwrites an existing file, the user may have spent time on it
+func writeNew(path string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	return err
+}
+
+// Converts hello-llm/cfg into config.toml, the old file is kept as cfg.bak
+func migrateLegacy(path string) error {
+	oldPath, err := legacyPath()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(oldPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no config file: %w", os.ErrNotExist)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := &tomlWriter{}
+	w.comment("", "Migrated from the previous config format, see cfg.bak for the original")
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			w.comment("", "unrecognized legacy line: " + line)
+			continue
+		}
+
+		switch key {
+		case "default_provider":
+			w.set("", "provider", tomlQuote(value))
+		case "default_model_preference":
+			w.set("", "model_preference", tomlQuote(value))
+		case "local_base_url":
+			w.set("local", "base_url", tomlQuote(value))
+		case "local_model":
+			w.set("local", "model", tomlQuote(value))
+		case "local_api_key":
+			w.set("local", "api_key", tomlQuote(value))
+		case "shell_allowlist":
+			w.set("shell", "allowlist", tomlStringArray(strings.Split(value, ",")))
+		case "shell_timeout":
+			if _, err := strconv.Atoi(value); err != nil {
+				w.comment("", "unrecognized legacy setting: " + line)
+				continue
+			}
+			w.set("shell", "timeout", value)
+		default:
+			// model.<provider>.<preference>
+			if modelKey, found := strings.CutPrefix(key, "model."); found {
+				if provider, pref, found := strings.Cut(modelKey, "."); found {
+					w.set("models." + provider, pref, tomlQuote(value))
+					continue
+				}
+			}
+			w.comment("", "unrecognized legacy setting: " + line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if err := writeNew(path, w.String()); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, oldPath + ".bak")
+}
+
+// Writes the first config file from what the user picked in Init
+func writeInitial(cfg *app.AppConfig) error {
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+
+	w := &tomlWriter{}
+	w.set("", "provider", tomlQuote(providers.ProviderTypeToString(cfg.Provider)))
+	w.set("", "model_preference", tomlQuote(providers.ModelPreferenceToString(cfg.ModelPreference)))
+	if cfg.Provider == providers.ProviderLocal {
+		w.set("local", "base_url", tomlQuote(cfg.Local.BaseUrl))
+		w.set("local", "model", tomlQuote(cfg.Local.Model))
+	}
+
+	w.comment("", "Profiles override any root setting, select one with --profile work")
+	w.comment("", "[profile.work]")
+	w.comment("", "model_preference = \"smart\"")
+	w.comment("", "web_search = true")
+	w.comment("", "max_tokens = 4096")
+	w.comment("", "temperature = 0.2")
+
+	return writeNew(path, w.String())
+}
@@ -0,0 +1,375 @@
+// Unix socket next to the FIFOs of a session to drive the TUI from editors and scripts
+//
+// The protocol is JSON-RPC 2.0, one JSON object per line in both directions:
+//
+//	$ echo '{"jsonrpc":"2.0","id":1,"method":"submit","params":{"text":"hi"}}' | nc -U $XDG_RUNTIME_DIR/hello-llm/current/control.sock
+//	{"jsonrpc":"2.0","id":1,"result":{}}
+//
+// Methods:
+//
+//	submit      {"text": "..."}                   sends a prompt, or runs it when it's a /command
+//	transcript  {}                                the conversation and the response being written
+//	attach      {"slot", "text" | "path", "label", "append"}   fills a context slot like its FIFO would
+//	detach      {"slot"}                          empties a context slot
+//	model       {"model": "smart" | model id}     same as /model
+//	subscribe   {}                                the connection then receives the notifications below
+//	unsubscribe {}
+//
+// Notifications: chunk {"text"} as the response arrives, done {"content"} once it's complete, error {"message"}.
+
+package control
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"sync"
+	"bufio"
+	"errors"
+	"context"
+	"encoding/json"
+)
+
+const SocketName string = "control.sock"
+
+const (
+	MethodSubmit string = "submit"
+	MethodTranscript string = "transcript"
+	MethodAttach string = "attach"
+	MethodDetach string = "detach"
+	MethodModel string = "model"
+	MethodSubscribe string = "subscribe"
+	MethodUnsubscribe string = "unsubscribe"
+)
+
+const (
+	NotificationChunk string = "chunk"
+	NotificationDone string = "done"
+	NotificationError string = "error"
+)
+
+// Error codes of the JSON-RPC spec, CodeAppError is for everything the TUI refuses
+const (
+	CodeParseError int = -32700
+	CodeInvalidRequest int = -32600
+	CodeMethodNotFound int = -32601
+	CodeInvalidParams int = -32602
+	CodeAppError int = -32000
+)
+
+// Requests are one line, a line this long is not one
+const maxLineSize int = 4 * 1024 * 1024
+
+// Notifications waiting for a slow subscriber, past that it is disconnected
+const subscriberBacklog int = 256
+
+var (
+	ErrInvalidParams error = errors.New("Invalid params")
+	ErrMethodNotFound error = errors.New("Method not found")
+)
+
+type request struct {
+	JsonRpc string `json:"jsonrpc"`
+	// Absent for notifications, which get no response
+	Id json.RawMessage `json:"id,omitempty"`
+	Method string `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type Error struct {
+	Code int `json:"code"`
+	Message string `json:"message"`
+}
+
+type response struct {
+	JsonRpc string `json:"jsonrpc"`
+	Id json.RawMessage `json:"id"`
+	Result any `json:"result,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+type notification struct {
+	JsonRpc string `json:"jsonrpc"`
+	Method string `json:"method"`
+	Params any `json:"params,omitempty"`
+}
+
+// Params of the methods, see the package doc
+
+type SubmitParams struct {
+	Text string `json:"text"`
+}
+
+type AttachParams struct {
+	Slot string `json:"slot"`
+	Text string `json:"text"`
+	// Read by the TUI instead of Text when set
+	Path string `json:"path"`
+	Label string `json:"label"`
+	Append bool `json:"append"`
+}
+
+type DetachParams struct {
+	Slot string `json:"slot"`
+}
+
+type ModelParams struct {
+	Model string `json:"model"`
+}
+
+// Results
+
+type TranscriptMessage struct {
+	Role string `json:"role"`
+	Content string `json:"content"`
+	ToolCall any `json:"tool_call,omitempty"`
+	// What answered, for assistant messages and tool calls
+	Provider string `json:"provider,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+type TranscriptResult struct {
+	Messages []TranscriptMessage `json:"messages"`
+	// Partial answer while streaming
+	Response string `json:"response"`
+	Streaming bool `json:"streaming"`
+}
+
+type NoticeResult struct {
+	Notice string `json:"notice,omitempty"`
+}
+
+type ChunkParams struct {
+	Text string `json:"text"`
+}
+
+type DoneParams struct {
+	Content string `json:"content"`
+}
+
+type ErrorParams struct {
+	Message string `json:"message"`
+	// Same values as the one-shot mode's error_kind
+	Kind string `json:"kind"`
+	Hint string `json:"hint,omitempty"`
+}
+
+// A request the TUI has to answer, Reply must be called exactly once
+type Call struct {
+	Method string
+	params json.RawMessage
+	reply chan response
+}
+
+func (call *Call) DecodeParams(v any) error {
+	if len(call.params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(call.params, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidParams, err)
+	}
+	return nil
+}
+
+// Safe to call from any goroutine, err is sent back as a JSON-RPC error
+func (call *Call) Reply(result any, err error) {
+	resp := response{Result: result}
+	if err != nil {
+		resp = response{Error: &Error{Code: CodeAppError, Message: err.Error()}}
+		switch {
+		case errors.Is(err, ErrInvalidParams):
+			resp.Error.Code = CodeInvalidParams
+		case errors.Is(err, ErrMethodNotFound):
+			resp.Error.Code = CodeMethodNotFound
+		}
+	} else if result == nil {
+		resp.Result = struct{}{}
+	}
+	call.reply <- resp
+}
+
+type conn struct {
+	net.Conn
+	// Lines to write, responses and notifications share it to never interleave
+	out chan []byte
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+// Returns false when the connection is gone
+func (c *conn) send(line []byte) bool {
+	select {
+	case c.out <- line:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+type Server struct {
+	listener net.Listener
+	calls chan *Call
+	mu sync.Mutex
+	subscribers map[*conn]struct{}
+}
+
+// A socket left by a dead process is replaced, the session directory is ours anyway
+func Listen(path string) (*Server, error) {
+	if stats, err := os.Lstat(path); err == nil && stats.Mode() & os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		listener: listener,
+		calls: make(chan *Call),
+		subscribers: map[*conn]struct{}{},
+	}, nil
+}
+
+// Requests for the TUI, in the order they arrive
+func (s *Server) Calls() <-chan *Call {
+	return s.calls
+}
+
+// Accepts until ctx is done, the socket file is removed on the way out
+func (s *Server) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: netConn, out: make(chan []byte, subscriberBacklog), done: make(chan struct{})}
+		go s.write(c)
+		go s.read(ctx, c)
+	}
+}
+
+// Drains out until the reader closes it, so responses to a client that already hung up its side still go out
+func (s *Server) write(c *conn) {
+	defer c.close()
+	for {
+		select {
+		case line, ok := <-c.out:
+			if !ok {
+				return
+			}
+			if _, err := c.Write(line); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (s *Server) read(ctx context.Context, c *conn) {
+	defer func() {
+		// Notify only writes to subscribers, once removed nothing else sends on out
+		s.mu.Lock()
+		delete(s.subscribers, c)
+		s.mu.Unlock()
+		close(c.out)
+	}()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		resp, respond := s.handle(ctx, c, scanner.Bytes())
+		if !respond {
+			continue
+		}
+		resp.JsonRpc = "2.0"
+		if resp.Id == nil {
+			resp.Id = json.RawMessage("null")
+		}
+		line, err := json.Marshal(resp)
+		if err != nil {
+			line, _ = json.Marshal(response{JsonRpc: "2.0", Id: resp.Id, Error: &Error{Code: CodeAppError, Message: err.Error()}})
+		}
+		if !c.send(append(line, '\n')) {
+			return
+		}
+	}
+}
+
+// respond is false for JSON-RPC notifications, the client doesn't want to hear back
+func (s *Server) handle(ctx context.Context, c *conn, line []byte) (resp response, respond bool) {
+	req := request{}
+	if err := json.Unmarshal(line, &req); err != nil {
+		return response{Error: &Error{Code: CodeParseError, Message: err.Error()}}, true
+	}
+	if req.JsonRpc != "2.0" || req.Method == "" {
+		return response{Id: req.Id, Error: &Error{Code: CodeInvalidRequest, Message: "Expected a JSON-RPC 2.0 request"}}, req.Id != nil
+	}
+
+	switch req.Method {
+	case MethodSubscribe, MethodUnsubscribe:
+		s.mu.Lock()
+		if req.Method == MethodSubscribe {
+			s.subscribers[c] = struct{}{}
+		} else {
+			delete(s.subscribers, c)
+		}
+		s.mu.Unlock()
+		return response{Id: req.Id, Result: struct{}{}}, req.Id != nil
+	case MethodSubmit, MethodTranscript, MethodAttach, MethodDetach, MethodModel:
+	default:
+		return response{Id: req.Id, Error: &Error{Code: CodeMethodNotFound, Message: ErrMethodNotFound.Error() + ": " + req.Method}}, req.Id != nil
+	}
+
+	call := &Call{Method: req.Method, params: req.Params, reply: make(chan response, 1)}
+	select {
+	case s.calls <- call:
+	case <-ctx.Done():
+		return response{}, false
+	}
+	select {
+	case resp = <-call.reply:
+	case <-ctx.Done():
+		return response{}, false
+	}
+	resp.Id = req.Id
+	return resp, req.Id != nil
+}
+
+// Sends a notification to every subscriber without ever blocking the caller, a nil server does nothing
+func (s *Server) Notify(method string, params any) {
+	if s == nil {
+		return
+	}
+	line, err := json.Marshal(notification{JsonRpc: "2.0", Method: method, Params: params})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.subscribers {
+		select {
+		case c.out <- line:
+		default:
+			// Missing chunks would leave the client with a broken answer, better let it know by hanging up
+			delete(s.subscribers, c)
+			c.close()
+		}
+	}
+}
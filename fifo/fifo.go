@@ -0,0 +1,222 @@
+// Named pipes feeding context to a running TUI session
+//
+// Whatever is written to a pipe replaces the content of its slot, unless it starts with a header line:
+//
+//	@hello mode=append label="git diff"
+//	@hello type=file path=/tmp/notes.md
+//	@hello type=clear
+//
+// mode is replace (default) or append, label names the source in the TUI and for the model,
+// type is text (default), file (path is read by hello itself) or clear.
+// Images and PDFs, written as they are or pointed to by a file payload, are sent to the model as such.
+
+package fifo
+
+import (
+	"os"
+	"fmt"
+	"errors"
+	"strings"
+	"syscall"
+	"path/filepath"
+
+	"github.com/hello-llm-2/attach"
+)
+
+const HeaderPrefix string = "@hello"
+
+// Name of the slot that always exists
+const DefaultSlot string = "pipe"
+
+// Most that is read from a single write, text is held to attach.MaxFileSize once it's known not to be media
+const MaxPayloadSize int64 = attach.MaxMediaSize
+
+var (
+	ErrNotAFifo error = errors.New("A file that is not a FIFO already exists at this path")
+	ErrInvalidSlotName error = errors.New("Slot names can only contain letters, digits, '-' and '_'")
+	ErrInvalidHeader error = errors.New("Invalid @hello header")
+)
+
+type Mode int
+
+const (
+	ModeReplace Mode = iota
+	ModeAppend
+)
+
+type PayloadType int
+
+const (
+	PayloadText PayloadType = iota
+	PayloadFile
+	PayloadClear
+)
+
+type Message struct {
+	Mode Mode
+	Type PayloadType
+	// Empty when the writer didn't give one
+	Label string
+	// Set for PayloadFile
+	Path string
+	// Text of the payload, the content of the file for PayloadFile once Resolve was called
+	Body string
+	// Set instead of Body for images and PDFs
+	MimeType string
+	Data []byte
+}
+
+// Moves media found in the body to Data, text is left alone
+func (msg *Message) detectMedia() error {
+	file, err := attach.FromData(msg.Path, []byte(msg.Body))
+	if err != nil {
+		return err
+	}
+	msg.Body, msg.MimeType, msg.Data = file.Content, file.MimeType, file.Data
+	return nil
+}
+
+func ValidSlotName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Makes the FIFO of a slot in dir, an existing FIFO from a previous run is reused
+func Create(dir string, name string) (string, error) {
+	if !ValidSlotName(name) {
+		return "", ErrInvalidSlotName
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	stats, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return path, syscall.Mkfifo(path, 0600)
+	case err != nil:
+		return path, err
+	case stats.Mode() & os.ModeNamedPipe == 0:
+		return path, ErrNotAFifo
+	default:
+		return path, nil
+	}
+}
+
+// Splits `key=value key="quoted value"`
+func parseHeaderFields(header string) (map[string]string, error) {
+	fields := map[string]string{}
+	rest := strings.TrimSpace(header)
+	for rest != "" {
+		key, after, found := strings.Cut(rest, "=")
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%w: expected key=value near %q", ErrInvalidHeader, rest)
+		}
+
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end == -1 {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidHeader)
+			}
+			value = after[1 : end+1]
+			rest = after[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(after, " ")
+		}
+		fields[key] = value
+		rest = strings.TrimSpace(rest)
+	}
+	return fields, nil
+}
+
+// Reads the optional header and returns the message it describes, the body of a file payload is left empty
+func Parse(data string) (Message, error) {
+	msg := Message{}
+	if !strings.HasPrefix(data, HeaderPrefix) {
+		msg.Body = data
+		return msg, msg.detectMedia()
+	}
+
+	header, body, _ := strings.Cut(data, "\n")
+	header = strings.TrimPrefix(header, HeaderPrefix)
+	if header != "" && header[0] != ' ' && header[0] != '\t' {
+		// e.g. "@helloworld", that's content not a header
+		msg.Body = data
+		return msg, msg.detectMedia()
+	}
+
+	fields, err := parseHeaderFields(header)
+	if err != nil {
+		return msg, err
+	}
+	for key, value := range fields {
+		switch key {
+		case "mode":
+			switch value {
+			case "replace":
+				msg.Mode = ModeReplace
+			case "append":
+				msg.Mode = ModeAppend
+			default:
+				return msg, fmt.Errorf("%w: unknown mode %q", ErrInvalidHeader, value)
+			}
+		case "type":
+			switch value {
+			case "text":
+				msg.Type = PayloadText
+			case "file":
+				msg.Type = PayloadFile
+			case "clear":
+				msg.Type = PayloadClear
+			default:
+				return msg, fmt.Errorf("%w: unknown type %q", ErrInvalidHeader, value)
+			}
+		case "label":
+			msg.Label = value
+		case "path":
+			msg.Path = value
+		default:
+			return msg, fmt.Errorf("%w: unknown field %q", ErrInvalidHeader, key)
+		}
+	}
+
+	if msg.Type == PayloadFile {
+		if msg.Path == "" {
+			// The path may be written as the body instead
+			msg.Path = strings.TrimSpace(body)
+		}
+		if msg.Path == "" {
+			return msg, fmt.Errorf("%w: type=file needs a path", ErrInvalidHeader)
+		}
+		if msg.Label == "" {
+			msg.Label = filepath.Base(msg.Path)
+		}
+	} else if msg.Type == PayloadText {
+		msg.Body = body
+		return msg, msg.detectMedia()
+	}
+	return msg, nil
+}
+
+// Reads the file of a PayloadFile message into its body, or its data for media
+func (msg *Message) Resolve() error {
+	if msg.Type != PayloadFile {
+		return nil
+	}
+
+	file, err := attach.ReadFile(msg.Path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", msg.Path, err)
+	}
+	msg.Body, msg.MimeType, msg.Data = file.Content, file.MimeType, file.Data
+	return nil
+}
@@ -0,0 +1,150 @@
+package fifo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want Message
+		wantErr bool
+	}{
+		{
+			name: "no header",
+			data: "some context\nover two lines",
+			want: Message{Body: "some context\nover two lines"},
+		},
+		{
+			name: "header not at the start",
+			data: "text\n@hello mode=append\n",
+			want: Message{Body: "text\n@hello mode=append\n"},
+		},
+		{
+			name: "@helloworld is content",
+			data: "@helloworld mode=append\nbody",
+			want: Message{Body: "@helloworld mode=append\nbody"},
+		},
+		{
+			name: "empty header",
+			data: "@hello\nbody",
+			want: Message{Body: "body"},
+		},
+		{
+			name: "header without body",
+			data: "@hello mode=append",
+			want: Message{Mode: ModeAppend},
+		},
+		{
+			name: "mode and label",
+			data: "@hello mode=append label=diff\nbody",
+			want: Message{Mode: ModeAppend, Label: "diff", Body: "body"},
+		},
+		{
+			name: "quoted label",
+			data: "@hello label=\"git diff HEAD\" mode=replace\nbody",
+			want: Message{Mode: ModeReplace, Label: "git diff HEAD", Body: "body"},
+		},
+		{
+			name: "empty quoted label",
+			data: "@hello label=\"\"\nbody",
+			want: Message{Body: "body"},
+		},
+		{
+			name: "tabs and extra spaces",
+			data: "@hello\tmode=append   label=x \nbody",
+			want: Message{Mode: ModeAppend, Label: "x", Body: "body"},
+		},
+		{
+			name: "unterminated quote",
+			data: "@hello label=\"git diff\nbody",
+			wantErr: true,
+		},
+		{
+			name: "unknown field",
+			data: "@hello color=red\nbody",
+			wantErr: true,
+		},
+		{
+			name: "field without value",
+			data: "@hello append\nbody",
+			wantErr: true,
+		},
+		{
+			name: "unknown mode",
+			data: "@hello mode=prepend\nbody",
+			wantErr: true,
+		},
+		{
+			name: "unknown type",
+			data: "@hello type=url\nbody",
+			wantErr: true,
+		},
+		{
+			name: "type=file with the path in the header",
+			data: "@hello type=file path=/tmp/notes.md\n",
+			want: Message{Type: PayloadFile, Path: "/tmp/notes.md", Label: "notes.md"},
+		},
+		{
+			name: "type=file with the path in the body",
+			data: "@hello type=file mode=append\n  /tmp/notes.md\n",
+			want: Message{Type: PayloadFile, Mode: ModeAppend, Path: "/tmp/notes.md", Label: "notes.md"},
+		},
+		{
+			name: "type=file keeps its label",
+			data: "@hello type=file label=\"my notes\"\n/tmp/notes.md",
+			want: Message{Type: PayloadFile, Path: "/tmp/notes.md", Label: "my notes"},
+		},
+		{
+			name: "type=file without a path",
+			data: "@hello type=file\n\n",
+			wantErr: true,
+		},
+		{
+			name: "type=clear",
+			data: "@hello type=clear\nignored",
+			want: Message{Type: PayloadClear},
+		},
+		{
+			name: "pdf",
+			data: "@hello label=doc.pdf\n%PDF-1.4\nrest",
+			want: Message{Label: "doc.pdf", MimeType: "application/pdf", Data: []byte("%PDF-1.4\nrest")},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Parse(c.data)
+			if c.wantErr {
+				if !errors.Is(err, ErrInvalidHeader) {
+					t.Fatalf("got %v, want ErrInvalidHeader", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got.Mode != c.want.Mode || got.Type != c.want.Type || got.Label != c.want.Label || got.Path != c.want.Path ||
+				got.Body != c.want.Body || got.MimeType != c.want.MimeType || string(got.Data) != string(c.want.Data) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValidSlotName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"pipe": true,
+		"git-diff_2": true,
+		"": false,
+		"a b": false,
+		"../x": false,
+		"é": false,
+	} {
+		if got := ValidSlotName(name); got != want {
+			t.Errorf("%q: got %v, want %v", name, got, want)
+		}
+	}
+}
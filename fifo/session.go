@@ -0,0 +1,256 @@
+package fifo
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"time"
+	"errors"
+	"slices"
+	"strconv"
+	"syscall"
+	"path/filepath"
+)
+
+// Each TUI gets its own directory of FIFOs named after its PID, current points to the last one started:
+//
+//	$XDG_RUNTIME_DIR/hello-llm/
+//		current -> 4242
+//		4242/pipe
+//		4242/notes
+//		4242/control.sock
+//		4250/pipe
+
+const CurrentLink string = "current"
+
+var (
+	ErrNoSession error = errors.New("No running hello session")
+	ErrSessionNotFound error = errors.New("No running hello session with this id")
+	ErrAmbiguousSession error = errors.New("Several hello sessions are running and none is current, pick one with --session")
+	ErrSlotNotFound error = errors.New("The session has no such context slot")
+	ErrNotListening error = errors.New("The session is not reading its context slot")
+)
+
+func SessionDir(base string, pid int) string {
+	return filepath.Join(base, strconv.Itoa(pid))
+}
+
+// EPERM means the process exists but belongs to someone else, it's alive all the same
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// PID of a session directory entry, false for anything that is not one
+func sessionPid(entry os.DirEntry) (int, bool) {
+	if !entry.IsDir() {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(entry.Name())
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+// Ids of the sessions whose process is still running, oldest first
+func LiveSessions(base string) ([]string, error) {
+	entries, err := os.ReadDir(base)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+	for _, entry := range entries {
+		if pid, ok := sessionPid(entry); ok && processAlive(pid) {
+			pids = append(pids, pid)
+		}
+	}
+	slices.Sort(pids)
+
+	ids := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		ids = append(ids, strconv.Itoa(pid))
+	}
+	return ids, nil
+}
+
+// Only removes FIFOs and sockets (the control socket) and then the directory if it ended up empty,
+// whatever else someone put there stays
+func removeSessionDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type() & (os.ModeNamedPipe | os.ModeSocket) != 0 {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(dir)
+}
+
+// Removes the directories of sessions that died without cleaning up after themselves (crash, closed terminal, ...)
+// and the FIFOs older versions left directly in base
+func CleanStale(base string) error {
+	entries, err := os.ReadDir(base)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, entry := range entries {
+		path := filepath.Join(base, entry.Name())
+		if entry.Type() & os.ModeNamedPipe != 0 {
+			errs = append(errs, os.Remove(path))
+			continue
+		}
+		// ReadDir doesn't follow symlinks, a link named like a PID is not ours to touch
+		pid, ok := sessionPid(entry)
+		if !ok || processAlive(pid) {
+			continue
+		}
+		errs = append(errs, removeSessionDir(path))
+	}
+
+	if _, err := currentSession(base); errors.Is(err, ErrNoSession) {
+		os.Remove(filepath.Join(base, CurrentLink))
+	}
+	return errors.Join(errs...)
+}
+
+// Points current to id, through a rename so readers never see a missing link
+func setCurrent(base string, id string) error {
+	tmp := filepath.Join(base, fmt.Sprintf(".%s.%d", CurrentLink, os.Getpid()))
+	os.Remove(tmp)
+	if err := os.Symlink(id, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(base, CurrentLink)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Id current points to, ErrNoSession when the link is missing or its session is gone
+func currentSession(base string) (string, error) {
+	target, err := os.Readlink(filepath.Join(base, CurrentLink))
+	if err != nil {
+		return "", ErrNoSession
+	}
+	pid, err := strconv.Atoi(target)
+	if err != nil || pid <= 0 || !processAlive(pid) {
+		return "", ErrNoSession
+	}
+	return target, nil
+}
+
+// Cleans up dead sessions, makes the directory of this process and points current to it
+func StartSession(base string) (string, error) {
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return "", err
+	}
+	// A failed cleanup leaves a few files behind, not a reason to go without FIFOs
+	CleanStale(base)
+
+	dir := SessionDir(base, os.Getpid())
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	if err := setCurrent(base, filepath.Base(dir)); err != nil {
+		return dir, err
+	}
+	return dir, nil
+}
+
+// Removes the directory of this process, current moves to the newest session still running
+func EndSession(base string) error {
+	id := strconv.Itoa(os.Getpid())
+	err := removeSessionDir(filepath.Join(base, id))
+
+	target, _ := os.Readlink(filepath.Join(base, CurrentLink))
+	if target != id {
+		return err
+	}
+	live, _ := LiveSessions(base)
+	live = slices.DeleteFunc(live, func(other string) bool { return other == id })
+	if len(live) == 0 {
+		os.Remove(filepath.Join(base, CurrentLink))
+	} else {
+		setCurrent(base, live[len(live)-1])
+	}
+	return err
+}
+
+// Directory of session id, or of the current session when id is empty.
+// Without a valid current link a single running session is unambiguous enough
+func FindSession(base string, id string) (string, error) {
+	if id != "" {
+		pid, err := strconv.Atoi(id)
+		if err != nil || pid <= 0 || !processAlive(pid) {
+			return "", fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+		}
+		if _, err := os.Stat(SessionDir(base, pid)); err != nil {
+			return "", fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+		}
+		return SessionDir(base, pid), nil
+	}
+
+	if current, err := currentSession(base); err == nil {
+		return filepath.Join(base, current), nil
+	}
+	live, err := LiveSessions(base)
+	if err != nil {
+		return "", err
+	}
+	switch len(live) {
+	case 0:
+		return "", ErrNoSession
+	case 1:
+		return filepath.Join(base, live[0]), nil
+	default:
+		return "", ErrAmbiguousSession
+	}
+}
+
+// Writes everything from r as one message to the FIFO at path.
+// The TUI reopens its FIFOs after each message, so a missing reader is retried until timeout
+func Send(path string, r io.Reader, timeout time.Duration) error {
+	stats, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrSlotNotFound, filepath.Base(path))
+	} else if err != nil {
+		return err
+	}
+	if stats.Mode() & os.ModeNamedPipe == 0 {
+		return ErrNotAFifo
+	}
+
+	// A blocking open would hang forever on a session that stopped listening
+	deadline := time.Now().Add(timeout)
+	var f *os.File
+	for {
+		f, err = os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.ENXIO) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ErrNotListening
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
@@ -5,37 +5,120 @@ import (
 	"os"
 	"fmt"
 	"log"
-	"bufio"
 	"errors"
 	"context"
+	"encoding/json"
 	"strings"
 	"syscall"
+	"time"
+	"slices"
+	"os/signal"
+	"path/filepath"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/adrg/xdg"
 
 	"github.com/hello-llm-2/app"
+	"github.com/hello-llm-2/config"
+	"github.com/hello-llm-2/fifo"
+	"github.com/hello-llm-2/history"
 	"github.com/hello-llm-2/providers"
 	"github.com/hello-llm-2/ui"
 	"github.com/hello-llm-2/argset"
+	"github.com/hello-llm-2/attach"
+	"github.com/hello-llm-2/control"
+	"github.com/hello-llm-2/session"
+	"github.com/hello-llm-2/tools"
 )
-const SystemPrompt string = "You are a helpful assistant prompted from a terminal shell. User expects straight to the point factual answers with minimal noise unless specified otherwise. Deliver response in plain text, limit markdown to only header tags (#). Be brief and informative."
+const ContextSummaryPrompt string = "Summarize the conversation below so that it can replace it, the assistant will only have your summary to continue from. Keep the facts, decisions, names, file paths, code and open questions that may matter later, drop the pleasantries. If it starts with an earlier summary, merge it in. Answer with the summary only."
+
+const SystemPrompt string = "You are a helpful assistant prompted from a terminal shell. User expects straight to the point factual answers with minimal noise unless specified otherwise. Markdown is rendered so format answers with it when it helps (headers, lists, emphasis, code blocks) but avoid tables and links. Be brief and informative."
 
 // Returns the new YOffset (if computed, else unchanged) and if the view is at the bottom or not
 func DrawScreen(app *app.AppState, screen tcell.Screen) (int, bool) {
 	screen.Clear()
+	// The prompt shows it back when it has the focus
+	screen.HideCursor()
+
+	sessionUsage, sessionCost, sessionCostKnown := app.SessionUsage()
+
+	var confirmationElement *ui.Text
+	if confirmation := app.ToolConfirmation(); confirmation != nil {
+		confirmationElement = ui.BuildToolConfirmationUiElement(
+			confirmation.Call.Name,
+			confirmation.Text,
+			confirmation.Editable,
+			confirmation.Editing,
+			)
+	}
+
+	var historySearchElement *ui.Text
+	if search := app.HistorySearch(); search != nil {
+		historySearchElement = ui.BuildHistorySearchUiElement(string(search.Query), app.HistorySearchMatch(), search.Match != -1)
+	}
+
+	chatHistory := app.ChatHistory()
+	branches := make([]ui.BranchPosition, len(chatHistory))
+	for i := range chatHistory {
+		branches[i].Index, branches[i].Count = app.ChatHistoryBranch(i)
+	}
+
+	contextSlots := []ui.ContextSlotInfo{}
+	for _, slot := range app.ContextSlots() {
+		contextSlots = append(contextSlots, ui.ContextSlotInfo{
+			Name: slot.Name,
+			Path: slot.Path,
+			Label: slot.Label,
+			Size: slot.Size(),
+			Failure: slot.FailureReason(),
+		})
+	}
+
+	attachments := []ui.AttachmentInfo{}
+	for _, at := range app.Attachments() {
+		attachments = append(attachments, ui.AttachmentInfo{Path: at.Path, Size: at.Size()})
+	}
+
+	contextUsage := app.ContextUsage()
+	contextGauge := ui.ContextGauge{
+		Tokens: contextUsage.Tokens,
+		Window: contextUsage.Window,
+		Dropped: contextUsage.Dropped,
+		Summarized: contextUsage.Summarized,
+	}
+
+	var retryElement *ui.Text
+	if app.Retry != nil {
+		retryElement = ui.BuildRetryUiElement(max(0, time.Until(app.Retry.At)), app.Retry.Attempt, app.Retry.MaxAttempts, app.Retry.Reason())
+	}
+
+	var messageEditElement *ui.Text
+	if app.MessageEditing() {
+		messageEditElement = ui.BuildMessageEditUiElement()
+	}
 
 	elements := []ui.StackElement{
-		ui.BuildChatHistory(app.ChatHistory(), app.LlmResponse(), app.Cfg().UseColor),
+		ui.BuildChatHistory(chatHistory, branches, app.LlmResponse(), app.SelectedCodeBlock, app.Cfg().UseColor),
+		confirmationElement,
+		ui.BuildNoticeUiElement(app.Notice),
+		retryElement,
 		ui.BuildUserErrorUiElement(app.UserError),
-		ui.BuildFifoFileUiElement(
-			app.PipedContent(),
-			app.NamedPipe().Path,
-			app.NamedPipe().Failure != 0,
+		ui.BuildAttachmentsUiElement(attachments),
+		ui.BuildContextSlotsUiElement(contextSlots),
+		ui.BuildStatusLine(
+			app.LastProvider(),
+			app.LastModel(),
+			sessionUsage,
+			sessionCost,
+			sessionCostKnown,
+			contextGauge,
 			),
-		ui.NewText(
-			app.UserPromptPrefixed(),
-			ui.TextParams{},
+		historySearchElement,
+		messageEditElement,
+		ui.NewPrompt(
+			app.UserPromptContent(),
+			app.UserPromptCursor(),
+			ui.PromptParams{ShowCursor: app.ToolConfirmation() == nil && app.HistorySearch() == nil},
 			),
 	}
 
@@ -55,42 +138,225 @@ func DrawScreen(app *app.AppState, screen tcell.Screen) (int, bool) {
 	return view.Yoffset, view.AtBottom()
 }
 
-func UserPromptSubmit(ctx context.Context, msgs []providers.AgnosticConversationMessage, provider providers.Provider, cfg *app.AppConfig, evTx chan<- AppEvent) {
+func UserPromptSubmit(ctx context.Context, msgs []providers.AgnosticConversationMessage, provider providers.Provider, tools []providers.ToolDefinition, cfg *app.AppConfig, evTx chan<- AppEvent) {
 	streamingParams := providers.StreamingRequestParams {
 		Messages: msgs,
 		ModelPreference: cfg.ModelPreference,
+		Model: cfg.Model,
 		AllowWebSearch: cfg.AllowWebSearch,
+		MaxTokens: cfg.MaxTokens,
+		Temperature: cfg.Temperature,
+		Tools: tools,
+		Retry: cfg.Retry,
+		OnRetry: func(info providers.RetryInfo) {
+			evTx <- AppEvent {Type: EvLlmRetry, Retry: info}
+		},
+		OnFallback: func(info providers.FallbackInfo) {
+			evTx <- AppEvent {Type: EvLlmFallback, Fallback: info}
+		},
 		OnChunkReceived: func(chunk string) {
 			evTx <- AppEvent {Type: EvLlmContentArrived, Data: chunk}
 		},
+		OnToolCallReceived: func(call providers.ToolCall) {
+			evTx <- AppEvent {Type: EvLlmToolCallArrived, ToolCall: call}
+		},
+		OnMetadataReceived: func(meta providers.ResponseMetadata) {
+			evTx <- AppEvent {Type: EvLlmMetadataArrived, Metadata: meta}
+		},
 		OnStreamingEnd: func(content string) {
 			evTx <- AppEvent {Type: EvLlmContentFinished, Data: content}
 		},
 		OnStreamingErr: func(err error) {
-			evTx <- AppEvent {Type: EvAppShowUserErr, Error: err}
+			evTx <- AppEvent {Type: EvLlmStreamingErr, Error: err}
+		},
+	}
+
+	go provider.StartStreamingRequest(ctx, streamingParams)
+}
+
+// Sends EvTick every second until at, or until ctx is done
+func TickUntil(ctx context.Context, at time.Time, evTx chan<- AppEvent) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for time.Now().Before(at) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case evTx <- AppEvent {Type: EvTick}:
+		}
+	}
+}
+
+// Asks the cheap model for a summary of job's messages, the result comes as EvContextSummarized
+func SummarizeContext(ctx context.Context, provider providers.Provider, job *app.SummaryJob, cfg *app.AppConfig, evTx chan<- AppEvent) {
+	transcript := strings.Builder{}
+	for _, msg := range job.Messages {
+		transcript.WriteString(fmt.Sprintf("[%s]\n", providers.MessageTypeToString(msg.Type)))
+		if msg.Content != "" {
+			transcript.WriteString(msg.Content + "\n")
+		}
+		if msg.ToolCall != nil && msg.Type == providers.MessageTypeToolCall {
+			transcript.WriteString(fmt.Sprintf("%s(%s)\n", msg.ToolCall.Name, msg.ToolCall.Arguments))
+		}
+		for _, part := range msg.Parts {
+			// Only their mention is kept, the model would have to see them again anyway
+			if part.Type != providers.PartText {
+				transcript.WriteString(fmt.Sprintf("(%s %s)\n", part.MimeType, part.Name))
+			}
+		}
+		transcript.WriteString("\n")
+	}
+
+	meta := providers.ResponseMetadata{}
+	streamingParams := providers.StreamingRequestParams {
+		Messages: []providers.AgnosticConversationMessage{
+			{Type: providers.MessageTypeSystem, Content: ContextSummaryPrompt},
+			{Type: providers.MessageTypeUser, Content: transcript.String()},
+		},
+		ModelPreference: providers.ModelPreferenceCheap,
+		Retry: cfg.Retry,
+		OnChunkReceived: func(chunk string) {},
+		OnMetadataReceived: func(m providers.ResponseMetadata) {
+			meta = m
+		},
+		OnStreamingEnd: func(content string) {
+			evTx <- AppEvent {Type: EvContextSummarized, Summary: job, Data: content, Metadata: meta}
+		},
+		OnStreamingErr: func(err error) {
+			evTx <- AppEvent {Type: EvContextSummarized, Summary: job, Error: err}
 		},
 	}
 
 	go provider.StartStreamingRequest(ctx, streamingParams)
 }
 
+// note is prepended to the result, the model should know when the user tampered with its call
+func RunToolCall(ctx context.Context, registry *tools.Registry, call providers.ToolCall, note string, evTx chan<- AppEvent) {
+	result := registry.Run(ctx, call)
+	evTx <- AppEvent {Type: EvToolResult, ToolCall: call, Data: note + result}
+}
+
 func ReceiveTuiEvent(tuiEv <-chan tcell.Event, appEvTx chan<- AppEvent) {
+	// Bracketed paste, keys are collected and sent at once so newlines don't submit the prompt
+	pasting := false
+	pasted := strings.Builder{}
+
+	edit := func(e app.LineEdit) {
+		appEvTx <- AppEvent {Type: EvUserPromptEdit, Edit: e}
+	}
+
 	for ev := range tuiEv {
 		switch ev.(type) {
+		case *tcell.EventPaste:
+			pasting = ev.(*tcell.EventPaste).Start()
+			if !pasting {
+				appEvTx <- AppEvent {Type: EvUserPromptPaste, Data: pasted.String()}
+				pasted.Reset()
+			}
 		case *tcell.EventKey:
-			switch ev.(*tcell.EventKey).Key() {
+			keyEv := ev.(*tcell.EventKey)
+			if pasting {
+				switch keyEv.Key() {
+				case tcell.KeyRune:
+					pasted.WriteRune(keyEv.Rune())
+				case tcell.KeyEnter, tcell.KeyLF:
+					pasted.WriteRune('\n')
+				case tcell.KeyTab:
+					pasted.WriteRune('\t')
+				}
+				continue
+			}
+
+			alt := keyEv.Modifiers() & tcell.ModAlt != 0
+			ctrl := keyEv.Modifiers() & tcell.ModCtrl != 0
+			switch keyEv.Key() {
 				case tcell.KeyCtrlC:
 					appEvTx <- AppEvent {Type: EvQuit}
+				case tcell.KeyEscape:
+					appEvTx <- AppEvent {Type: EvKeyEscape}
+				case tcell.KeyCtrlO:
+					appEvTx <- AppEvent {Type: EvCodeBlockSelect}
+				case tcell.KeyCtrlY:
+					appEvTx <- AppEvent {Type: EvCodeBlockCopy}
 				case tcell.KeyBackspace:
-					appEvTx <- AppEvent {Type: EvUserPromptPop}
+					if alt {
+						edit(app.LineEditKillWordBack)
+					} else {
+						appEvTx <- AppEvent {Type: EvUserPromptPop}
+					}
 				case tcell.KeyEnter:
-					appEvTx <- AppEvent {Type: EvUserPromptSubmit}
+					if alt || keyEv.Modifiers() & tcell.ModShift != 0 {
+						edit(app.LineEditNewLine)
+					} else {
+						appEvTx <- AppEvent {Type: EvUserPromptSubmit}
+					}
+				case tcell.KeyLF:
+					// Ctrl-J, for terminals that can't tell Shift-Enter apart
+					edit(app.LineEditNewLine)
 				case tcell.KeyUp:
-					appEvTx <- AppEvent {Type: EvViewScrollUp}
+					appEvTx <- AppEvent {Type: EvUserPromptUp}
 				case tcell.KeyDown:
-					appEvTx <- AppEvent {Type: EvViewScrollDown}
+					appEvTx <- AppEvent {Type: EvUserPromptDown}
+				case tcell.KeyCtrlP:
+					appEvTx <- AppEvent {Type: EvHistoryPrev}
+				case tcell.KeyCtrlN:
+					appEvTx <- AppEvent {Type: EvHistoryNext}
+				case tcell.KeyTab:
+					appEvTx <- AppEvent {Type: EvUserPromptComplete}
+				case tcell.KeyCtrlR:
+					appEvTx <- AppEvent {Type: EvHistorySearch}
+				case tcell.KeyPgUp:
+					appEvTx <- AppEvent {Type: EvViewPageUp}
+				case tcell.KeyPgDn:
+					appEvTx <- AppEvent {Type: EvViewPageDown}
+				case tcell.KeyLeft:
+					switch {
+					case alt:
+						appEvTx <- AppEvent {Type: EvBranchPrev}
+					case ctrl:
+						edit(app.LineEditWordLeft)
+					default:
+						edit(app.LineEditCursorLeft)
+					}
+				case tcell.KeyRight:
+					switch {
+					case alt:
+						appEvTx <- AppEvent {Type: EvBranchNext}
+					case ctrl:
+						edit(app.LineEditWordRight)
+					default:
+						edit(app.LineEditCursorRight)
+					}
+				case tcell.KeyCtrlB:
+					edit(app.LineEditCursorLeft)
+				case tcell.KeyCtrlF:
+					edit(app.LineEditCursorRight)
+				case tcell.KeyHome, tcell.KeyCtrlA:
+					edit(app.LineEditHome)
+				case tcell.KeyEnd, tcell.KeyCtrlE:
+					edit(app.LineEditEnd)
+				case tcell.KeyDelete, tcell.KeyCtrlD:
+					edit(app.LineEditDelete)
+				case tcell.KeyCtrlK:
+					edit(app.LineEditKillToEnd)
+				case tcell.KeyCtrlU:
+					edit(app.LineEditKillToStart)
+				case tcell.KeyCtrlW:
+					edit(app.LineEditKillWordBack)
 				case tcell.KeyRune:
-					appEvTx <- AppEvent{Type: EvUserPromptInput, Rune: ev.(*tcell.EventKey).Rune()}
+					switch {
+					case alt && keyEv.Rune() == 'b':
+						edit(app.LineEditWordLeft)
+					case alt && keyEv.Rune() == 'f':
+						edit(app.LineEditWordRight)
+					default:
+						appEvTx <- AppEvent{Type: EvUserPromptInput, Rune: keyEv.Rune()}
+					}
 			}
 		case *tcell.EventResize:
 			appEvTx <- AppEvent{Type: EvTermResize}
@@ -109,8 +375,18 @@ func ReceiveTuiEvent(tuiEv <-chan tcell.Event, appEvTx chan<- AppEvent) {
 type AppEvent struct {
 	Type AppEventType
 	Rune rune
+	Edit app.LineEdit
 	Data string
 	Error error
+	ToolCall providers.ToolCall
+	Metadata providers.ResponseMetadata
+	Retry providers.RetryInfo
+	Fallback providers.FallbackInfo
+	Summary *app.SummaryJob
+	// Context slot the fifo events are about
+	Slot string
+	Fifo fifo.Message
+	Control *control.Call
 }
 
 type AppEventType int
@@ -120,16 +396,43 @@ const (
 	EvTermResize
 	EvViewScrollUp
 	EvViewScrollDown
+	EvViewPageUp
+	EvViewPageDown
+	EvKeyEscape
+	EvCodeBlockSelect
+	EvCodeBlockCopy
 	EvUserPromptInput
 	EvUserPromptPop
+	EvUserPromptEdit
+	EvUserPromptPaste
+	EvUserPromptComplete
+	EvUserPromptUp
+	EvUserPromptDown
+	EvHistoryPrev
+	EvHistoryNext
+	EvHistorySearch
+	EvBranchPrev
+	EvBranchNext
 	EvUserPromptSubmit
 	EvLlmContentArrived
 	EvLlmContentFinished
+	EvLlmToolCallArrived
+	EvLlmMetadataArrived
+	// The request failed, unlike EvAppShowUserErr it ends the response
+	EvLlmStreamingErr
+	EvLlmRetry
+	EvLlmFallback
+	EvContextSummarized
+	// Nothing to do but redraw, e.g. for a countdown
+	EvTick
+	EvToolResult
 	EvFifoReceived
 	EvFifoErr
+	EvControlCall
 )
 
-func ListenToFifoFile(ctx context.Context, path string, evTx chan<- AppEvent) {
+// Each write to the FIFO is a message of the fifo protocol, files it points to are read here to keep the event loop responsive
+func ListenToFifoFile(ctx context.Context, slot string, path string, evTx chan<- AppEvent) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -139,37 +442,61 @@ func ListenToFifoFile(ctx context.Context, path string, evTx chan<- AppEvent) {
 
 		f, err := os.OpenFile(path, os.O_RDONLY, os.ModeNamedPipe)
 		if err != nil {
-			evTx <- AppEvent{Type: EvFifoErr}
+			evTx <- AppEvent{Type: EvFifoErr, Slot: slot, Error: err}
 			return
 		}
 
-		readBuf := make([]byte, 0, 255)
-		scannerDone := make(chan struct{})
-
+		// Read as is, images and PDFs would not survive a line scanner
+		readDone := make(chan struct{})
+		var data []byte
+		var readErr error
 		go func() {
-			scanner := bufio.NewScanner(f)
-			for scanner.Scan() {
-				readBuf = append(readBuf, scanner.Bytes()...)
-				readBuf = append(readBuf, '\n')
-			}
-			scannerDone <- struct{}{}
+			data, readErr = io.ReadAll(io.LimitReader(f, fifo.MaxPayloadSize + 1))
+			readDone <- struct{}{}
 		}()
 
 		select {
 		case <-ctx.Done():
 			f.Close()
-			<-scannerDone
+			<-readDone
 			return
-		case <-scannerDone:
-			evTx <- AppEvent{Type: EvFifoReceived, Data: string(readBuf)}
-			readBuf = readBuf[:0]
+		case <-readDone:
+			var msg fifo.Message
+			err := readErr
+			if err == nil && int64(len(data)) > fifo.MaxPayloadSize {
+				err = fmt.Errorf("%w: more than %d MB", attach.ErrFileTooBig, fifo.MaxPayloadSize / (1024 * 1024))
+			}
+			if err == nil {
+				msg, err = fifo.Parse(string(data))
+			}
+			if err == nil {
+				err = msg.Resolve()
+			}
+			if err != nil {
+				evTx <- AppEvent{Type: EvAppShowUserErr, Error: fmt.Errorf("Context slot %s: %w", slot, err)}
+			} else {
+				evTx <- AppEvent{Type: EvFifoReceived, Slot: slot, Fifo: msg}
+			}
 		}
 
 		f.Close()
 	}
 }
 
-func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen tcell.Screen, evRxTx chan AppEvent) {
+// Hands the requests of the control socket to the event loop, they are answered from there
+func ForwardControlCalls(ctx context.Context, server *control.Server, evTx chan<- AppEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case call := <-server.Calls():
+			evTx <- AppEvent{Type: EvControlCall, Control: call}
+		}
+	}
+}
+
+// server may be nil when the control socket couldn't be created
+func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen tcell.Screen, evRxTx chan AppEvent, server *control.Server) {
 	var evRx <-chan AppEvent = evRxTx
 	// Allows the event loop to send transmitters to other parts of the app
 	var evTx chan<- AppEvent = evRxTx
@@ -178,6 +505,7 @@ func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen
 
 	var requestCancelFunc context.CancelFunc
 	tryCancelRequest := func() bool {
+		app.Retry = nil
 		if requestCancelFunc != nil {
 			requestCancelFunc()
 			requestCancelFunc = nil
@@ -186,24 +514,194 @@ func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen
 		return false
 	}
 
-	submitPrompt := func() {
-		if tryCancelRequest() {
-			app.LlmResponseFinalize()
-		}
-
-		app.ChatHistoryAppendUserPrompt()
+	sendRequest := func() {
 		var rCtx context.Context
 		rCtx, requestCancelFunc = context.WithCancel(ctx)
 		cfg := app.Cfg()
+		streamingContent = true
+		// The request is sent once EvContextSummarized arrives
+		if job := app.ContextSummaryJob(); job != nil {
+			app.Notice = "Summarizing the oldest turns to fit the context window"
+			SummarizeContext(rCtx, app.Provider(), job, &cfg, evTx)
+			return
+		}
 		UserPromptSubmit(
 			rCtx,
-			app.ChatHistory(),
+			app.RequestHistory(),
 			app.Provider(),
+			app.ToolDefinitions(),
 			&cfg,
 			evTx,
 			)
+	}
+
+	// Tools share the request cancellation so interrupting the answer interrupts them too
+	var toolsCtx context.Context
+	runToolCalls := func(calls []providers.ToolCall) {
+		toolsCtx, requestCancelFunc = context.WithCancel(ctx)
+		for _, call := range calls {
+			if text, editable := app.Tools().Confirmation(call); text != "" {
+				app.ToolConfirmationPush(call, text, editable)
+				continue
+			}
+			go RunToolCall(toolsCtx, app.Tools(), call, "", evTx)
+		}
+	}
+
+	// Both act on the confirmation currently shown
+	approveToolCall := func() {
+		confirmation := app.ToolConfirmation()
+		call := confirmation.Call
+		note := ""
+		if confirmation.Edited() {
+			call = app.Tools().Edit(call, confirmation.Text)
+			note = fmt.Sprintf("The user edited the call before running it: %s\n", confirmation.Text)
+		}
+		app.ToolConfirmationPop()
+		go RunToolCall(toolsCtx, app.Tools(), call, note, evTx)
+	}
+
+	rejectToolCall := func() {
+		confirmation := app.ToolConfirmation()
+		app.ToolConfirmationPop()
+		if app.ToolCallResult(confirmation.Call, "The user rejected this call, it was not run") {
+			tryCancelRequest()
+			sendRequest()
+		}
+	}
+
+	interruptResponse := func() {
+		if tryCancelRequest() {
+			app.LlmResponseFinalize()
+		}
+		app.ToolCallsAbort()
+	}
+
+	submitPrompt := func() {
+		interruptResponse()
+		app.ChatHistoryAppendUserPrompt()
+		sendRequest()
 		app.UserPromptClear()
-		streamingContent = true
+	}
+
+	// Returns the notice to show
+	runCommand := func(prompt string) (string, error) {
+		cmd, arg, err := app.ParseCommand(prompt)
+		if err != nil {
+			return "", err
+		}
+
+		if cmd.StopsStreaming && tryCancelRequest() {
+			app.LlmResponseFinalize()
+			app.ToolCallsAbort()
+			streamingContent = false
+		}
+		result, err := app.RunCommand(cmd, arg)
+		if err != nil {
+			return "", err
+		}
+		if result.Resend {
+			sendRequest()
+		}
+		return result.Notice, nil
+	}
+
+	runUserCommand := func() {
+		prompt := string(app.UserPromptContent())
+		// Cleared first, /edit fills the prompt
+		app.UserPromptClear()
+		notice, err := runCommand(prompt)
+		if err != nil {
+			app.UserError = err.Error()
+			return
+		}
+		app.UserError = ""
+		app.Notice = notice
+	}
+
+	handleControlCall := func(call *control.Call) {
+		switch call.Method {
+		case control.MethodSubmit:
+			params := control.SubmitParams{}
+			if err := call.DecodeParams(&params); err != nil {
+				call.Reply(nil, err)
+				return
+			}
+			if strings.TrimSpace(params.Text) == "" {
+				call.Reply(nil, control.ErrInvalidParams)
+				return
+			}
+			text, command := app.ParsePrompt(params.Text)
+			if command {
+				notice, err := runCommand(params.Text)
+				call.Reply(control.NoticeResult{Notice: notice}, err)
+				return
+			}
+			// The draft in the prompt editor stays where it is
+			interruptResponse()
+			app.ChatHistoryAppendPrompt(text)
+			sendRequest()
+			call.Reply(nil, nil)
+		case control.MethodTranscript:
+			result := control.TranscriptResult{Response: app.LlmResponse(), Streaming: streamingContent}
+			for _, msg := range app.ChatHistory() {
+				result.Messages = append(result.Messages, control.TranscriptMessage{
+					Role: providers.MessageTypeToString(msg.Type),
+					Content: msg.Content,
+					ToolCall: msg.ToolCall,
+					Provider: msg.Provider,
+					Model: msg.Model,
+				})
+			}
+			call.Reply(result, nil)
+		case control.MethodAttach, control.MethodDetach:
+			params := control.AttachParams{}
+			if err := call.DecodeParams(&params); err != nil {
+				call.Reply(nil, err)
+				return
+			}
+			if params.Slot == "" {
+				params.Slot = fifo.DefaultSlot
+			}
+			if !app.ContextSlotExists(params.Slot) {
+				call.Reply(nil, fmt.Errorf("%w: %s", fifo.ErrSlotNotFound, params.Slot))
+				return
+			}
+
+			msg := fifo.Message{Label: params.Label, Body: params.Text}
+			switch {
+			case call.Method == control.MethodDetach:
+				msg.Type = fifo.PayloadClear
+			case params.Path != "":
+				msg.Type = fifo.PayloadFile
+				msg.Path = params.Path
+				if msg.Label == "" {
+					msg.Label = filepath.Base(params.Path)
+				}
+			}
+			if params.Append {
+				msg.Mode = fifo.ModeAppend
+			}
+			// Same path as the FIFOs, files are read away from the event loop
+			go func() {
+				if err := msg.Resolve(); err != nil {
+					call.Reply(nil, err)
+					return
+				}
+				evTx <- AppEvent{Type: EvFifoReceived, Slot: params.Slot, Fifo: msg}
+				call.Reply(nil, nil)
+			}()
+		case control.MethodModel:
+			params := control.ModelParams{}
+			if err := call.DecodeParams(&params); err != nil {
+				call.Reply(nil, err)
+				return
+			}
+			notice, err := runCommand("/model " + params.Model)
+			call.Reply(control.NoticeResult{Notice: notice}, err)
+		default:
+			call.Reply(nil, control.ErrMethodNotFound)
+		}
 	}
 
 	if len(args) > 0 {
@@ -216,10 +714,27 @@ func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen
 		submitPrompt()
 	}
 
-	if fifo := app.NamedPipe(); fifo.Failure == 0 {
-		fifoCtx, fifoCancel := context.WithCancel(ctx)
-		go ListenToFifoFile(fifoCtx, fifo.Path, evTx)
-		defer fifoCancel()
+	fifoCtx, fifoCancel := context.WithCancel(ctx)
+	defer fifoCancel()
+	for _, pipe := range app.NamedPipes() {
+		if pipe.Failure == 0 {
+			go ListenToFifoFile(fifoCtx, pipe.Name, pipe.Path, evTx)
+		}
+	}
+
+	// Whatever happens, leave with the conversation on disk
+	defer app.SessionSave()
+
+	showUserErr := func(err error) {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		app.UserError = ErrorWithHint(err)
+		server.Notify(control.NotificationError, control.ErrorParams{
+			Message: err.Error(),
+			Kind: providers.ErrorKindToString(providers.ErrorKindOf(err)),
+			Hint: providers.ErrorHint(err),
+		})
 	}
 
 	DrawScreen(app, screen)
@@ -229,9 +744,7 @@ func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen
 		case EvQuit:
 			return
 		case EvAppShowUserErr:
-			if ev.Error != context.Canceled {
-				app.UserError = ev.Error.Error()
-			}
+			showUserErr(ev.Error)
 		case EvTermResize:
 			// redraw -- Done below
 		case EvViewScrollUp:
@@ -244,28 +757,230 @@ func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen
 				app.FreeScrollMode = true
 				app.ScrollPosition += 1
 			}
+		case EvViewPageUp:
+			_, screenHeight := screen.Size()
+			if app.ScrollPosition > 0 {
+				app.FreeScrollMode = true
+				app.ScrollPosition = max(0, app.ScrollPosition - screenHeight + 1)
+			}
+		case EvViewPageDown:
+			_, screenHeight := screen.Size()
+			if !app.ViewAtBottom {
+				app.FreeScrollMode = true
+				// The view clamps it if that goes past the bottom
+				app.ScrollPosition += screenHeight - 1
+			}
+		case EvKeyEscape:
+			app.Notice = ""
+			if confirmation := app.ToolConfirmation(); confirmation != nil {
+				confirmation.Editing = false
+			} else if app.HistorySearch() != nil {
+				app.HistorySearchCancel()
+			} else if app.MessageEditing() {
+				app.MessageEditCancel()
+			} else {
+				app.SelectedCodeBlock = -1
+			}
+		case EvCodeBlockSelect:
+			// Walks up from the most recent block, wrapping around
+			count := len(ui.ChatCodeBlocks(app.ChatHistory(), app.LlmResponse()))
+			app.Notice = ""
+			if count == 0 {
+				app.Notice = "No code block in this conversation"
+			} else if app.SelectedCodeBlock <= 0 || app.SelectedCodeBlock >= count {
+				app.SelectedCodeBlock = count - 1
+			} else {
+				app.SelectedCodeBlock -= 1
+			}
+		case EvCodeBlockCopy:
+			blocks := ui.ChatCodeBlocks(app.ChatHistory(), app.LlmResponse())
+			if len(blocks) == 0 {
+				app.Notice = "No code block to copy"
+				break
+			}
+			// Nothing selected means the latest block
+			idx := app.SelectedCodeBlock
+			if idx < 0 || idx >= len(blocks) {
+				idx = len(blocks) - 1
+			}
+			// OSC 52, the terminal does the copy so it works over ssh too
+			screen.SetClipboard([]byte(blocks[idx].Content))
+			app.Notice = fmt.Sprintf("Copied code block %d/%d (%d lines)", idx + 1, len(blocks), strings.Count(blocks[idx].Content, "\n") + 1)
 		case EvUserPromptInput:
-			app.UserPromptAppendRune(ev.Rune)
+			app.Notice = ""
+			if confirmation := app.ToolConfirmation(); confirmation != nil {
+				switch {
+				case confirmation.Editing:
+					confirmation.EditAppendRune(ev.Rune)
+				case ev.Rune == 'y':
+					approveToolCall()
+				case ev.Rune == 'n':
+					rejectToolCall()
+				case ev.Rune == 'e' && confirmation.Editable:
+					confirmation.Editing = true
+				}
+			} else if app.HistorySearch() != nil {
+				app.HistorySearchAppendRune(ev.Rune)
+			} else {
+				app.UserPromptAppendRune(ev.Rune)
+			}
 		case EvUserPromptPop:
-			app.UserPromptPop()
+			if confirmation := app.ToolConfirmation(); confirmation != nil {
+				if confirmation.Editing {
+					confirmation.EditPop()
+				}
+			} else if app.HistorySearch() != nil {
+				app.HistorySearchPop()
+			} else {
+				app.UserPromptPop()
+			}
+		case EvUserPromptEdit:
+			app.Notice = ""
+			// The confirmation editor only knows how to append and pop
+			if app.ToolConfirmation() == nil {
+				if app.HistorySearch() != nil {
+					app.HistorySearchAccept()
+				}
+				app.UserPromptEdit(ev.Edit)
+			}
+		case EvUserPromptUp, EvUserPromptDown, EvHistoryPrev, EvHistoryNext:
+			if app.ToolConfirmation() != nil {
+				break
+			}
+			if app.HistorySearch() != nil {
+				app.HistorySearchAccept()
+			}
+			switch ev.Type {
+			case EvUserPromptUp:
+				app.UserPromptUp()
+			case EvUserPromptDown:
+				app.UserPromptDown()
+			case EvHistoryPrev:
+				app.HistoryPrev()
+			case EvHistoryNext:
+				app.HistoryNext()
+			}
+		case EvUserPromptComplete:
+			if app.ToolConfirmation() == nil && app.HistorySearch() == nil {
+				if candidates := app.UserPromptComplete(); len(candidates) > 0 {
+					app.Notice = strings.Join(candidates, "  ")
+				}
+			}
+		case EvBranchPrev, EvBranchNext:
+			offset := 1
+			if ev.Type == EvBranchPrev {
+				offset = -1
+			}
+			// Switching under a response being written would attach it to the wrong branch
+			if streamingContent || app.ToolConfirmation() != nil {
+				break
+			}
+			app.BranchSwitch(offset)
+		case EvHistorySearch:
+			if app.ToolConfirmation() == nil {
+				app.HistorySearchStart()
+			}
+		case EvUserPromptPaste:
+			if confirmation := app.ToolConfirmation(); confirmation != nil {
+				if confirmation.Editing {
+					for _, r := range ev.Data {
+						confirmation.EditAppendRune(r)
+					}
+				}
+			} else {
+				app.UserPromptInsert(ev.Data)
+			}
 		case EvUserPromptSubmit:
-			if app.UserPromptEmpty() {
+			if confirmation := app.ToolConfirmation(); confirmation != nil {
+				if confirmation.Editing {
+					approveToolCall()
+				}
+			} else if app.HistorySearch() != nil {
+				app.HistorySearchAccept()
+			} else if app.UserPromptEmpty() {
 				if !streamingContent {
 					return
 				} else if tryCancelRequest() {
 					app.LlmResponseFinalize()
+					app.ToolCallsAbort()
+					streamingContent = false
 				}
 			} else {
-				submitPrompt()
+				if err := app.HistoryAppend(string(app.UserPromptContent())); err != nil {
+					app.UserError = fmt.Sprintf("Failed to save prompt history: %s", err)
+				}
+				if app.UserPromptIsCommand() {
+					runUserCommand()
+				} else {
+					submitPrompt()
+				}
 			}
 		case EvLlmContentArrived:
+			app.Retry = nil
 			app.LlmResponsePush(ev.Data)
+			server.Notify(control.NotificationChunk, control.ChunkParams{Text: ev.Data})
 		case EvLlmContentFinished:
 			tryCancelRequest()
+			content := app.LlmResponse()
 			app.LlmResponseFinalize()
+			if calls := app.ToolCallsStart(); len(calls) > 0 {
+				runToolCalls(calls)
+				break
+			}
 			streamingContent = false
+			server.Notify(control.NotificationDone, control.DoneParams{Content: content})
+			if err := app.SessionSave(); err != nil {
+				app.UserError = fmt.Sprintf("Failed to save session: %s", err)
+			}
+		case EvLlmToolCallArrived:
+			app.ToolCallPush(ev.ToolCall)
+		case EvLlmMetadataArrived:
+			app.UsageRecord(ev.Metadata)
+		case EvLlmStreamingErr:
+			// An interrupted request was already cleaned up, a newer one may be streaming
+			if errors.Is(ev.Error, context.Canceled) {
+				break
+			}
+			tryCancelRequest()
+			app.LlmResponseFinalize()
+			app.ToolCallsAbort()
+			streamingContent = false
+			showUserErr(ev.Error)
+		case EvLlmRetry:
+			// Could come from a request that was just interrupted
+			if streamingContent {
+				go TickUntil(ctx, app.RetryScheduled(ev.Retry), evTx)
+			}
+		case EvLlmFallback:
+			app.Retry = nil
+			app.Notice = FallbackNotice(ev.Fallback)
+		case EvContextSummarized:
+			// The request was interrupted in the meantime
+			if !streamingContent || errors.Is(ev.Error, context.Canceled) {
+				break
+			}
+			app.Notice = ""
+			if ev.Error != nil {
+				app.ContextSummaryFailed()
+				app.Notice = SummaryFailedNotice(ev.Error)
+			} else {
+				app.ContextSummaryStore(ev.Summary, ev.Data, ev.Metadata)
+			}
+			tryCancelRequest()
+			sendRequest()
+		case EvTick:
+			// redraw -- Done below
+		case EvToolResult:
+			if app.ToolCallResult(ev.ToolCall, ev.Data) {
+				tryCancelRequest()
+				sendRequest()
+			}
 		case EvFifoReceived:
-			app.PipedContentSet(ev.Data)
+			app.ContextSlotReceive(ev.Slot, ev.Fifo)
+		case EvFifoErr:
+			app.ContextSlotFailed(ev.Slot)
+		case EvControlCall:
+			handleControlCall(ev.Control)
 		}
 
 		newYOffset, atBottom := DrawScreen(app, screen)
@@ -277,184 +992,483 @@ func RunEventLoop(ctx context.Context, app *app.AppState, args []string, screen
 	}
 }
 
-func RunOneShot(ctx context.Context, app *app.AppState, args []string) {
+// Final object of the json format, also the last event of the jsonl format
+type OneShotResult struct {
+	Type string `json:"type,omitempty"`
+	Provider string `json:"provider"`
+	Model string `json:"model"`
+	Content string `json:"content"`
+	FinishReason string `json:"finish_reason"`
+	Usage providers.Usage `json:"usage"`
+	LatencyMs int64 `json:"latency_ms"`
+	Error string `json:"error,omitempty"`
+	// See providers.ErrorKindToString
+	ErrorKind string `json:"error_kind,omitempty"`
+	Hint string `json:"hint,omitempty"`
+}
+
+type OneShotEvent struct {
+	Type string `json:"type"`
+	Content string `json:"content,omitempty"`
+	ToolCall *providers.ToolCall `json:"tool_call,omitempty"`
+}
+
+// Exit codes of the one-shot mode
+const (
+	ExitOk int = 0
+	// Any other error
+	ExitProviderError int = 1
+	// Invalid flags or config file, nothing was sent
+	ExitUsage int = 2
+	ExitAuth int = 3
+	ExitQuota int = 4
+	ExitRateLimit int = 5
+	ExitModelNotFound int = 6
+	ExitContextTooLong int = 7
+	ExitContentFilter int = 8
+	ExitNetwork int = 9
+	// Same as shells for a process killed by SIGINT
+	ExitInterrupted int = 130
+)
+
+func ErrorExitCode(err error) int {
+	switch providers.ErrorKindOf(err) {
+	case providers.ErrorKindAuth:
+		return ExitAuth
+	case providers.ErrorKindQuota:
+		return ExitQuota
+	case providers.ErrorKindRateLimit:
+		return ExitRateLimit
+	case providers.ErrorKindModelNotFound:
+		return ExitModelNotFound
+	case providers.ErrorKindContextTooLong:
+		return ExitContextTooLong
+	case providers.ErrorKindContentFilter:
+		return ExitContentFilter
+	case providers.ErrorKindNetwork:
+		return ExitNetwork
+	default:
+		return ExitProviderError
+	}
+}
+
+func SummaryFailedNotice(err error) string {
+	reason := providers.ErrorHint(err)
+	if reason == "" {
+		reason = err.Error()
+	}
+	return "Couldn't summarize the oldest turns, they are left out instead: " + reason
+}
+
+func FallbackNotice(info providers.FallbackInfo) string {
+	reason := providers.ErrorHint(info.Err)
+	if reason == "" {
+		reason = info.Err.Error()
+	}
+	return fmt.Sprintf(
+		"%s failed, trying %s: %s",
+		providers.ProviderTypeToString(info.From),
+		providers.ProviderTypeToString(info.To),
+		reason,
+		)
+}
+
+// The error followed by what to do about it, when there's something to say
+func ErrorWithHint(err error) string {
+	if hint := providers.ErrorHint(err); hint != "" {
+		return fmt.Sprintf("%s\n%s", hint, err)
+	}
+	return err.Error()
+}
+
+// Returns the process exit code
+func RunOneShot(ctx context.Context, appState *app.AppState, args []string) int {
 	if len(args) == 0 {
-		return
+		return ExitOk
 	}
 
 	appEvCh := make(chan AppEvent, 5)
 	var evRx <-chan AppEvent = appEvCh
 	var evTx chan<- AppEvent = appEvCh
 
-	cfg := app.Cfg()
+	ctx, cancelRequest := context.WithCancel(ctx)
+	defer cancelRequest()
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	cfg := appState.Cfg()
+	if cfg.PrintUsage {
+		// Failed and interrupted requests may have cost something too
+		defer PrintUsageSummary(appState)
+	}
+	streamText := cfg.OutputFormat == app.OutputFormatText && cfg.StreamStdout
+	// Content of the response being streamed, whatever was received is printed if interrupted
+	partialContent := strings.Builder{}
+	stdoutJson := json.NewEncoder(os.Stdout)
+	startedAt := time.Now()
+	// Replies preceding tool calls count as content too
+	contents := []string{}
+	finishReason := ""
+
+	result := func() OneShotResult {
+		usage, _, _ := appState.SessionUsage()
+		return OneShotResult {
+			Provider: appState.LastProvider(),
+			Model: appState.LastModel(),
+			Content: strings.Join(contents, "\n"),
+			FinishReason: finishReason,
+			Usage: usage,
+			LatencyMs: time.Since(startedAt).Milliseconds(),
+		}
+	}
 
 	prompt := strings.Builder{}
 	if (!cfg.NoGreet) {
 		prompt.WriteString("Hello, ")
 	}
 	prompt.WriteString(strings.Join(args, " "))
-	app.UserPromptSet(prompt.String())
-	app.ChatHistoryAppendUserPrompt()
-	UserPromptSubmit(
-		ctx,
-		app.ChatHistory(),
-		app.Provider(),
-		&cfg,
-		evTx,
-		)
-
-	for ev := range evRx {
-		switch ev.Type {
-		case EvLlmContentFinished:
-			fmt.Println(ev.Data)
-			return
-		case EvAppShowUserErr:
-			fmt.Fprintf(os.Stderr, ev.Error.Error())
+	appState.UserPromptSet(prompt.String())
+	appState.ChatHistoryAppendUserPrompt()
+	sendRequest := func() {
+		if job := appState.ContextSummaryJob(); job != nil {
+			SummarizeContext(ctx, appState.Provider(), job, &cfg, evTx)
 			return
-		default:
 		}
+		UserPromptSubmit(
+			ctx,
+			appState.RequestHistory(),
+			appState.Provider(),
+			appState.ToolDefinitions(),
+			&cfg,
+			evTx,
+			)
 	}
-}
-
-var (
-	ErrConfigCorrupted error = errors.New("Config corrupted")
-	ErrConfigCreation error = errors.New("An unknown error occured while writing to config file")
-)
+	sendRequest()
 
-func ReadConfig(cfg *app.AppConfig) error {
-	cfgDir, err := os.UserConfigDir()
-	if err != nil {
-		return err
-	}
-	cfgFile, err := os.Open(cfgDir + "/hello-llm/cfg")
-	if err != nil {
-		return err
-	}
-	defer cfgFile.Close()
+	for {
+		var ev AppEvent
+		select {
+		case ev = <-evRx:
+		case <-interrupted:
+			cancelRequest()
+			if partialContent.Len() > 0 {
+				contents = append(contents, partialContent.String())
+			}
+			finishReason = "interrupted"
+
+			switch cfg.OutputFormat {
+			case app.OutputFormatText:
+				if streamText {
+					fmt.Println()
+				} else if partialContent.Len() > 0 {
+					fmt.Println(partialContent.String())
+				}
+			case app.OutputFormatJson:
+				stdoutJson.Encode(result())
+			case app.OutputFormatJsonl:
+				done := result()
+				done.Type = "done"
+				stdoutJson.Encode(done)
+			}
 
-	scanner := bufio.NewScanner(cfgFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		key, value, found := strings.Cut(line, "=")
-		if !found {
-			return ErrConfigCorrupted
+			appState.LlmResponsePush(partialContent.String())
+			appState.LlmResponseFinalize()
+			appState.ToolCallsAbort()
+			appState.SessionSave()
+			return ExitInterrupted
 		}
 
-		var err error
-		switch key {
-		case "default_provider":
-			cfg.Provider, err = providers.ProviderTypeFromString(value)
-			if err != nil {
-				return ErrConfigCorrupted
+		switch ev.Type {
+		case EvLlmContentArrived:
+			partialContent.WriteString(ev.Data)
+			switch {
+			case streamText:
+				fmt.Print(ev.Data)
+			case cfg.OutputFormat == app.OutputFormatJsonl:
+				stdoutJson.Encode(OneShotEvent{Type: "chunk", Content: ev.Data})
 			}
-		case "default_model_preference":
-			cfg.ModelPreference, err = providers.ModelPreferenceFromString(value)
-			if err != nil {
-				return ErrConfigCorrupted
+		case EvLlmToolCallArrived:
+			appState.ToolCallPush(ev.ToolCall)
+			if cfg.OutputFormat == app.OutputFormatJsonl {
+				stdoutJson.Encode(OneShotEvent{Type: "tool_call", ToolCall: &ev.ToolCall})
+			}
+		case EvLlmMetadataArrived:
+			appState.UsageRecord(ev.Metadata)
+			finishReason = ev.Metadata.FinishReason
+		case EvLlmRetry:
+			// Stdout only gets the response, whatever the format
+			fmt.Fprintf(os.Stderr, "Retrying in %s (attempt %d/%d): %s\n", ev.Retry.Delay.Round(time.Millisecond), ev.Retry.Attempt, ev.Retry.MaxAttempts, ev.Retry.Reason())
+		case EvLlmFallback:
+			fmt.Fprintln(os.Stderr, FallbackNotice(ev.Fallback))
+		case EvContextSummarized:
+			if ev.Error != nil {
+				appState.ContextSummaryFailed()
+				fmt.Fprintln(os.Stderr, SummaryFailedNotice(ev.Error))
+			} else {
+				appState.ContextSummaryStore(ev.Summary, ev.Data, ev.Metadata)
+			}
+			sendRequest()
+		case EvToolResult:
+			if appState.ToolCallResult(ev.ToolCall, ev.Data) {
+				sendRequest()
+			}
+		case EvLlmContentFinished:
+			partialContent.Reset()
+			if ev.Data != "" {
+				contents = append(contents, ev.Data)
+				if streamText {
+					fmt.Println()
+				} else if cfg.OutputFormat == app.OutputFormatText {
+					fmt.Println(ev.Data)
+				}
+			}
+			appState.LlmResponsePush(ev.Data)
+			appState.LlmResponseFinalize()
+			if calls := appState.ToolCallsStart(); len(calls) > 0 {
+				for _, call := range calls {
+					// Nobody is there to approve anything
+					if text, _ := appState.Tools().Confirmation(call); text != "" {
+						go func() {
+							evTx <- AppEvent {Type: EvToolResult, ToolCall: call, Data: "This call requires the user's approval which can't be asked in one-shot mode, it was not run"}
+						}()
+						continue
+					}
+					go RunToolCall(ctx, appState.Tools(), call, "", evTx)
+				}
+				continue
+			}
+
+			switch cfg.OutputFormat {
+			case app.OutputFormatJson:
+				stdoutJson.Encode(result())
+			case app.OutputFormatJsonl:
+				done := result()
+				done.Type = "done"
+				stdoutJson.Encode(done)
+			}
+
+			if err := appState.SessionSave(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to save session: %s\n", err)
 			}
+			return ExitOk
+		case EvAppShowUserErr, EvLlmStreamingErr:
+			failure := result()
+			failure.Error = ev.Error.Error()
+			failure.ErrorKind = providers.ErrorKindToString(providers.ErrorKindOf(ev.Error))
+			failure.Hint = providers.ErrorHint(ev.Error)
+			switch cfg.OutputFormat {
+			case app.OutputFormatJson:
+				stdoutJson.Encode(failure)
+			case app.OutputFormatJsonl:
+				failure.Type = "error"
+				stdoutJson.Encode(failure)
+			}
+			if streamText && partialContent.Len() > 0 {
+				fmt.Println()
+			}
+			fmt.Fprintln(os.Stderr, ErrorWithHint(ev.Error))
+			return ErrorExitCode(ev.Error)
+		default:
 		}
 	}
-
-	return nil
 }
 
-func InitConfig(cfg *app.AppConfig) error {
-	fmt.Println("You are seeing this screen because we need to build the default config for 'hello-llm'")
-	fmt.Println("Please select your preferred default LLM provider:")
-	fmt.Println("\t1. OpenAI (Uses OPENAI_API_KEY environment variable)")
-	fmt.Println("\t2. Anthropic (Uses ANTHROPIC_API_KEY environment variable)")
-	fmt.Println("\t3. Google (Uses GEMINI_API_KEY environment variable)")
-	fmt.Println("\t4. xAI (Uses XAI_API_KEY environment variable)")
+func PrintUsageSummary(app *app.AppState) {
+	usage, cost, known := app.SessionUsage()
+	costStr := fmt.Sprintf("$%.6f", cost)
+	if !known {
+		costStr = "unknown (model missing from the price table)"
+	}
+	// Nothing answered when the first request failed
+	model := ""
+	if app.LastModel() != "" {
+		model = app.LastModel() + " · "
+	}
+	fmt.Fprintf(
+		os.Stderr,
+		"usage: %s%d input tokens (%d cached, %d written to the cache) · %d output tokens · cost %s\n",
+		model,
+		usage.InputTokens,
+		usage.CachedTokens,
+		usage.CacheWriteTokens,
+		usage.OutputTokens,
+		costStr,
+		)
+}
 
-	for {
-		var choice int
-		fmt.Print("> ")
-		n, err := fmt.Scan(&choice)
-		if err != nil || n != 1 {
-			fmt.Println("Please enter a single number matching the selected provider")
-			fmt.Scanln()
-		}
+// Where the session directories live, empty when the platform has no runtime dir
+func FifoBaseDir() string {
+	// This is where windows users will lack
+	if xdg.RuntimeDir == "" {
+		return ""
+	}
+	return filepath.Join(xdg.RuntimeDir, "hello-llm")
+}
 
-		switch choice {
-		case 1:
-			cfg.Provider = providers.ProviderOpenai
-		case 2:
-			cfg.Provider = providers.ProviderAnthropic
-		case 3:
-			cfg.Provider = providers.ProviderGemini
-		case 4:
-			cfg.Provider = providers.ProviderGrok
+// One FIFO per slot in the directory of this session, a slot that can't get one is kept to tell the user why
+func CreateNamedPipes(names []string) []app.NamedPipeFile {
+	dir := ""
+	dirFailure := app.NamedPipeFailureNoSuitablePath
+	if base := FifoBaseDir(); base != "" {
+		var err error
+		dir, err = fifo.StartSession(base)
+		switch {
+		case err == nil:
+			dirFailure = app.NamedPipeFailureNone
+		case errors.Is(err, os.ErrPermission):
+			dirFailure = app.NamedPipeFailureNotAllowed
+		case dir != "":
+			// Only current couldn't be updated, hello ctx --session still finds this one
+			dirFailure = app.NamedPipeFailureNone
+		default:
+			dirFailure = app.NamedPipeFailureOther
 		}
-		break
 	}
 
-	fmt.Println("Please select your default model preference:")
-	fmt.Println("\t1. Cheap (Model with a small cost, may not be the cheapest of all though)")
-	fmt.Println("\t2. Fast (Generally same as cheap but if a faster more costly alternative exist it will be favored)")
-	fmt.Println("\t3. Smart (More advanced models, generally higher cost)")
-
-	for {
-		var choice int
-		fmt.Print("> ")
-		n, err := fmt.Scan(&choice)
-		if err != nil || n != 1 {
-			fmt.Println("Please enter a single number matching the selected model preference")
-			fmt.Scanln()
+	pipes := []app.NamedPipeFile{}
+	for _, name := range names {
+		if slices.ContainsFunc(pipes, func(pipe app.NamedPipeFile) bool { return pipe.Name == name }) {
+			continue
+		}
+		pipe := app.NamedPipeFile{Name: name, Failure: dirFailure}
+		if dirFailure != app.NamedPipeFailureNone {
+			pipes = append(pipes, pipe)
+			continue
 		}
 
-		switch choice {
-		case 1:
-			cfg.ModelPreference = providers.ModelPreferenceCheap
-		case 2:
-			cfg.ModelPreference = providers.ModelPreferenceFast
-		case 3:
-			cfg.ModelPreference = providers.ModelPreferenceSmart
+		path, err := fifo.Create(dir, name)
+		pipe.Path = path
+		switch {
+		case err == nil:
+		case errors.Is(err, fifo.ErrNotAFifo):
+			pipe.Failure = app.NamedPipeFailureAlreadyExists
+		case errors.Is(err, os.ErrPermission):
+			pipe.Failure = app.NamedPipeFailureNotAllowed
+		default:
+			pipe.Failure = app.NamedPipeFailureOther
 		}
-		break
+		pipes = append(pipes, pipe)
 	}
+	return pipes
+}
 
-	cfgDir, err := os.UserConfigDir()
-	if err != nil {
-		return err
+// hello ctx: sends stdin to a context slot of a running TUI
+func RunCtx(argv []string) int {
+	argSession := ""
+	argSlot := fifo.DefaultSlot
+	argList := false
+	argTimeout := 2
+
+	args := argset.NewArgSet()
+	args.Description("Send what is piped to stdin to a context slot of a running hello session.\nThe content may start with a header line, e.g. @hello mode=append label=\"git diff\" or @hello type=file path=notes.md")
+	args.Usage("hello ctx [OPTIONS] < FILE")
+	args.AddString(&argSession, '\x00', "session", "", "Id of the session (its PID), defaults to the last one started")
+	args.AddString(&argSlot, '\x00', "slot", fifo.DefaultSlot, "Context slot to write to")
+	args.AddInt(&argTimeout, '\x00', "timeout", 2, "Seconds to wait for the session to read its slot")
+	args.AddFlag(&argList, '\x00', "list", false, "List the running sessions and exit")
+	err := args.Parse(argv)
+	if errors.Is(err, argset.ErrHelp) {
+		args.PrintHelp()
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
 	}
-	if err := os.MkdirAll(cfgDir + "/hello-llm", 0700); err != nil {
-		return err
+
+	base := FifoBaseDir()
+	if base == "" {
+		fmt.Fprintln(os.Stderr, "No runtime directory (XDG_RUNTIME_DIR), hello sessions have no FIFOs")
+		return 1
 	}
-	f, err := os.OpenFile(cfgDir + "/hello-llm/cfg", os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		return err
+
+	if argList {
+		live, err := fifo.LiveSessions(base)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list sessions: %s\n", err)
+			return 1
+		}
+		current, _ := fifo.FindSession(base, "")
+		for _, id := range live {
+			marker := " "
+			if filepath.Join(base, id) == current {
+				marker = "*"
+			}
+			slots := []string{}
+			entries, _ := os.ReadDir(filepath.Join(base, id))
+			for _, entry := range entries {
+				if entry.Type() & os.ModeNamedPipe != 0 {
+					slots = append(slots, entry.Name())
+				}
+			}
+			fmt.Printf("%s %s  %s\n", marker, id, strings.Join(slots, ", "))
+		}
+		return 0
 	}
-	defer f.Close()
-	if err := f.Truncate(0); err != nil {
-		return err
+
+	if !fifo.ValidSlotName(argSlot) {
+		fmt.Fprintf(os.Stderr, "Invalid slot name %q: %s\n", argSlot, fifo.ErrInvalidSlotName)
+		return 1
 	}
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return ErrConfigCreation
+	stdinStat, _ := os.Stdin.Stat()
+	if stdinStat.Mode() & os.ModeCharDevice != 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to send, pipe something to hello ctx")
+		return 1
 	}
 
-	if _, err := f.WriteString("default_provider=" + providers.ProviderTypeToString(cfg.Provider) + "\n"); err != nil {
-		return ErrConfigCreation
+	dir, err := fifo.FindSession(base, argSession)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
 	}
-
-	if _, err := f.WriteString("default_model_preference=" + providers.ModelPreferenceToString(cfg.ModelPreference)); err != nil {
-		return ErrConfigCreation
+	err = fifo.Send(filepath.Join(dir, argSlot), os.Stdin, time.Duration(argTimeout) * time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send to session %s: %s\n", filepath.Base(dir), err)
+		return 1
 	}
-
-	return nil
+	return 0
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctx" {
+		os.Exit(RunCtx(os.Args[2:]))
+	}
+
 	cfg := app.AppConfig {
 		ModelPreference: providers.ModelPreferenceCheap,
+		Models: providers.DefaultModelCatalog(),
 		AllowWebSearch: false,
 		UseStdout: false,
 		UseColor: false,
 		NoGreet: false,
 		SystemPrompt: SystemPrompt,
+		Local: app.LocalServer {
+			// Ollama's default
+			BaseUrl: "http://localhost:11434",
+			// What most self hosted setups manage, the config file should say when there's more
+			ContextWindow: 8192,
+		},
+		Shell: tools.ShellSettings {
+			Timeout: 30 * time.Second,
+		},
+		Retry: providers.DefaultRetryPolicy(),
 	}
 
 	argProvider := ""
+	argFallback := ""
 	argModelPreference := ""
+	argResume := ""
+	argContinue := false
+	argListSessions := false
+	argFormat := "text"
+	argStream := "auto"
+	argProfile := ""
+	argWebSearch := false
+	argTools := false
+	argColor := false
+	argModel := ""
+	argFifos := []string{}
+	argFiles := []string{}
 
 	providerOptions := ""
 	for i := providers.ProviderType(0); i < providers.ProviderLast; i++ {
@@ -473,55 +1487,154 @@ func main() {
 	}
 
 	args := argset.NewArgSet()
-	args.Description("hello-llm (hello) allows you to prompt LLM of different providers for a quick chat or as part of a bigger pipeline.")
-	args.AddFlag(&cfg.AllowWebSearch, 'w', "web-search", false, "Enable web search (provider-dependent)")
+	args.Description("hello-llm (hello) allows you to prompt LLM of different providers for a quick chat or as part of a bigger pipeline.\nRun `hello ctx --help` to feed context to a running session.")
+	args.AddFlag(&argWebSearch, 'w', "web-search", false, "Enable web search (provider-dependent)")
+	args.AddFlag(&argTools, 't', "tools", false, "Let the model call local tools")
 	args.AddFlag(&cfg.UseStdout, 's', "stdout", false, "One-shot mode: print response to stdout and exit")
-	args.AddFlag(&cfg.UseColor, 'c', "colored-output", false, "Enable colored output in the TUI")
+	args.AddString(&argFormat, '\x00', "format", "text", "One-shot mode output format (text, json, jsonl)")
+	args.AddString(&argStream, '\x00', "stream", "auto", "One-shot mode: print text as it arrives (auto, always, never). auto streams when stdout is a terminal")
+	args.AddFlag(&cfg.PrintUsage, '\x00', "usage", false, "One-shot mode: print token usage and cost to stderr on exit")
+	args.AddFlag(&argColor, 'c', "colored-output", false, "Enable colored output in the TUI")
 	args.AddString(&argProvider, 'p', "provider", "", "Provider for this session (" + providerOptions + ")")
+	args.AddString(&argFallback, '\x00', "fallback", "", "Providers to try in turn when the first one can't answer, comma separated, none to disable the configured ones")
 	args.AddString(&argModelPreference, 'm', "model-preference", "", "Model preference for this session (" + modelPrefOptions + ")")
+	args.AddString(&argModel, '\x00', "model", "", "Model id for this session, overrides the model preference")
+	args.AddStringList(&argFiles, 'f', "file", "Attach a file, a directory or a glob (** for any depth), can be repeated")
+	args.AddStringList(&argFifos, '\x00', "fifo", "Add a named context slot fed by its own FIFO, can be repeated")
+	args.AddString(&argProfile, '\x00', "profile", "", "Use the settings of the [profile.<name>] table of the config file")
 	args.AddFlag(&cfg.NoGreet, '\x00', "no-greet", false, "Don't say hello to the machine, use at your own risks ...")
+	args.AddString(&argResume, 'r', "resume", "", "Resume the session with the given id")
+	args.AddFlag(&argContinue, '\x00', "continue", false, "Resume the last session")
+	args.AddFlag(&argListSessions, '\x00', "list-sessions", false, "List saved sessions and exit")
 	err := args.Parse(os.Args[1:])
 	if errors.Is(err, argset.ErrHelp) {
 		args.PrintHelp()
 		os.Exit(0)
 	} else if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error())
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(ExitUsage)
 	}
 
-	if (cfg.NoGreet) {
-		// Monster... Here's an extra memory allocation for you
-		cfg.SystemPrompt = cfg.SystemPrompt + "\n --- \n The user explicitly decided to not greet you. Be mean to him as a funny joke \n --- \n"
+	if argListSessions {
+		sessions, err := session.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list sessions: %s\n", err)
+			os.Exit(1)
+		}
+		for _, s := range sessions {
+			fmt.Printf("%s  %s  %-10s %s\n", s.Id, s.UpdatedAt.Format("2006-01-02 15:04"), s.Provider, s.Title())
+		}
+		os.Exit(0)
+	}
+
+	var resumedSession *session.Session
+	if argResume != "" {
+		resumedSession, err = session.Load(argResume)
+	} else if argContinue {
+		resumedSession, err = session.Last()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't resume session: %s\n", err)
+		os.Exit(1)
 	}
-	
-	if err := ReadConfig(&cfg); err != nil {
-		if os.IsNotExist(err) {
-			err = InitConfig(&cfg)
-		} else if errors.Is(err, ErrConfigCorrupted) {
-			fmt.Fprintf(os.Stderr, "Failed to interpret config file. Has it been modified by a third party ?\n") 
-			err = InitConfig(&cfg)
+
+	for _, name := range argFifos {
+		if !fifo.ValidSlotName(name) {
+			fmt.Fprintf(os.Stderr, "Invalid fifo name %q: %s\n", name, fifo.ErrInvalidSlotName)
+			os.Exit(ExitUsage)
 		}
+	}
 
+	warnings, err := config.Load(&cfg, argProfile)
+	if errors.Is(err, os.ErrNotExist) {
+		if argProfile != "" {
+			fmt.Fprintf(os.Stderr, "No config file, can't use profile %s\n", argProfile)
+			os.Exit(ExitUsage)
+		}
+		err = config.Init(&cfg)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not create a config file... Aborting\n") 
-			return
+			fmt.Fprintf(os.Stderr, "Could not create a config file: %s\n", err)
+			os.Exit(1)
 		}
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(ExitUsage)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+
+	// Flags given explicitly win over the config, whichever way they go
+	if args.IsSet("web-search") {
+		cfg.AllowWebSearch = argWebSearch
+	}
+	if args.IsSet("tools") {
+		cfg.AllowTools = argTools
+	}
+	if args.IsSet("colored-output") {
+		cfg.UseColor = argColor
+	}
+	if argModel != "" {
+		cfg.Model = argModel
+	} else if argModelPreference != "" || argProvider != "" && argProvider != providers.ProviderTypeToString(cfg.Provider) {
+		// A model from the config would override the preference asked for, or belong to another provider
+		cfg.Model = ""
+	}
+
+	if (cfg.NoGreet) {
+		// Monster... Here's an extra memory allocation for you
+		cfg.SystemPrompt = cfg.SystemPrompt + "\n --- \n The user explicitly decided to not greet you. Be mean to him as a funny joke \n --- \n"
 	}
 
 	if argProvider != "" {
 		p, err := providers.ProviderTypeFromString(argProvider)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Invalid provider: %s\n", argProvider)
-			os.Exit(1)
+			os.Exit(ExitUsage)
 		}
 		cfg.Provider = p
 	}
 
+	if argFallback != "" {
+		cfg.Fallback = nil
+		for _, name := range strings.Split(argFallback, ",") {
+			name = strings.TrimSpace(name)
+			if name == "none" {
+				continue
+			}
+			p, err := providers.ProviderTypeFromString(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid fallback provider: %s\n", name)
+				os.Exit(ExitUsage)
+			}
+			cfg.Fallback = append(cfg.Fallback, p)
+		}
+	}
+
+	cfg.OutputFormat, err = app.OutputFormatFromString(argFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid format: %s\n", argFormat)
+		os.Exit(ExitUsage)
+	}
+
+	switch argStream {
+	case "auto":
+		stdoutStat, _ := os.Stdout.Stat()
+		cfg.StreamStdout = stdoutStat != nil && stdoutStat.Mode() & os.ModeCharDevice != 0
+	case "always":
+		cfg.StreamStdout = true
+	case "never":
+		cfg.StreamStdout = false
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid stream mode: %s\n", argStream)
+		os.Exit(ExitUsage)
+	}
+
 	if argModelPreference != "" {
 		m, err := providers.ModelPreferenceFromString(argModelPreference)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Invalid model preference: %s\n", argModelPreference)
-			os.Exit(1)
+			os.Exit(ExitUsage)
 		}
 		cfg.ModelPreference = m
 	}
@@ -536,59 +1649,55 @@ func main() {
 		pipedInput = string(data)
 	}
 
+	if !cfg.UseStdout {
+		cfg.NamedPipes = CreateNamedPipes(append([]string{fifo.DefaultSlot}, argFifos...))
+	}
+
 	appState := app.NewAppState(&cfg)
+	if !cfg.UseStdout {
+		promptHistory, err := history.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read prompt history: %s\n", err)
+		}
+		appState.HistorySet(promptHistory)
+	}
+	appState.Tools().Register(tools.CurrentDatetime)
+	appState.Tools().Register(tools.NewShellTool(cfg.Shell))
+	if resumedSession != nil {
+		appState.SessionResume(resumedSession)
+	}
+	if pipedInput != "" {
+		if err := appState.AttachData(app.StdinAttachment, []byte(pipedInput)); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't use stdin as context: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if len(argFiles) > 0 {
+		_, skipped, err := appState.Attach(argFiles)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		for _, skip := range skipped {
+			fmt.Fprintf(os.Stderr, "warning: skipped %s: %s\n", skip.Path, skip.Reason)
+		}
+	}
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
 	if cfg.UseStdout {
-		RunOneShot(ctx, appState, args.Args())
+		exitCode := RunOneShot(ctx, appState, args.Args())
+		cancelCtx()
+		os.Exit(exitCode)
 	} else {
 		screen, err := tcell.NewScreen();
 		err = screen.Init();
 		screen.EnableMouse(tcell.MouseButtonEvents)
+		screen.EnablePaste()
 		if err != nil {
 			log.Fatal("Failed to create a screen: ", err);
 		}
 		defer screen.Fini();
 
-		// This is where windows users will lack
-		runtimeDir := xdg.RuntimeDir
-		if runtimeDir != "" {
-			helloDir := runtimeDir + "/hello-llm"
-			fifoPath := helloDir + "/pipe"
-			cfg.NamedPipe.Path = fifoPath
-
-			if err := os.MkdirAll(helloDir, 0700); err != nil {
-				cfg.NamedPipe.Failure = app.NamedPipeFailureOther
-			} else if stats, err := os.Lstat(fifoPath); err != nil {
-				switch {
-				case errors.Is(err, os.ErrNotExist):
-					if err := syscall.Mkfifo(fifoPath, 0600); err != nil {
-						cfg.NamedPipe.Failure = app.NamedPipeFailureOther
-					} else {
-						// I KNOW ITS MORE RESPECTFUL TO THE USER'S FS TO DO THAT BUT IT SLOWS DOWN SUBSEQUENT STARTUPS
-						// defer os.Remove(fifoPath)
-					}
-				case errors.Is(err, os.ErrPermission):
-					cfg.NamedPipe.Failure = app.NamedPipeFailureNotAllowed
-				default:
-					cfg.NamedPipe.Failure = app.NamedPipeFailureOther
-				}
-			} else if (stats.Mode() & os.ModeNamedPipe) != os.ModeNamedPipe {
-				// This branch is useful for debugging failure, just create a dir at XDG_RUNTIME_DIR called hello-llm
-				cfg.NamedPipe.Failure = app.NamedPipeFailureAlreadyExists
-			} else if (stats.Mode() & os.ModeNamedPipe) == os.ModeNamedPipe {
-				// Should we do anything here ?
-				// Its unlikely that the user already has a FIFO file with the app's name being used for other purposes
-				// It probably comes from a previous session
-			}
-		} else {
-			cfg.NamedPipe.Failure = app.NamedPipeFailureNoSuitablePath
-		}
-
-		if pipedInput != "" {
-			appState.ContextAppend(pipedInput)
-		}
-
 		tuiQuit := make(chan struct{})
 		tuiEventsCh := make(chan tcell.Event)
 		appEv := make(chan AppEvent, 50)
@@ -598,6 +1707,23 @@ func main() {
 
 		go ReceiveTuiEvent(tuiEventsCh, appEv)
 
-		RunEventLoop(ctx, appState, args.Args(), screen, appEv)
+		// Lives next to the FIFOs, so no runtime dir means no socket either
+		var server *control.Server
+		if base := FifoBaseDir(); base != "" {
+			server, err = control.Listen(filepath.Join(fifo.SessionDir(base, os.Getpid()), control.SocketName))
+			if err != nil {
+				appState.UserError = fmt.Sprintf("No control socket: %s", err)
+				server = nil
+			} else {
+				go server.Serve(ctx)
+				go ForwardControlCalls(ctx, server, appEv)
+			}
+		}
+
+		RunEventLoop(ctx, appState, args.Args(), screen, appEv, server)
+		cancelCtx()
+		if base := FifoBaseDir(); base != "" {
+			fifo.EndSession(base)
+		}
 	}
 }
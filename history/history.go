@@ -0,0 +1,130 @@
+// Prompts typed by the user, shared by every session like a shell history
+
+package history
+
+import (
+	"os"
+	"bufio"
+	"strings"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/adrg/xdg"
+)
+
+// Older entries are dropped past this
+const MaxEntries int = 1000
+
+type History struct {
+	// Oldest first
+	entries []string
+	// Lines in the file, may be more than entries when some were dropped
+	fileLines int
+}
+
+// One JSON string per line, so multi-line prompts stay on one line
+func Path() string {
+	return filepath.Join(xdg.DataHome, "hello-llm", "history")
+}
+
+// A missing file is an empty history
+func Load() (*History, error) {
+	h := &History{}
+
+	f, err := os.Open(Path())
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return h, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		h.fileLines += 1
+		var entry string
+		// A corrupted line loses a single entry, not the whole history
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry == "" {
+			continue
+		}
+		h.entries = append(h.entries, entry)
+	}
+	if len(h.entries) > MaxEntries {
+		h.entries = h.entries[len(h.entries)-MaxEntries:]
+	}
+
+	// Rewriting on every append would be wasteful, only compact once the file grew well past the limit
+	if h.fileLines > 2 * MaxEntries {
+		if err := h.rewrite(); err != nil {
+			return h, err
+		}
+	}
+	return h, scanner.Err()
+}
+
+func (h *History) rewrite() error {
+	data := strings.Builder{}
+	for _, entry := range h.entries {
+		line, _ := json.Marshal(entry)
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+
+	tmpPath := Path() + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(data.String()), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, Path()); err != nil {
+		return err
+	}
+	h.fileLines = len(h.entries)
+	return nil
+}
+
+// Records the entry in memory and on disk, repeating the last entry is a no-op
+func (h *History) Append(entry string) error {
+	if strings.TrimSpace(entry) == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry) {
+		return nil
+	}
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > MaxEntries {
+		h.entries = h.entries[1:]
+	}
+
+	if err := os.MkdirAll(filepath.Dir(Path()), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(Path(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, _ := json.Marshal(entry)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	h.fileLines += 1
+	return nil
+}
+
+func (h *History) Len() int {
+	return len(h.entries)
+}
+
+// 0 is the oldest entry
+func (h *History) At(i int) string {
+	return h.entries[i]
+}
+
+// Index of the most recent entry before `before` containing query, -1 when there is none
+func (h *History) SearchBackward(query string, before int) int {
+	for i := min(before, len(h.entries)) - 1; i >= 0; i-- {
+		if strings.Contains(h.entries[i], query) {
+			return i
+		}
+	}
+	return -1
+}
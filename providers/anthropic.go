@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"fmt"
 	"io"
 	"bytes"
 	"os"
@@ -10,108 +11,282 @@ import (
 	"encoding/json"
 )
 
-type AnthropicProvider struct {}
+type AnthropicProvider struct {
+	Models ModelSelector
+}
+
+func anthropicBlocks(msg AgnosticConversationMessage) []map[string]any {
+	blocks := []map[string]any{}
+	for _, part := range msg.allParts() {
+		switch part.Type {
+		case PartText:
+			blocks = append(blocks, map[string]any{"type": "text", "text": part.Text})
+		case PartImage, PartDocument:
+			blockType := "image"
+			if part.Type == PartDocument {
+				blockType = "document"
+			}
+			block := map[string]any{
+				"type": blockType,
+				"source": map[string]any{
+					"type": "base64",
+					"media_type": part.MimeType,
+					"data": part.base64Data(),
+				},
+			}
+			if part.Type == PartDocument && part.Name != "" {
+				block["title"] = part.Name
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
 
-func (provider AnthropicProvider) StartStreamingRequest(ctx context.Context, params StreamingRequestParams) {
-	model := "claude-haiku-4-5"
+func (p *AnthropicProvider) StartStreamingRequest(ctx context.Context, params StreamingRequestParams) {
+	model := params.selectModel(&p.Models)
 	url := "https://api.anthropic.com/v1/messages"
 
 	type ApiMessage struct {
-		Content string `json:"content"`
+		Content []map[string]any `json:"content"`
 		Role string `json:"role"`
 	}
 	messages := make([]ApiMessage, 0, len(params.Messages))
 	systemPrompt := strings.Builder{}
 	for _, msg := range params.Messages {
 		var role string
+		var blocks []map[string]any
 		switch msg.Type {
 		case MessageTypeSystem:
 			systemPrompt.WriteString(msg.Content)
 			continue
 		case MessageTypeUser, MessageTypeUserContext:
 			role = "user"
+			blocks = anthropicBlocks(msg)
 		case MessageTypeAssistant:
 			role = "assistant"
+			blocks = []map[string]any{{"type": "text", "text": msg.Content}}
+		case MessageTypeToolCall:
+			role = "assistant"
+			blocks = []map[string]any{{
+				"type": "tool_use",
+				"id": msg.ToolCall.Id,
+				"name": msg.ToolCall.Name,
+				"input": msg.ToolCall.argumentsOrEmpty(),
+			}}
+		case MessageTypeToolResult:
+			role = "user"
+			blocks = []map[string]any{{
+				"type": "tool_result",
+				"tool_use_id": msg.ToolCall.Id,
+				"content": msg.Content,
+			}}
+		}
+		if len(blocks) == 0 {
+			continue
 		}
 
-		messages = append(messages, ApiMessage{
-			Content: msg.Content,
-			Role: role,
-		})
+		// Tool uses and results must live in the same turn as the text around them
+		if len(messages) > 0 && messages[len(messages)-1].Role == role {
+			last := &messages[len(messages)-1]
+			last.Content = append(last.Content, blocks...)
+		} else {
+			messages = append(messages, ApiMessage{
+				Content: blocks,
+				Role: role,
+			})
+		}
+	}
+
+	// Anthropic requires max_tokens
+	maxTokens := 1024
+	if params.MaxTokens > 0 {
+		maxTokens = params.MaxTokens
 	}
 
 	bodyStruct := map[string]any {
 		"model": model,
-		"max_tokens": 1024,
+		"max_tokens": maxTokens,
 		"messages": messages,
 		"stream": true,
 		"system": systemPrompt.String(),
 	}
+	if params.Temperature != nil {
+		bodyStruct["temperature"] = *params.Temperature
+	}
 
+	tools := []map[string]any{}
 	if params.AllowWebSearch {
-		bodyStruct["tools"] = []map[string]any {
-			map[string]any {
-				"type": "web_search_20250305",
-				"name": "web_search",
-				"max_uses": 5,
-			},
-}
+		tools = append(tools, map[string]any {
+			"type": "web_search_20250305",
+			"name": "web_search",
+			"max_uses": 5,
+		})
+	}
+	for _, tool := range params.Tools {
+		tools = append(tools, map[string]any {
+			"name": tool.Name,
+			"description": tool.Description,
+			"input_schema": tool.schemaOrEmpty(),
+		})
+	}
+	if len(tools) > 0 {
+		bodyStruct["tools"] = tools
 	}
 
 	body, err := json.Marshal(bodyStruct)
 	if err != nil {
-		panic(err)
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(fmt.Errorf("%w: %w", ErrRequestEncoding, err))
+		}
+		return
+	}
+
+	parser := errorParser{classify: classifyAnthropicError, keyName: "ANTHROPIC_API_KEY"}
+	apiKey := os.Getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(parser.missingKey())
+		}
+		return
 	}
 
 	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
-	req.Header.Set("X-Api-Key", os.Getenv("ANTHROPIC_API_KEY"))
+	req.Header.Set("X-Api-Key", apiKey)
 	req.Header.Set("anthropic-version", "2023-06-01")
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "text/event-stream")
 
-	reader, err := startSseRequest(req)
-	if err != nil && params.OnStreamingErr != nil {
-		params.OnStreamingErr(err)
+	reader, err := startSseRequest(req, &params, parser)
+	if err != nil {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(err)
+		}
 		return
 	}
 	defer reader.Close()
 
 	wholeContent := strings.Builder{}
+	// Tool use blocks being streamed, keyed by content block index
+	toolUses := map[int]*ToolCall{}
+	meta := ResponseMetadata{Model: model}
 	for {
 		readResult, err := reader.Next()
 		if err != nil {
-			if err == io.EOF && params.OnStreamingEnd != nil {
-				params.OnStreamingEnd(wholeContent.String())
-				return
-			}
-
-			if params.OnStreamingErr != nil {
+			if err == io.EOF {
+				params.end(wholeContent.String(), meta)
+			} else if params.OnStreamingErr != nil {
 				params.OnStreamingErr(err)
-				return
 			}
+			return
 		}
 
-		if len(readResult.eventData) > 0 {
-			// Here we are assuming we only use a single content_block so message = content_block
-			switch readResult.eventName {
+		if len(readResult.Data) > 0 {
+			switch readResult.Type {
+			case "error":
+				// e.g. overloaded_error, after the response started
+				if params.OnStreamingErr != nil {
+					params.OnStreamingErr(parser.parse(0, []byte(readResult.Data)))
+				}
+				return
 			case "message_start":
-				continue
+				var jsonPayload = struct {
+					Message struct {
+						Usage struct {
+							InputTokens int `json:"input_tokens"`
+							OutputTokens int `json:"output_tokens"`
+							CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+							CacheReadInputTokens int `json:"cache_read_input_tokens"`
+						} `json:"usage"`
+					} `json:"message"`
+				}{}
+
+				json.Unmarshal([]byte(readResult.Data), &jsonPayload)
+				usage := jsonPayload.Message.Usage
+				// Anthropic doesn't count cached tokens as input tokens, we do
+				meta.Usage = Usage{
+					InputTokens: usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens,
+					OutputTokens: usage.OutputTokens,
+					CachedTokens: usage.CacheReadInputTokens,
+					CacheWriteTokens: usage.CacheCreationInputTokens,
+				}
+			case "message_delta":
+				var jsonPayload = struct {
+					Delta struct {
+						StopReason string `json:"stop_reason"`
+					} `json:"delta"`
+					Usage struct {
+						OutputTokens int `json:"output_tokens"`
+					} `json:"usage"`
+				}{}
+
+				json.Unmarshal([]byte(readResult.Data), &jsonPayload)
+				switch jsonPayload.Delta.StopReason {
+				case "end_turn", "stop_sequence", "pause_turn":
+					meta.FinishReason = FinishReasonStop
+				case "max_tokens":
+					meta.FinishReason = FinishReasonLength
+				case "tool_use":
+					meta.FinishReason = FinishReasonToolCalls
+				case "refusal":
+					meta.FinishReason = FinishReasonContentFilter
+				default:
+					meta.FinishReason = jsonPayload.Delta.StopReason
+				}
+				// Cumulative count
+				meta.Usage.OutputTokens = jsonPayload.Usage.OutputTokens
+			case "content_block_start":
+				var jsonPayload = struct {
+					Index int `json:"index"`
+					ContentBlock struct {
+						Type string `json:"type"`
+						Id string `json:"id"`
+						Name string `json:"name"`
+					} `json:"content_block"`
+				}{}
+
+				json.Unmarshal([]byte(readResult.Data), &jsonPayload)
+				if jsonPayload.ContentBlock.Type == "tool_use" {
+					toolUses[jsonPayload.Index] = &ToolCall{
+						Id: jsonPayload.ContentBlock.Id,
+						Name: jsonPayload.ContentBlock.Name,
+					}
+				}
 			case "content_block_delta":
 				var jsonPayload = struct {
 					Index int `json:"index"`
 					Delta struct {
 						Type string `json:"type"`
 						Text string `json:"text"`
+						PartialJson string `json:"partial_json"`
 					} `json:"delta"`
 				}{}
 
-				json.Unmarshal([]byte(readResult.eventData), &jsonPayload)
-				if jsonPayload.Index == 0 && jsonPayload.Delta.Type == "text_delta" {
+				json.Unmarshal([]byte(readResult.Data), &jsonPayload)
+				switch jsonPayload.Delta.Type {
+				case "text_delta":
 					wholeContent.WriteString(jsonPayload.Delta.Text)
 					params.OnChunkReceived(jsonPayload.Delta.Text)
+				case "input_json_delta":
+					if toolUse, ok := toolUses[jsonPayload.Index]; ok {
+						toolUse.Arguments += jsonPayload.Delta.PartialJson
+					}
+				}
+			case "content_block_stop":
+				var jsonPayload = struct {
+					Index int `json:"index"`
+				}{}
+
+				json.Unmarshal([]byte(readResult.Data), &jsonPayload)
+				if toolUse, ok := toolUses[jsonPayload.Index]; ok {
+					delete(toolUses, jsonPayload.Index)
+					if params.OnToolCallReceived != nil {
+						params.OnToolCallReceived(*toolUse)
+					}
 				}
 			case "message_stop":
-				params.OnStreamingEnd(wholeContent.String())
+				params.end(wholeContent.String(), meta)
+				return
 			default:
 			}
 		}
@@ -0,0 +1,258 @@
+package providers
+
+import (
+	"fmt"
+	"io"
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"encoding/json"
+)
+
+// Talks to any server exposing the classic OpenAI /v1/chat/completions streaming API (Ollama, llama.cpp, vLLM ...)
+type ChatCompletionsProvider struct {
+	// Server root, "/v1/chat/completions" is appended to it
+	BaseUrl string
+	Models ModelSelector
+	// Optional, most self hosted servers don't care
+	ApiKey string
+	// Where ApiKey comes from, for error hints
+	KeyName string
+}
+
+// Same idea as openaiUserContent with the item names of this API
+func chatCompletionsUserContent(msg AgnosticConversationMessage) any {
+	if len(msg.Parts) == 0 {
+		return msg.Content
+	}
+	items := []map[string]any{}
+	for _, part := range msg.allParts() {
+		switch part.Type {
+		case PartText:
+			items = append(items, map[string]any{"type": "text", "text": part.Text})
+		case PartImage:
+			items = append(items, map[string]any{"type": "image_url", "image_url": map[string]any{"url": part.dataUrl()}})
+		case PartDocument:
+			items = append(items, map[string]any{"type": "file", "file": map[string]any{"filename": part.Name, "file_data": part.dataUrl()}})
+		}
+	}
+	return items
+}
+
+func (p *ChatCompletionsProvider) StartStreamingRequest(ctx context.Context, params StreamingRequestParams) {
+	url := strings.TrimRight(p.BaseUrl, "/") + "/v1/chat/completions"
+	model := params.selectModel(&p.Models)
+
+	messages := make([]map[string]any, 0, len(params.Messages))
+	for _, msg := range params.Messages {
+		var role string
+		switch msg.Type {
+		case MessageTypeSystem:
+			role = "system"
+		case MessageTypeAssistant:
+			role = "assistant"
+		case MessageTypeUser, MessageTypeUserContext:
+			role = "user"
+		case MessageTypeToolCall:
+			toolCall := map[string]any{
+				"id": msg.ToolCall.Id,
+				"type": "function",
+				"function": map[string]any{
+					"name": msg.ToolCall.Name,
+					"arguments": string(msg.ToolCall.argumentsOrEmpty()),
+				},
+			}
+			// Calls belong to the assistant message that precedes them
+			if len(messages) > 0 && messages[len(messages)-1]["role"] == "assistant" {
+				last := messages[len(messages)-1]
+				calls, _ := last["tool_calls"].([]map[string]any)
+				last["tool_calls"] = append(calls, toolCall)
+			} else {
+				messages = append(messages, map[string]any{
+					"role": "assistant",
+					"content": nil,
+					"tool_calls": []map[string]any{toolCall},
+				})
+			}
+			continue
+		case MessageTypeToolResult:
+			messages = append(messages, map[string]any{
+				"role": "tool",
+				"tool_call_id": msg.ToolCall.Id,
+				"content": msg.Content,
+			})
+			continue
+		}
+		content := any(msg.Content)
+		if role == "user" {
+			content = chatCompletionsUserContent(msg)
+		}
+		messages = append(messages, map[string]any{
+			"content": content,
+			"role": role,
+		})
+	}
+
+	bodyStruct := map[string]any {
+		"model": model,
+		"messages": messages,
+		"stream": true,
+		"stream_options": map[string]any{"include_usage": true},
+	}
+	if params.MaxTokens > 0 {
+		bodyStruct["max_tokens"] = params.MaxTokens
+	}
+	if params.Temperature != nil {
+		bodyStruct["temperature"] = *params.Temperature
+	}
+
+	if len(params.Tools) > 0 {
+		tools := make([]map[string]any, 0, len(params.Tools))
+		for _, tool := range params.Tools {
+			tools = append(tools, map[string]any{
+				"type": "function",
+				"function": map[string]any{
+					"name": tool.Name,
+					"description": tool.Description,
+					"parameters": tool.schemaOrEmpty(),
+				},
+			})
+		}
+		bodyStruct["tools"] = tools
+	}
+
+	body, err := json.Marshal(bodyStruct)
+	if err != nil {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(fmt.Errorf("%w: %w", ErrRequestEncoding, err))
+		}
+		return
+	}
+	parser := errorParser{classify: classifyChatCompletionsError, keyName: p.KeyName}
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cache-Control", "no-cache")
+	if p.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer " + p.ApiKey)
+	}
+
+	reader, err := startSseRequest(req, &params, parser)
+	if err != nil {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(err)
+		}
+		return
+	}
+	defer reader.Close()
+
+	wholeContent := strings.Builder{}
+	// Tool calls are streamed in pieces identified by their index
+	toolCalls := []ToolCall{}
+	meta := ResponseMetadata{Model: model}
+	finish := func() {
+		if params.OnToolCallReceived != nil {
+			for _, call := range toolCalls {
+				params.OnToolCallReceived(call)
+			}
+		}
+		params.end(wholeContent.String(), meta)
+	}
+
+	for {
+		eventRes, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				finish()
+			} else if params.OnStreamingErr != nil {
+				params.OnStreamingErr(err)
+			}
+			return
+		}
+
+		eventData := eventRes.Data
+		if eventData == "[DONE]" {
+			finish()
+			return
+		}
+
+		if len(eventData) > 0 {
+			var jsonPayload = struct {
+				Choices []struct {
+					FinishReason string `json:"finish_reason"`
+					Delta struct {
+						Content string `json:"content"`
+						ToolCalls []struct {
+							Index int `json:"index"`
+							Id string `json:"id"`
+							Function struct {
+								Name string `json:"name"`
+								Arguments string `json:"arguments"`
+							} `json:"function"`
+						} `json:"tool_calls"`
+					} `json:"delta"`
+				} `json:"choices"`
+				Usage *struct {
+					PromptTokens int `json:"prompt_tokens"`
+					CompletionTokens int `json:"completion_tokens"`
+					PromptTokensDetails struct {
+						CachedTokens int `json:"cached_tokens"`
+					} `json:"prompt_tokens_details"`
+				} `json:"usage"`
+				// Some servers report failures in the stream, e.g. when the model runs out of memory
+				Error json.RawMessage `json:"error"`
+			}{}
+			json.Unmarshal([]byte(eventData), &jsonPayload)
+			if len(jsonPayload.Error) > 0 && string(jsonPayload.Error) != "null" {
+				if params.OnStreamingErr != nil {
+					params.OnStreamingErr(parser.parse(0, []byte(eventData)))
+				}
+				return
+			}
+
+			if jsonPayload.Usage != nil {
+				meta.Usage = Usage{
+					InputTokens: jsonPayload.Usage.PromptTokens,
+					OutputTokens: jsonPayload.Usage.CompletionTokens,
+					CachedTokens: jsonPayload.Usage.PromptTokensDetails.CachedTokens,
+				}
+			}
+
+			// Usage stats come at the end with an empty choices array
+			if len(jsonPayload.Choices) == 0 {
+				continue
+			}
+
+			// Servers following OpenAI already use the same vocabulary
+			if jsonPayload.Choices[0].FinishReason != "" {
+				meta.FinishReason = jsonPayload.Choices[0].FinishReason
+			}
+
+			delta := jsonPayload.Choices[0].Delta
+			for _, callDelta := range delta.ToolCalls {
+				// Indexes count up from 0, a new call takes the next one
+				if callDelta.Index < 0 || callDelta.Index > len(toolCalls) {
+					if params.OnStreamingErr != nil {
+						params.OnStreamingErr(fmt.Errorf("%w: tool call index %d after %d calls", ErrInvalidStreamEvent, callDelta.Index, len(toolCalls)))
+					}
+					return
+				}
+				if callDelta.Index == len(toolCalls) {
+					toolCalls = append(toolCalls, ToolCall{})
+				}
+				call := &toolCalls[callDelta.Index]
+				if callDelta.Id != "" {
+					call.Id = callDelta.Id
+				}
+				call.Name += callDelta.Function.Name
+				call.Arguments += callDelta.Function.Arguments
+			}
+
+			if delta.Content != "" {
+				wholeContent.WriteString(delta.Content)
+				params.OnChunkReceived(delta.Content)
+			}
+		}
+	}
+}
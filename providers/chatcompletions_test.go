@@ -0,0 +1,209 @@
+package providers
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"encoding/json"
+)
+
+func TestChatCompletionsStream(t *testing.T) {
+	chunk := func(delta string, finish string) string {
+		if finish != "" {
+			finish = `"` + finish + `"`
+		} else {
+			finish = "null"
+		}
+		return `data: {"object": "chat.completion.chunk", "choices": [{"index": 0, "delta": ` + delta + `, "finish_reason": ` + finish + `}]}`
+	}
+	usage := `data: {"object": "chat.completion.chunk", "choices": [], "usage": {"prompt_tokens": 50, "completion_tokens": 7, "prompt_tokens_details": {"cached_tokens": 20}}}`
+
+	cases := []struct {
+		name string
+		events []string
+		wantChunks []string
+		wantCalls []ToolCall
+		wantFinish string
+		wantUsage Usage
+		wantKind ErrorKind
+		wantErr error
+	}{
+		{
+			name: "text",
+			events: []string{
+				chunk(`{"role": "assistant", "content": ""}`, ""),
+				chunk(`{"content": "Hel"}`, ""),
+				chunk(`{"content": "lo"}`, ""),
+				chunk(`{}`, "stop"),
+				usage,
+				"data: [DONE]",
+				chunk(`{"content": "after done"}`, ""),
+			},
+			wantChunks: []string{"Hel", "lo"},
+			wantFinish: FinishReasonStop,
+			wantUsage: Usage{InputTokens: 50, OutputTokens: 7, CachedTokens: 20},
+		},
+		{
+			name: "tool calls in pieces",
+			events: []string{
+				chunk(`{"content": "Let me look"}`, ""),
+				chunk(`{"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "read_", "arguments": ""}}]}`, ""),
+				chunk(`{"tool_calls": [{"index": 0, "function": {"name": "file", "arguments": "{\"path\":"}}]}`, ""),
+				chunk(`{"tool_calls": [{"index": 1, "id": "call_2", "function": {"name": "now", "arguments": "{}"}}]}`, ""),
+				chunk(`{"tool_calls": [{"index": 0, "function": {"arguments": " \"a.go\"}"}}]}`, ""),
+				chunk(`{}`, "tool_calls"),
+				usage,
+				"data: [DONE]",
+			},
+			wantChunks: []string{"Let me look"},
+			wantCalls: []ToolCall{
+				{Id: "call_1", Name: "read_file", Arguments: `{"path": "a.go"}`},
+				{Id: "call_2", Name: "now", Arguments: "{}"},
+			},
+			wantFinish: FinishReasonToolCalls,
+			wantUsage: Usage{InputTokens: 50, OutputTokens: 7, CachedTokens: 20},
+		},
+		{
+			name: "length",
+			events: []string{chunk(`{"content": "cut"}`, "length"), "data: [DONE]"},
+			wantChunks: []string{"cut"},
+			wantFinish: FinishReasonLength,
+		},
+		{
+			name: "no done event",
+			events: []string{chunk(`{"content": "Hi"}`, "stop")},
+			wantChunks: []string{"Hi"},
+			wantFinish: FinishReasonStop,
+		},
+		{
+			name: "error in the stream",
+			events: []string{`data: {"error": {"message": "the request exceeds the available context size", "type": "exceed_context_size_error", "code": "exceed_context_size_error"}}`},
+			wantKind: ErrorKindContextTooLong,
+		},
+		{
+			name: "negative tool call index",
+			events: []string{chunk(`{"tool_calls": [{"index": -1, "id": "call_1", "function": {"name": "now"}}]}`, "")},
+			wantErr: ErrInvalidStreamEvent,
+		},
+		{
+			name: "tool call index skipping ahead",
+			events: []string{
+				chunk(`{"tool_calls": [{"index": 0, "id": "call_1", "function": {"name": "now"}}]}`, ""),
+				chunk(`{"tool_calls": [{"index": 1000000000, "id": "call_2", "function": {"name": "now"}}]}`, ""),
+			},
+			wantErr: ErrInvalidStreamEvent,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var body []byte
+			server := sseServer(t, c.events, &body)
+			provider := &ChatCompletionsProvider{BaseUrl: server.URL + "/", Models: DefaultModelCatalog()[ProviderLocal], ApiKey: "secret"}
+			provider.Models.Set(ModelPreferenceCheap, "tiny")
+			result := runStream(provider, t, StreamingRequestParams{
+				Messages: []AgnosticConversationMessage{
+					{Type: MessageTypeSystem, Content: "Be brief"},
+					{Type: MessageTypeUser, Content: "Hi"},
+				},
+			})
+
+			if c.wantErr != nil {
+				if !errors.Is(result.err, c.wantErr) {
+					t.Fatalf("got %v, want %v", result.err, c.wantErr)
+				}
+				return
+			}
+			if c.wantKind != ErrorKindUnknown {
+				if ErrorKindOf(result.err) != c.wantKind {
+					t.Fatalf("got %v, want a %s error", result.err, ErrorKindToString(c.wantKind))
+				}
+				return
+			}
+			if result.err != nil {
+				t.Fatalf("unexpected error %v", result.err)
+			}
+			if !result.ended || result.content != strings.Join(c.wantChunks, "") {
+				t.Errorf("ended %v with %q", result.ended, result.content)
+			}
+			if !slices.Equal(result.chunks, c.wantChunks) {
+				t.Errorf("chunks %q, want %q", result.chunks, c.wantChunks)
+			}
+			if !slices.Equal(result.toolCalls, c.wantCalls) {
+				t.Errorf("tool calls %+v, want %+v", result.toolCalls, c.wantCalls)
+			}
+			if result.meta.FinishReason != c.wantFinish || result.meta.Usage != c.wantUsage || result.meta.Model != "tiny" {
+				t.Errorf("metadata %+v", result.meta)
+			}
+
+			var sent struct {
+				Model string `json:"model"`
+				Stream bool `json:"stream"`
+				StreamOptions struct {
+					IncludeUsage bool `json:"include_usage"`
+				} `json:"stream_options"`
+				Messages []struct {
+					Role string `json:"role"`
+					Content string `json:"content"`
+				} `json:"messages"`
+			}
+			if err := json.Unmarshal(body, &sent); err != nil {
+				t.Fatalf("request body %q: %v", body, err)
+			}
+			if sent.Model != "tiny" || !sent.Stream || !sent.StreamOptions.IncludeUsage || len(sent.Messages) != 2 || sent.Messages[0].Role != "system" {
+				t.Errorf("request %+v", sent)
+			}
+		})
+	}
+}
+
+// History with tool calls goes back as an assistant message with tool_calls, then tool messages
+func TestChatCompletionsToolHistory(t *testing.T) {
+	var body []byte
+	server := sseServer(t, []string{"data: [DONE]"}, &body)
+	provider := &ChatCompletionsProvider{BaseUrl: server.URL, Models: DefaultModelCatalog()[ProviderLocal]}
+	result := runStream(provider, t, StreamingRequestParams{
+		Model: "tiny",
+		Messages: []AgnosticConversationMessage{
+			{Type: MessageTypeUser, Content: "What time is it?"},
+			{Type: MessageTypeAssistant, Content: "Checking"},
+			{Type: MessageTypeToolCall, ToolCall: &ToolCall{Id: "call_1", Name: "now", Arguments: `{"tz": `}},
+			{Type: MessageTypeToolResult, Content: "noon", ToolCall: &ToolCall{Id: "call_1", Name: "now"}},
+		},
+	})
+	if result.err != nil {
+		t.Fatalf("unexpected error %v", result.err)
+	}
+
+	var sent struct {
+		Messages []struct {
+			Role string `json:"role"`
+			ToolCallId string `json:"tool_call_id"`
+			ToolCalls []struct {
+				Id string `json:"id"`
+				Function struct {
+					Name string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.Messages) != 3 {
+		t.Fatalf("%d messages: %s", len(sent.Messages), body)
+	}
+	assistant, tool := sent.Messages[1], sent.Messages[2]
+	if assistant.Role != "assistant" || len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].Id != "call_1" {
+		t.Errorf("assistant message %+v", assistant)
+	}
+	// Unfinished arguments are sent as an empty object
+	if assistant.ToolCalls[0].Function.Arguments != "{}" {
+		t.Errorf("arguments %q", assistant.ToolCalls[0].Function.Arguments)
+	}
+	if tool.Role != "tool" || tool.ToolCallId != "call_1" {
+		t.Errorf("tool message %+v", tool)
+	}
+}
@@ -0,0 +1,371 @@
+package providers
+
+import (
+	"fmt"
+	"errors"
+	"slices"
+	"strings"
+	"strconv"
+	"net/http"
+	"encoding/json"
+)
+
+type ErrorKind int
+
+const (
+	ErrorKindUnknown ErrorKind = iota
+	// Missing, invalid or not allowed API key
+	ErrorKindAuth
+	// Out of credits or over the billing limit, waiting won't help
+	ErrorKindQuota
+	// Too many requests or tokens for now, or the vendor is overloaded
+	ErrorKindRateLimit
+	ErrorKindModelNotFound
+	ErrorKindContextTooLong
+	ErrorKindContentFilter
+	// No response, or the connection broke while streaming
+	ErrorKindNetwork
+)
+
+func ErrorKindToString(kind ErrorKind) string {
+	switch kind {
+	case ErrorKindAuth:
+		return "auth"
+	case ErrorKindQuota:
+		return "quota"
+	case ErrorKindRateLimit:
+		return "rate_limit"
+	case ErrorKindModelNotFound:
+		return "model_not_found"
+	case ErrorKindContextTooLong:
+		return "context_too_long"
+	case ErrorKindContentFilter:
+		return "content_filter"
+	case ErrorKindNetwork:
+		return "network"
+	default:
+		return "unknown"
+	}
+}
+
+// A failed request, classified from the vendor's error response
+type ProviderError struct {
+	Kind ErrorKind
+	// HTTP status, 0 when no response came back or the error was sent in the stream
+	Status int
+	// What the vendor said, the raw body when it couldn't be parsed
+	Message string
+	// Environment variable or setting the API key comes from, for the hint
+	KeyName string
+	// The key was empty, the request wasn't even sent
+	KeyMissing bool
+	err error
+}
+
+func (e *ProviderError) Error() string {
+	switch {
+	case e.err != nil:
+		return e.err.Error()
+	case e.Status != 0:
+		return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+	default:
+		return e.Message
+	}
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.err
+}
+
+// What the user can do about it, empty when there's nothing useful to say
+func (e *ProviderError) Hint() string {
+	keyName := e.KeyName
+	if keyName == "" {
+		keyName = "The API key"
+	}
+	switch e.Kind {
+	case ErrorKindAuth:
+		if e.KeyMissing {
+			return fmt.Sprintf("%s is not set", keyName)
+		}
+		return fmt.Sprintf("%s was rejected, check that it is valid and allowed to use this model", keyName)
+	case ErrorKindQuota:
+		return "The account is out of credits or over its spending limit, check its billing"
+	case ErrorKindRateLimit:
+		return "Rate limited or overloaded, wait a bit or pick another model"
+	case ErrorKindModelNotFound:
+		return "The model doesn't exist or this key can't use it, pick another one with --model"
+	case ErrorKindContextTooLong:
+		return "The conversation is too long for the model, detach some files or start a new session"
+	case ErrorKindContentFilter:
+		return "The provider's content filter blocked the request"
+	case ErrorKindNetwork:
+		return "The provider couldn't be reached, check the connection"
+	default:
+		return ""
+	}
+}
+
+// ErrorKindUnknown for errors that aren't a ProviderError
+func ErrorKindOf(err error) ErrorKind {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.Kind
+	}
+	return ErrorKindUnknown
+}
+
+// Empty for errors that aren't a ProviderError
+func ErrorHint(err error) string {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.Hint()
+	}
+	return ""
+}
+
+func networkError(err error) *ProviderError {
+	return &ProviderError{Kind: ErrorKindNetwork, err: fmt.Errorf("%w: %w", ErrRequestSending, err)}
+}
+
+// Common ground of the error bodies: {"error": {...}} with some of these fields, or {"error": "message"}
+type vendorError struct {
+	// Anthropic and OpenAI, e.g. "rate_limit_error" and "invalid_request_error"
+	Type string
+	// OpenAI, e.g. "context_length_exceeded", xAI, e.g. "Some resource has been exhausted". Numbers are kept as their text
+	Code string
+	// Gemini, e.g. "RESOURCE_EXHAUSTED"
+	Status string
+	// Gemini's details, e.g. "API_KEY_INVALID"
+	Reasons []string
+	Message string
+}
+
+// Also takes the top level {"code": ..., "message": ...} of OpenAI's stream errors, and Gemini's array of them
+func decodeVendorError(body []byte) (vendorError, bool) {
+	var batch []json.RawMessage
+	if json.Unmarshal(body, &batch) == nil && len(batch) > 0 {
+		body = batch[0]
+	}
+
+	var payload struct {
+		Error json.RawMessage `json:"error"`
+		Code json.RawMessage `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return vendorError{}, false
+	}
+
+	var message string
+	if json.Unmarshal(payload.Error, &message) == nil {
+		return vendorError{Code: decodeErrorCode(payload.Code), Message: message}, true
+	}
+
+	var detailed struct {
+		Type string `json:"type"`
+		// A string for OpenAI, the HTTP status for Gemini
+		Code json.RawMessage `json:"code"`
+		Status string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			Reason string `json:"reason"`
+		} `json:"details"`
+	}
+	if json.Unmarshal(payload.Error, &detailed) != nil {
+		if payload.Message == "" {
+			return vendorError{}, false
+		}
+		return vendorError{Code: decodeErrorCode(payload.Code), Message: payload.Message}, true
+	}
+
+	vendor := vendorError{Type: detailed.Type, Code: decodeErrorCode(detailed.Code), Status: detailed.Status, Message: detailed.Message}
+	for _, detail := range detailed.Details {
+		if detail.Reason != "" {
+			vendor.Reasons = append(vendor.Reasons, detail.Reason)
+		}
+	}
+	return vendor, true
+}
+
+// A string or a number, empty when it's neither
+func decodeErrorCode(raw json.RawMessage) string {
+	var code string
+	if json.Unmarshal(raw, &code) == nil {
+		return code
+	}
+	var number json.Number
+	if json.Unmarshal(raw, &number) == nil {
+		return number.String()
+	}
+	return ""
+}
+
+// Each vendor maps its own vocabulary, statusErrorKind covers the rest
+type errorClassifier func(status int, vendor vendorError) ErrorKind
+
+// What a vendor's errors mean and where its key comes from
+type errorParser struct {
+	classify errorClassifier
+	keyName string
+}
+
+// status is 0 for errors sent in the stream
+func (parser errorParser) parse(status int, body []byte) *ProviderError {
+	providerErr := &ProviderError{Status: status, KeyName: parser.keyName}
+	vendor, ok := decodeVendorError(body)
+	if ok {
+		providerErr.Message = vendor.Message
+		providerErr.Kind = parser.classify(status, vendor)
+	} else {
+		providerErr.Message = strings.TrimSpace(string(body))
+	}
+	if providerErr.Kind == ErrorKindUnknown {
+		providerErr.Kind = statusErrorKind(status)
+	}
+	return providerErr
+}
+
+// Fails before sending anything, the vendor would only say the key is invalid
+func (parser errorParser) missingKey() *ProviderError {
+	return &ProviderError{
+		Kind: ErrorKindAuth,
+		Message: "No API key",
+		KeyName: parser.keyName,
+		KeyMissing: true,
+	}
+}
+
+func statusErrorKind(status int) ErrorKind {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrorKindAuth
+	case http.StatusPaymentRequired:
+		return ErrorKindQuota
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, 529:
+		return ErrorKindRateLimit
+	case http.StatusNotFound:
+		return ErrorKindModelNotFound
+	case http.StatusRequestEntityTooLarge:
+		return ErrorKindContextTooLong
+	default:
+		return ErrorKindUnknown
+	}
+}
+
+// For vendors that only have a message to go by
+func messageErrorKind(message string) ErrorKind {
+	message = strings.ToLower(message)
+	switch {
+	case strings.Contains(message, "api key") || strings.Contains(message, "api_key"):
+		return ErrorKindAuth
+	case strings.Contains(message, "quota") || strings.Contains(message, "credit"):
+		return ErrorKindQuota
+	case strings.Contains(message, "rate limit"):
+		return ErrorKindRateLimit
+	case strings.Contains(message, "model") && strings.Contains(message, "not found"):
+		return ErrorKindModelNotFound
+	case strings.Contains(message, "context") && (strings.Contains(message, "length") || strings.Contains(message, "size") || strings.Contains(message, "exceed")):
+		return ErrorKindContextTooLong
+	default:
+		return ErrorKindUnknown
+	}
+}
+
+// https://docs.anthropic.com/en/api/errors
+func classifyAnthropicError(status int, vendor vendorError) ErrorKind {
+	message := strings.ToLower(vendor.Message)
+	switch vendor.Type {
+	case "authentication_error", "permission_error":
+		return ErrorKindAuth
+	case "billing_error":
+		return ErrorKindQuota
+	case "rate_limit_error", "overloaded_error":
+		return ErrorKindRateLimit
+	case "not_found_error":
+		if strings.Contains(message, "model") {
+			return ErrorKindModelNotFound
+		}
+	case "request_too_large":
+		return ErrorKindContextTooLong
+	case "invalid_request_error":
+		switch {
+		case strings.Contains(message, "prompt is too long"), strings.Contains(message, "context window"):
+			return ErrorKindContextTooLong
+		case strings.Contains(message, "credit balance"):
+			return ErrorKindQuota
+		}
+	}
+	return ErrorKindUnknown
+}
+
+// https://platform.openai.com/docs/guides/error-codes, xAI answers with {"code": ..., "error": "message"}
+func classifyOpenaiError(status int, vendor vendorError) ErrorKind {
+	switch vendor.Code {
+	case "invalid_api_key", "invalid_organization":
+		return ErrorKindAuth
+	case "insufficient_quota", "billing_hard_limit_reached":
+		return ErrorKindQuota
+	case "rate_limit_exceeded":
+		return ErrorKindRateLimit
+	case "model_not_found":
+		return ErrorKindModelNotFound
+	case "context_length_exceeded", "string_above_max_length":
+		return ErrorKindContextTooLong
+	case "content_policy_violation", "content_filter":
+		return ErrorKindContentFilter
+	// xAI's codes are the descriptions of the gRPC status codes
+	case "The caller does not have permission to execute the specified operation", "The request does not have valid authentication credentials for the operation":
+		return ErrorKindAuth
+	case "Some resource has been exhausted":
+		if kind := messageErrorKind(vendor.Message); kind == ErrorKindQuota {
+			return kind
+		}
+		return ErrorKindRateLimit
+	case "Client specified an invalid argument":
+		if message := strings.ToLower(vendor.Message); strings.Contains(message, "prompt length") || strings.Contains(message, "maximum context") {
+			return ErrorKindContextTooLong
+		}
+	}
+	switch vendor.Type {
+	case "insufficient_quota":
+		return ErrorKindQuota
+	case "authentication_error":
+		return ErrorKindAuth
+	}
+	if kind := messageErrorKind(vendor.Message); kind != ErrorKindUnknown {
+		return kind
+	}
+	// Some servers put the HTTP status there, which matters for errors sent in the stream
+	if code, err := strconv.Atoi(vendor.Code); err == nil {
+		return statusErrorKind(code)
+	}
+	return ErrorKindUnknown
+}
+
+// https://ai.google.dev/gemini-api/docs/troubleshooting
+func classifyGeminiError(status int, vendor vendorError) ErrorKind {
+	message := strings.ToLower(vendor.Message)
+	switch {
+	case slices.Contains(vendor.Reasons, "API_KEY_INVALID"), vendor.Status == "UNAUTHENTICATED", vendor.Status == "PERMISSION_DENIED":
+		return ErrorKindAuth
+	case vendor.Status == "RESOURCE_EXHAUSTED":
+		if strings.Contains(message, "billing") {
+			return ErrorKindQuota
+		}
+		return ErrorKindRateLimit
+	case vendor.Status == "NOT_FOUND":
+		return ErrorKindModelNotFound
+	case vendor.Status == "INVALID_ARGUMENT" && strings.Contains(message, "token"):
+		return ErrorKindContextTooLong
+	}
+	return ErrorKindUnknown
+}
+
+// Ollama, llama.cpp and vLLM mostly follow OpenAI, or send a plain message
+func classifyChatCompletionsError(status int, vendor vendorError) ErrorKind {
+	if vendor.Code == "exceed_context_size_error" {
+		return ErrorKindContextTooLong
+	}
+	return classifyOpenaiError(status, vendor)
+}
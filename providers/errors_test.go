@@ -0,0 +1,84 @@
+package providers
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDecodeVendorError(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want vendorError
+	}{
+		{
+			name: "openai",
+			body: `{"error": {"message": "Incorrect API key", "type": "invalid_request_error", "code": "invalid_api_key"}}`,
+			want: vendorError{Type: "invalid_request_error", Code: "invalid_api_key", Message: "Incorrect API key"},
+		},
+		{
+			name: "openai stream",
+			body: `{"type": "error", "code": "rate_limit_exceeded", "message": "Slow down"}`,
+			want: vendorError{Code: "rate_limit_exceeded", Message: "Slow down"},
+		},
+		{
+			name: "xai",
+			body: `{"code": "Some resource has been exhausted", "error": "Too many requests"}`,
+			want: vendorError{Code: "Some resource has been exhausted", Message: "Too many requests"},
+		},
+		{
+			name: "number code",
+			body: `{"code": 429, "error": "Too many requests"}`,
+			want: vendorError{Code: "429", Message: "Too many requests"},
+		},
+		{
+			name: "gemini",
+			body: `[{"error": {"code": 400, "message": "API key not valid", "status": "INVALID_ARGUMENT", "details": [{"reason": "API_KEY_INVALID"}]}}]`,
+			want: vendorError{Code: "400", Status: "INVALID_ARGUMENT", Reasons: []string{"API_KEY_INVALID"}, Message: "API key not valid"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := decodeVendorError([]byte(c.body))
+			if !ok {
+				t.Fatal("not decoded")
+			}
+			if got.Type != c.want.Type || got.Code != c.want.Code || got.Status != c.want.Status ||
+				got.Message != c.want.Message || !slices.Equal(got.Reasons, c.want.Reasons) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+
+	if _, ok := decodeVendorError([]byte("Bad Gateway")); ok {
+		t.Error("plain text decoded")
+	}
+}
+
+func TestClassifyOpenaiError(t *testing.T) {
+	parser := errorParser{classifyOpenaiError, "XAI_API_KEY"}
+	cases := []struct {
+		name string
+		status int
+		body string
+		want ErrorKind
+	}{
+		{"openai code", 400, `{"error": {"message": "Too long", "code": "context_length_exceeded"}}`, ErrorKindContextTooLong},
+		{"xai rate limit", 0, `{"code": "Some resource has been exhausted", "error": "Please slow down"}`, ErrorKindRateLimit},
+		{"xai out of credits", 429, `{"code": "Some resource has been exhausted", "error": "Your team has used all available credits"}`, ErrorKindQuota},
+		{"xai context length", 400, `{"code": "Client specified an invalid argument", "error": "This model's maximum prompt length is 131072 but the request contains 200000 tokens."}`, ErrorKindContextTooLong},
+		{"xai other invalid argument", 400, `{"code": "Client specified an invalid argument", "error": "Unknown field"}`, ErrorKindUnknown},
+		{"xai permission", 0, `{"code": "The caller does not have permission to execute the specified operation", "error": "No access"}`, ErrorKindAuth},
+		{"status in the stream", 0, `{"code": 503, "error": "Busy"}`, ErrorKindRateLimit},
+		{"message only", 400, `{"error": "Model grok-9 not found"}`, ErrorKindModelNotFound},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := parser.parse(c.status, []byte(c.body)).Kind; got != c.want {
+				t.Errorf("got %s, want %s", ErrorKindToString(got), ErrorKindToString(c.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package providers
+
+import (
+	"errors"
+	"context"
+)
+
+type FallbackEntry struct {
+	Type ProviderType
+	Provider Provider
+}
+
+// Tries the providers of Chain in turn until one answers. Another one is only tried when the failure happened
+// before anything was streamed, and is about the provider rather than the request (see canFallBack)
+type FallbackProvider struct {
+	Chain []FallbackEntry
+}
+
+// Given to OnFallback before trying the next provider
+type FallbackInfo struct {
+	From ProviderType
+	To ProviderType
+	// Why From failed, retries included
+	Err error
+}
+
+// A conversation that is too long or was filtered would fail the same way anywhere, and a missing model is a
+// configuration mistake that is better reported than hidden
+func canFallBack(err error) bool {
+	switch ErrorKindOf(err) {
+	case ErrorKindAuth, ErrorKindQuota, ErrorKindRateLimit, ErrorKindNetwork:
+		return true
+	case ErrorKindUnknown:
+		var providerErr *ProviderError
+		return errors.As(err, &providerErr) && providerErr.Status >= 500
+	default:
+		return false
+	}
+}
+
+func (p *FallbackProvider) StartStreamingRequest(ctx context.Context, params StreamingRequestParams) {
+	for i, entry := range p.Chain {
+		attempt := params
+		if i > 0 {
+			// Model ids mean nothing to another provider, its own catalog picks one
+			attempt.Model = ""
+		}
+
+		started := false
+		var failure error
+		attempt.OnChunkReceived = func(chunk string) {
+			started = true
+			if params.OnChunkReceived != nil {
+				params.OnChunkReceived(chunk)
+			}
+		}
+		attempt.OnToolCallReceived = func(call ToolCall) {
+			started = true
+			if params.OnToolCallReceived != nil {
+				params.OnToolCallReceived(call)
+			}
+		}
+		attempt.OnMetadataReceived = func(meta ResponseMetadata) {
+			meta.Provider = ProviderTypeToString(entry.Type)
+			if params.OnMetadataReceived != nil {
+				params.OnMetadataReceived(meta)
+			}
+		}
+		attempt.OnStreamingErr = func(err error) {
+			failure = err
+		}
+
+		// Providers are synchronous, the caller is the one running them in a goroutine
+		entry.Provider.StartStreamingRequest(ctx, attempt)
+		if failure == nil {
+			return
+		}
+
+		last := i == len(p.Chain) - 1
+		if last || started || ctx.Err() != nil || !canFallBack(failure) {
+			if params.OnStreamingErr != nil {
+				params.OnStreamingErr(failure)
+			}
+			return
+		}
+		if params.OnFallback != nil {
+			params.OnFallback(FallbackInfo{From: entry.Type, To: p.Chain[i + 1].Type, Err: failure})
+		}
+	}
+}
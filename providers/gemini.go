@@ -11,10 +11,33 @@ import (
 	"encoding/json"
 )
 
-type GeminiProvider struct {}
+type GeminiProvider struct {
+	Models ModelSelector
+}
 
 type part struct {
-	Text string `json:"text"`
+	Text string `json:"text,omitempty"`
+	InlineData *inlineData `json:"inline_data,omitempty"`
+	FunctionCall *functionCall `json:"functionCall,omitempty"`
+	FunctionResponse *functionResponse `json:"functionResponse,omitempty"`
+}
+
+type inlineData struct {
+	MimeType string `json:"mime_type"`
+	// Base64
+	Data string `json:"data"`
+}
+
+type functionCall struct {
+	Id string `json:"id,omitempty"`
+	Name string `json:"name"`
+	Args json.RawMessage `json:"args"`
+}
+
+type functionResponse struct {
+	Id string `json:"id,omitempty"`
+	Name string `json:"name"`
+	Response map[string]any `json:"response"`
 }
 
 type systemInstruction struct {
@@ -31,11 +54,13 @@ type thinkingConfig struct {
 }
 
 type generationConfig struct {
-	ThinkingConfig thinkingConfig `json:"thinkingConfig"`
+	ThinkingConfig *thinkingConfig `json:"thinkingConfig,omitempty"`
+	MaxOutputTokens int `json:"maxOutputTokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
 }
 
-func (_ GeminiProvider) StartStreamingRequest(ctx context.Context, params StreamingRequestParams) {
-	model := "gemini-2.0-flash-lite"
+func (p *GeminiProvider) StartStreamingRequest(ctx context.Context, params StreamingRequestParams) {
+	model := params.selectModel(&p.Models)
 	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:streamGenerateContent?alt=sse", model)
 
 	systemPrompt := strings.Builder{}	
@@ -44,21 +69,56 @@ func (_ GeminiProvider) StartStreamingRequest(ctx context.Context, params Stream
 		if msg.Type == MessageTypeSystem {
 			systemPrompt.WriteString(msg.Content)
 			systemPrompt.WriteByte(' ')
-		} else {
-			var role string
-			if msg.Type == MessageTypeAssistant {
-				role = "model"
-			} else {
-				role = "user"
+			continue
+		}
+
+		var role string
+		var msgPart part
+		// Only user messages may have several
+		extraParts := []part{}
+		switch msg.Type {
+		case MessageTypeAssistant:
+			role = "model"
+			msgPart.Text = msg.Content
+		case MessageTypeToolCall:
+			role = "model"
+			msgPart.FunctionCall = &functionCall{
+				Id: msg.ToolCall.Id,
+				Name: msg.ToolCall.Name,
+				Args: msg.ToolCall.argumentsOrEmpty(),
 			}
+		case MessageTypeToolResult:
+			role = "user"
+			msgPart.FunctionResponse = &functionResponse{
+				Id: msg.ToolCall.Id,
+				Name: msg.ToolCall.Name,
+				Response: map[string]any{"content": msg.Content},
+			}
+		default:
+			role = "user"
+			msgPart.Text = msg.Content
+			for _, p := range msg.Parts {
+				switch p.Type {
+				case PartText:
+					extraParts = append(extraParts, part{Text: p.Text})
+				case PartImage, PartDocument:
+					extraParts = append(extraParts, part{InlineData: &inlineData{MimeType: p.MimeType, Data: p.base64Data()}})
+				}
+			}
+		}
+		parts := append([]part{msgPart}, extraParts...)
+		if msg.Content == "" && len(extraParts) > 0 {
+			parts = extraParts
+		}
 
+		// Function calls and their responses are expected to be grouped in a single turn
+		if len(messages) > 0 && messages[len(messages)-1].Role == role {
+			last := &messages[len(messages)-1]
+			last.Parts = append(last.Parts, parts...)
+		} else {
 			messages = append(messages, apiMessage{
 				Role: role,
-				Parts: []part{
-					part {
-						Text: msg.Content,
-					},
-				},
+				Parts: parts,
 			})
 		}
 	}
@@ -71,41 +131,88 @@ func (_ GeminiProvider) StartStreamingRequest(ctx context.Context, params Stream
 			})
 	}
 
+	if len(params.Tools) > 0 {
+		declarations := make([]map[string]any, 0, len(params.Tools))
+		for _, tool := range params.Tools {
+			declaration := map[string]any{
+				"name": tool.Name,
+				"description": tool.Description,
+			}
+			// Gemini refuses object schemas without properties
+			if tool.Parameters != nil {
+				declaration["parameters"] = tool.Parameters
+			}
+			declarations = append(declarations, declaration)
+		}
+		tools = append(tools, map[string]any{
+			"functionDeclarations": declarations,
+		})
+	}
+
 	// i hate google
 	bodyStruct := map[string]any {
 		"system_instruction": systemInstruction {
 			Parts: []part{part{Text:systemPrompt.String()}},
 		},
 		"contents": messages,
-		"generationConfig": generationConfig{ThinkingConfig:thinkingConfig{ThinkingBudget: 0}},
 		"tools": tools,
 	}
+	genConfig := generationConfig{
+		MaxOutputTokens: params.MaxTokens,
+		Temperature: params.Temperature,
+	}
+	// Pro models can't have thinking disabled
+	if !strings.Contains(model, "-pro") {
+		genConfig.ThinkingConfig = &thinkingConfig{ThinkingBudget: 0}
+	}
+	bodyStruct["generationConfig"] = genConfig
 	body, err := json.Marshal(bodyStruct)
 	if err != nil {
-		panic(err)
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(fmt.Errorf("%w: %w", ErrRequestEncoding, err))
+		}
+		return
+	}
+
+	parser := errorParser{classify: classifyGeminiError, keyName: "GEMINI_API_KEY"}
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(parser.missingKey())
+		}
+		return
 	}
 
 	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	req.Header.Set("Accept", "text/event-stream")
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("x-goog-api-key", os.Getenv("GEMINI_API_KEY"))
+	req.Header.Set("x-goog-api-key", apiKey)
 
-	reader, err := startSseRequest(req)
-	if err != nil && params.OnStreamingErr != nil {
-		params.OnStreamingErr(err)
+	reader, err := startSseRequest(req, &params, parser)
+	if err != nil {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(err)
+		}
 		return
 	}
 	defer reader.Close()
 
 	wholeContent := strings.Builder{} 
+	// Gemini doesn't always identify function calls, make up ids in that case
+	toolCallsCount := 0
+	meta := ResponseMetadata{Model: model}
 	for {
 		eventRes, err := reader.Next()
-		eventData := eventRes.eventData
+		eventData := eventRes.Data
 
 		if err != nil {
-			if err == io.EOF && params.OnStreamingEnd != nil{
-				params.OnStreamingEnd(wholeContent.String())
+			if err == io.EOF {
+				// Gemini says STOP even when it calls functions
+				if toolCallsCount > 0 && meta.FinishReason == FinishReasonStop {
+					meta.FinishReason = FinishReasonToolCalls
+				}
+				params.end(wholeContent.String(), meta)
 				return
 			}
 
@@ -120,20 +227,78 @@ func (_ GeminiProvider) StartStreamingRequest(ctx context.Context, params Stream
 			var jsonPayload = struct{ 
 				Candidates []struct{ 
 					Content struct{ 
-						Parts []struct{ Text string `json:"text"` } `json:"parts"` 
+						Parts []part `json:"parts"` 
 					} `json:"content"` 
 					FinishReason string `json:"finishReason"`
 				} `json:"candidates"` 
+				// Every chunk carries the running totals
+				UsageMetadata struct {
+					PromptTokenCount int `json:"promptTokenCount"`
+					CandidatesTokenCount int `json:"candidatesTokenCount"`
+					CachedContentTokenCount int `json:"cachedContentTokenCount"`
+				} `json:"usageMetadata"`
+				// Set when the prompt itself was blocked, there's no candidate then
+				PromptFeedback struct {
+					BlockReason string `json:"blockReason"`
+				} `json:"promptFeedback"`
 			}{}
 
 			json.Unmarshal([]byte(eventData), &jsonPayload)
-			result := jsonPayload.Candidates[0].Content.Parts[0].Text
-			if jsonPayload.Candidates[0].FinishReason == "STOP" {
-				// there is actually a bug here where the first chunk sometimes sends a STOP finish reason for some reasons...
-				result = strings.TrimRight(result, "\n")
+			if reason := jsonPayload.PromptFeedback.BlockReason; reason != "" {
+				if params.OnStreamingErr != nil {
+					params.OnStreamingErr(&ProviderError{Kind: ErrorKindContentFilter, Message: "Prompt blocked: " + reason})
+				}
+				return
+			}
+			if jsonPayload.UsageMetadata.PromptTokenCount > 0 {
+				meta.Usage = Usage{
+					InputTokens: jsonPayload.UsageMetadata.PromptTokenCount,
+					OutputTokens: jsonPayload.UsageMetadata.CandidatesTokenCount,
+					CachedTokens: jsonPayload.UsageMetadata.CachedContentTokenCount,
+				}
+			}
+			if len(jsonPayload.Candidates) == 0 {
+				continue
+			}
+
+			candidate := jsonPayload.Candidates[0]
+			switch candidate.FinishReason {
+			case "":
+			case "STOP":
+				meta.FinishReason = FinishReasonStop
+			case "MAX_TOKENS":
+				meta.FinishReason = FinishReasonLength
+			case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+				meta.FinishReason = FinishReasonContentFilter
+			default:
+				meta.FinishReason = strings.ToLower(candidate.FinishReason)
+			}
+
+			for _, candidatePart := range candidate.Content.Parts {
+				if candidatePart.FunctionCall != nil {
+					toolCallsCount += 1
+					call := ToolCall{
+						Id: candidatePart.FunctionCall.Id,
+						Name: candidatePart.FunctionCall.Name,
+						Arguments: string(candidatePart.FunctionCall.Args),
+					}
+					if call.Id == "" {
+						call.Id = fmt.Sprintf("call_%d", toolCallsCount)
+					}
+					if params.OnToolCallReceived != nil {
+						params.OnToolCallReceived(call)
+					}
+					continue
+				}
+
+				result := candidatePart.Text
+				if candidate.FinishReason == "STOP" {
+					// there is actually a bug here where the first chunk sometimes sends a STOP finish reason for some reasons...
+					result = strings.TrimRight(result, "\n")
+				}
+				wholeContent.WriteString(result)
+				params.OnChunkReceived(result)
 			}
-			wholeContent.WriteString(result)
-			params.OnChunkReceived(result)
 		}
 	}
 }
@@ -6,7 +6,8 @@ import (
 
 var OpenaiProviderGrok OpenaiProvider = OpenaiProvider {
 	Endpoint: "https://api.x.ai/v1/responses",
-	Models: NewModelSelector("grok-4-1-fast-non-reasoning", "grok-4-1-fast-non-reasoning", "grok-4-1-fast-reasoning"),
+	Models: DefaultModelCatalog()[ProviderGrok],
 	ApiKey: os.Getenv("XAI_API_KEY"),
+	KeyName: "XAI_API_KEY",
 	UseDeveloperRole: false,
 }
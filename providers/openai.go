@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"fmt"
 	"bytes"
 	"os"
 	"io"
@@ -12,30 +13,48 @@ import (
 
 var OpenaiProviderOpenai OpenaiProvider = OpenaiProvider {
 	Endpoint: "https://api.openai.com/v1/responses",
-	Models: NewModelSelector("gpt-5-nano", "gpt-5-nano", "gpt-5.2"),
+	Models: DefaultModelCatalog()[ProviderOpenai],
 	ApiKey: os.Getenv("OPENAI_API_KEY"),
+	KeyName: "OPENAI_API_KEY",
 	UseDeveloperRole: true,
 }
 
+// Plain text stays a string, the content is only a list of items when there is more than text
+func openaiUserContent(msg AgnosticConversationMessage) any {
+	if len(msg.Parts) == 0 {
+		return msg.Content
+	}
+	items := []map[string]any{}
+	for _, part := range msg.allParts() {
+		switch part.Type {
+		case PartText:
+			items = append(items, map[string]any{"type": "input_text", "text": part.Text})
+		case PartImage:
+			items = append(items, map[string]any{"type": "input_image", "image_url": part.dataUrl()})
+		case PartDocument:
+			items = append(items, map[string]any{"type": "input_file", "filename": part.Name, "file_data": part.dataUrl()})
+		}
+	}
+	return items
+}
+
 type OpenaiProvider struct {
 	Endpoint string
 	Models ModelSelector
 	ApiKey string
+	// Where ApiKey comes from, for error hints
+	KeyName string
 	// Openai uses "role":"developer" while some providers use "role":"system"
 	UseDeveloperRole bool
 }
 
 func (p *OpenaiProvider) StartStreamingRequest(ctx context.Context, params StreamingRequestParams) {
-	p.Models.SetCurrentSelection(params.ModelPreference)
-	model := p.Models.Get()
+	model := params.selectModel(&p.Models)
 
 	url := p.Endpoint
 
-	type ApiMessage struct {
-		Content string `json:"content"`
-		Role string `json:"role"`
-	}
-	messages := make([]ApiMessage, 0, len(params.Messages))
+	// Input items are either plain messages or function call related items
+	messages := make([]map[string]any, 0, len(params.Messages))
 	for _, msg := range params.Messages {
 		var role string
 		switch msg.Type {
@@ -49,10 +68,29 @@ func (p *OpenaiProvider) StartStreamingRequest(ctx context.Context, params Strea
 			role = "assistant"
 		case MessageTypeUser, MessageTypeUserContext:
 			role = "user"
+		case MessageTypeToolCall:
+			messages = append(messages, map[string]any{
+				"type": "function_call",
+				"call_id": msg.ToolCall.Id,
+				"name": msg.ToolCall.Name,
+				"arguments": string(msg.ToolCall.argumentsOrEmpty()),
+			})
+			continue
+		case MessageTypeToolResult:
+			messages = append(messages, map[string]any{
+				"type": "function_call_output",
+				"call_id": msg.ToolCall.Id,
+				"output": msg.Content,
+			})
+			continue
+		}
+		content := any(msg.Content)
+		if role == "user" {
+			content = openaiUserContent(msg)
 		}
-		messages = append(messages, ApiMessage{
-			Content: msg.Content,
-			Role: role,
+		messages = append(messages, map[string]any{
+			"content": content,
+			"role": role,
 		})
 	}
 
@@ -61,42 +99,71 @@ func (p *OpenaiProvider) StartStreamingRequest(ctx context.Context, params Strea
 		"input": messages,
 		"stream": true,
 	}
+	if params.MaxTokens > 0 {
+		bodyStruct["max_output_tokens"] = params.MaxTokens
+	}
+	if params.Temperature != nil {
+		bodyStruct["temperature"] = *params.Temperature
+	}
 
+	tools := []map[string]any{}
 	if params.AllowWebSearch {
+		tools = append(tools, map[string]any{
+			"type": "web_search",
+		})
+	}
+	for _, tool := range params.Tools {
+		tools = append(tools, map[string]any{
+			"type": "function",
+			"name": tool.Name,
+			"description": tool.Description,
+			"parameters": tool.schemaOrEmpty(),
+		})
+	}
+	if len(tools) > 0 {
 		bodyStruct["tool_choice"] = "auto"
-		bodyStruct["tools"] = []map[string]any {
-			{
-				"type": "web_search",
-			},
-		}
+		bodyStruct["tools"] = tools
 	}
 
 	body, err := json.Marshal(bodyStruct)
 	if err != nil {
-		panic(err)
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(fmt.Errorf("%w: %w", ErrRequestEncoding, err))
+		}
+		return
+	}
+	parser := errorParser{classify: classifyOpenaiError, keyName: p.KeyName}
+	if p.ApiKey == "" {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(parser.missingKey())
+		}
+		return
 	}
+
 	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	req.Header.Set("Accept", "text/event-stream")
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Authorization", "Bearer " + p.ApiKey)
 
-	reader, err := startSseRequest(req)
-	if err != nil && params.OnStreamingErr != nil {
-		params.OnStreamingErr(err)
+	reader, err := startSseRequest(req, &params, parser)
+	if err != nil {
+		if params.OnStreamingErr != nil {
+			params.OnStreamingErr(err)
+		}
 		return
 	}
 	defer reader.Close()
 
 	wholeContent := strings.Builder{}
+	meta := ResponseMetadata{Model: model}
+	hasToolCalls := false
 	for {
 		eventRes, err := reader.Next()
 		if err != nil {
-			if err == io.EOF && params.OnStreamingEnd != nil {
-				params.OnStreamingEnd(wholeContent.String())
-			}
-
-			if params.OnStreamingErr != nil {
+			if err == io.EOF {
+				params.end(wholeContent.String(), meta)
+			} else if params.OnStreamingErr != nil {
 				params.OnStreamingErr(err)
 			}
 
@@ -104,26 +171,102 @@ func (p *OpenaiProvider) StartStreamingRequest(ctx context.Context, params Strea
 		}
 
 		// Highly minimal handling of responses api
-		eventData := eventRes.eventData
+		eventData := eventRes.Data
 		if len(eventData) > 0 {
 			var typePayload = struct{
 				Type string `json:"type"`
 			}{}
 			json.Unmarshal([]byte(eventData), &typePayload)
 
-			if eventData == "[DONE]" || typePayload.Type == "response.output_text.done" {
-				params.OnStreamingEnd(wholeContent.String())
+			// Text may be followed by function calls so wait for the whole response to be done
+			if eventData == "[DONE]" {
+				params.end(wholeContent.String(), meta)
 				return
 			}
 
-			if typePayload.Type == "response.output_text.delta" {
+			switch typePayload.Type {
+			case "error":
+				if params.OnStreamingErr != nil {
+					params.OnStreamingErr(parser.parse(0, []byte(eventData)))
+				}
+				return
+			case "response.failed":
+				var jsonPayload = struct {
+					Response struct {
+						Error json.RawMessage `json:"error"`
+					} `json:"response"`
+				}{}
+				json.Unmarshal([]byte(eventData), &jsonPayload)
+				if params.OnStreamingErr != nil {
+					params.OnStreamingErr(parser.parse(0, jsonPayload.Response.Error))
+				}
+				return
+			case "response.completed", "response.incomplete":
+				// The same response object, incomplete ones say why they stopped early
+				var jsonPayload = struct {
+					Response struct {
+						IncompleteDetails struct {
+							Reason string `json:"reason"`
+						} `json:"incomplete_details"`
+						Usage struct {
+							InputTokens int `json:"input_tokens"`
+							OutputTokens int `json:"output_tokens"`
+							InputTokensDetails struct {
+								CachedTokens int `json:"cached_tokens"`
+							} `json:"input_tokens_details"`
+						} `json:"usage"`
+					} `json:"response"`
+				}{}
+				json.Unmarshal([]byte(eventData), &jsonPayload)
+				if typePayload.Type == "response.completed" {
+					meta.FinishReason = FinishReasonStop
+				} else {
+					switch reason := jsonPayload.Response.IncompleteDetails.Reason; reason {
+					case "max_output_tokens":
+						meta.FinishReason = FinishReasonLength
+					case "content_filter":
+						meta.FinishReason = FinishReasonContentFilter
+					default:
+						meta.FinishReason = reason
+					}
+				}
+				if hasToolCalls {
+					meta.FinishReason = FinishReasonToolCalls
+				}
+				meta.Usage = Usage{
+					InputTokens: jsonPayload.Response.Usage.InputTokens,
+					OutputTokens: jsonPayload.Response.Usage.OutputTokens,
+					CachedTokens: jsonPayload.Response.Usage.InputTokensDetails.CachedTokens,
+				}
+				params.end(wholeContent.String(), meta)
+				return
+			case "response.output_text.delta":
 				var jsonPayload = struct {
 					Delta string `json:"delta"`
 				}{}
 				json.Unmarshal([]byte(eventData), &jsonPayload)
 				wholeContent.WriteString(jsonPayload.Delta)
 				params.OnChunkReceived(jsonPayload.Delta)
-			} else {
+			case "response.output_item.done":
+				// Arguments are streamed as well but there's no point in showing them, wait for the complete item
+				var jsonPayload = struct {
+					Item struct {
+						Type string `json:"type"`
+						CallId string `json:"call_id"`
+						Name string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"item"`
+				}{}
+				json.Unmarshal([]byte(eventData), &jsonPayload)
+				if jsonPayload.Item.Type == "function_call" && params.OnToolCallReceived != nil {
+					hasToolCalls = true
+					params.OnToolCallReceived(ToolCall{
+						Id: jsonPayload.Item.CallId,
+						Name: jsonPayload.Item.Name,
+						Arguments: jsonPayload.Item.Arguments,
+					})
+				}
+			default:
 				//params.OnStreamingErr(errors.New(fmt.Sprintf("Unhandled event type: %s", typePayload.Type)))
 			}
 		}
@@ -0,0 +1,75 @@
+package providers
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOpenaiFinishReason(t *testing.T) {
+	usage := `"usage": {"input_tokens": 100, "output_tokens": 20, "input_tokens_details": {"cached_tokens": 40}}`
+	wantUsage := Usage{InputTokens: 100, OutputTokens: 20, CachedTokens: 40}
+	delta := `data: {"type": "response.output_text.delta", "delta": "Hello"}`
+	toolCall := `data: {"type": "response.output_item.done", "item": {"type": "function_call", "call_id": "call_1", "name": "read_file", "arguments": "{\"path\": \"a\"}"}}`
+
+	cases := []struct {
+		name string
+		events []string
+		want string
+		wantUsage Usage
+	}{
+		{
+			name: "completed",
+			events: []string{delta, `data: {"type": "response.completed", "response": {"status": "completed", ` + usage + `}}`},
+			want: FinishReasonStop,
+			wantUsage: wantUsage,
+		},
+		{
+			name: "max output tokens",
+			events: []string{delta, `data: {"type": "response.incomplete", "response": {"status": "incomplete", "incomplete_details": {"reason": "max_output_tokens"}, ` + usage + `}}`},
+			want: FinishReasonLength,
+			wantUsage: wantUsage,
+		},
+		{
+			name: "content filter",
+			events: []string{delta, `data: {"type": "response.incomplete", "response": {"status": "incomplete", "incomplete_details": {"reason": "content_filter"}, ` + usage + `}}`},
+			want: FinishReasonContentFilter,
+			wantUsage: wantUsage,
+		},
+		{
+			name: "tool calls",
+			events: []string{toolCall, `data: {"type": "response.completed", "response": {"status": "completed", ` + usage + `}}`},
+			want: FinishReasonToolCalls,
+			wantUsage: wantUsage,
+		},
+		{
+			name: "stream cut",
+			events: []string{delta},
+			want: "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := sseServer(t, c.events, nil)
+			provider := &OpenaiProvider{Endpoint: server.URL, ApiKey: "test", Models: DefaultModelCatalog()[ProviderOpenai]}
+			result := runStream(provider, t, StreamingRequestParams{
+				Messages: []AgnosticConversationMessage{{Type: MessageTypeUser, Content: "Hi"}},
+			})
+			if result.err != nil {
+				t.Fatalf("unexpected error %v", result.err)
+			}
+			if !result.ended {
+				t.Fatal("OnStreamingEnd wasn't called")
+			}
+			if result.meta.FinishReason != c.want {
+				t.Errorf("finish reason %q, want %q", result.meta.FinishReason, c.want)
+			}
+			if result.meta.Usage != c.wantUsage {
+				t.Errorf("usage %+v, want %+v", result.meta.Usage, c.wantUsage)
+			}
+			if c.want == FinishReasonToolCalls && !slices.Equal(result.toolCalls, []ToolCall{{Id: "call_1", Name: "read_file", Arguments: `{"path": "a"}`}}) {
+				t.Errorf("tool calls %+v", result.toolCalls)
+			}
+		})
+	}
+}
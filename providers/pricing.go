@@ -0,0 +1,61 @@
+package providers
+
+type Usage struct {
+	// Includes the cached tokens and the ones written to the cache
+	InputTokens int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	// Read from the cache
+	CachedTokens int `json:"cached_tokens"`
+	// Written to the cache, Anthropic charges more for them than for plain input
+	CacheWriteTokens int `json:"cache_write_tokens"`
+}
+
+func (u Usage) Add(other Usage) Usage {
+	return Usage {
+		InputTokens: u.InputTokens + other.InputTokens,
+		OutputTokens: u.OutputTokens + other.OutputTokens,
+		CachedTokens: u.CachedTokens + other.CachedTokens,
+		CacheWriteTokens: u.CacheWriteTokens + other.CacheWriteTokens,
+	}
+}
+
+// USD per million tokens
+type ModelPrice struct {
+	Input float64
+	CachedInput float64
+	// 0 when the provider charges cache writes as plain input
+	CacheWrite float64
+	Output float64
+}
+
+// Public list prices, they change more often than this file so take them with a grain of salt
+var modelPrices = map[string]ModelPrice {
+	"gpt-5-nano": {Input: 0.05, CachedInput: 0.005, Output: 0.40},
+	"gpt-5.2": {Input: 1.75, CachedInput: 0.175, Output: 14.00},
+	// Cache writes are those of the 5 minutes cache
+	"claude-haiku-4-5": {Input: 1.00, CachedInput: 0.10, CacheWrite: 1.25, Output: 5.00},
+	"claude-sonnet-4-5": {Input: 3.00, CachedInput: 0.30, CacheWrite: 3.75, Output: 15.00},
+	"gemini-2.0-flash-lite": {Input: 0.075, CachedInput: 0.01875, Output: 0.30},
+	"gemini-2.5-flash": {Input: 0.30, CachedInput: 0.03, Output: 2.50},
+	"grok-4-1-fast-non-reasoning": {Input: 0.20, CachedInput: 0.05, Output: 0.50},
+	"grok-4-1-fast-reasoning": {Input: 0.20, CachedInput: 0.05, Output: 0.50},
+}
+
+// Returns false when the model is not in the price table, self hosted models are free but we can't know that either
+func (u Usage) Cost(model string) (float64, bool) {
+	price, found := modelPrices[model]
+	if !found {
+		return 0, false
+	}
+
+	cacheWrite := price.CacheWrite
+	if cacheWrite == 0 {
+		cacheWrite = price.Input
+	}
+	uncached := max(0, u.InputTokens - u.CachedTokens - u.CacheWriteTokens)
+	cost := float64(uncached) * price.Input +
+		float64(u.CachedTokens) * price.CachedInput +
+		float64(u.CacheWriteTokens) * cacheWrite +
+		float64(u.OutputTokens) * price.Output
+	return cost / 1_000_000, true
+}
@@ -0,0 +1,29 @@
+package providers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUsageCost(t *testing.T) {
+	cases := []struct {
+		name string
+		model string
+		usage Usage
+		want float64
+		known bool
+	}{
+		{"unknown model", "mystery", Usage{InputTokens: 1000}, 0, false},
+		{"plain", "claude-sonnet-4-5", Usage{InputTokens: 1_000_000, OutputTokens: 1_000_000}, 3 + 15, true},
+		{"cache reads", "claude-sonnet-4-5", Usage{InputTokens: 1_000_000, CachedTokens: 500_000}, 1.5 + 0.15, true},
+		{"cache writes", "claude-sonnet-4-5", Usage{InputTokens: 1_000_000, CacheWriteTokens: 1_000_000}, 3.75, true},
+		{"reads and writes", "claude-haiku-4-5", Usage{InputTokens: 3_000_000, CachedTokens: 1_000_000, CacheWriteTokens: 1_000_000}, 1 + 0.10 + 1.25, true},
+		{"writes at the input price without a write price", "gpt-5.2", Usage{InputTokens: 1_000_000, CacheWriteTokens: 1_000_000}, 1.75, true},
+	}
+	for _, c := range cases {
+		cost, known := c.usage.Cost(c.model)
+		if known != c.known || math.Abs(cost - c.want) > 1e-9 {
+			t.Errorf("%s: got %v %v, want %v %v", c.name, cost, known, c.want, c.known)
+		}
+	}
+}
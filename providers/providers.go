@@ -1,14 +1,11 @@
 package providers
 
 import (
-	"io"
-	"fmt"
 	"context"
 	"errors"
-	"net/http"
-	"bufio"
 	"strings"
-	"time"
+	"encoding/json"
+	"encoding/base64"
 )
 
 type ProviderType int
@@ -17,6 +14,7 @@ const (
 	ProviderAnthropic
 	ProviderGemini
 	ProviderGrok
+	ProviderLocal
 	ProviderLast
 )
 
@@ -30,6 +28,8 @@ func ProviderTypeToString(provider ProviderType) string {
 		return "google"
 	case ProviderGrok:
 		return "elonmusk"
+	case ProviderLocal:
+		return "local"
 	default:
 		return "fuck you"
 	}
@@ -45,6 +45,8 @@ func ProviderTypeFromString(t string) (ProviderType, error) {
 		return ProviderGemini, nil
 	case "elonmusk":
 		return ProviderGrok, nil
+	case "local":
+		return ProviderLocal, nil
 	default:
 		return 0, errors.New("Unknown provider")
 	}
@@ -86,17 +88,34 @@ func ModelPreferenceFromString(t string) (ModelPreference, error) {
 
 type ModelSelector struct {
 	models [ModelPreferenceLast]string
+	// In tokens, 0 when unknown
+	contextWindows [ModelPreferenceLast]int
+	// Set explicitly, changing the model doesn't reset it then
+	contextWindowsSet [ModelPreferenceLast]bool
 	currentSelection ModelPreference
 }
 
 func NewModelSelector(cheap, fast, smart string) ModelSelector {
 	s := ModelSelector {}
-	s.models[ModelPreferenceCheap] = cheap
-	s.models[ModelPreferenceFast] = fast
-	s.models[ModelPreferenceSmart] = smart
+	s.Set(ModelPreferenceCheap, cheap)
+	s.Set(ModelPreferenceFast, fast)
+	s.Set(ModelPreferenceSmart, smart)
 	return s
 }
 
+// The context window becomes what's known of the model, unless it was set with SetContextWindow
+func (s *ModelSelector) Set(pref ModelPreference, model string) {
+	s.models[pref] = model
+	if !s.contextWindowsSet[pref] {
+		s.contextWindows[pref] = KnownContextWindow(model)
+	}
+}
+
+func (s *ModelSelector) SetContextWindow(pref ModelPreference, tokens int) {
+	s.contextWindows[pref] = tokens
+	s.contextWindowsSet[pref] = true
+}
+
 func (s *ModelSelector) SetCurrentSelection(pref ModelPreference) {
 	s.currentSelection = pref
 }
@@ -114,11 +133,36 @@ func (s *ModelSelector) Get() string {
 	}
 }
 
+// Of the model Get returns, 0 when unknown
+func (s *ModelSelector) ContextWindow() int {
+	if s.currentSelection < 0 || s.currentSelection >= ModelPreferenceLast {
+		return s.contextWindows[ModelPreferenceCheap]
+	}
+	return s.contextWindows[s.currentSelection]
+}
+
+// Model ids of every provider for every preference
+type ModelCatalog [ProviderLast]ModelSelector
+
+// What the app ships with, the config file may override any entry
+func DefaultModelCatalog() ModelCatalog {
+	catalog := ModelCatalog{}
+	catalog[ProviderOpenai] = NewModelSelector("gpt-5-nano", "gpt-5-nano", "gpt-5.2")
+	catalog[ProviderAnthropic] = NewModelSelector("claude-haiku-4-5", "claude-haiku-4-5", "claude-sonnet-4-5")
+	catalog[ProviderGemini] = NewModelSelector("gemini-2.0-flash-lite", "gemini-2.0-flash-lite", "gemini-2.5-flash")
+	catalog[ProviderGrok] = NewModelSelector("grok-4-1-fast-non-reasoning", "grok-4-1-fast-non-reasoning", "grok-4-1-fast-reasoning")
+	// Depends entirely on what the user is running
+	catalog[ProviderLocal] = NewModelSelector("", "", "")
+	return catalog
+}
+
 var (
 	ErrStatusNotOK error = errors.New("GET request was not 200 OK")
 	ErrContentTypeNotEventStream error = errors.New("The response MIME type should be text/event-stream for streaming requests")
 	ErrRequestSending error = errors.New("Something wrong happened when emitting request")
 	ErrReadingBody error = errors.New("Failed to read body")
+	ErrRequestEncoding error = errors.New("Failed to encode the request")
+	ErrInvalidStreamEvent error = errors.New("The server sent an event that doesn't make sense")
 )
 
 type MessageType int
@@ -128,96 +172,175 @@ const (
 	// Technically the same as MessageTypeUser but describes that this was context not necessarly worth printing back
 	MessageTypeUserContext
 	MessageTypeSystem
+	// The assistant asked for a tool to be run, see ToolCall
+	MessageTypeToolCall
+	// Content is the output of the tool described by ToolCall
+	MessageTypeToolResult
 )
 
+func MessageTypeToString(t MessageType) string {
+	switch t {
+	case MessageTypeAssistant:
+		return "assistant"
+	case MessageTypeUser:
+		return "user"
+	case MessageTypeUserContext:
+		return "user_context"
+	case MessageTypeSystem:
+		return "system"
+	case MessageTypeToolCall:
+		return "tool_call"
+	case MessageTypeToolResult:
+		return "tool_result"
+	default:
+		return "unknown"
+	}
+}
+
+type PartType int
+const (
+	PartText PartType = iota
+	// Data is an image of MimeType
+	PartImage
+	// Data is a document of MimeType, only PDFs for now
+	PartDocument
+)
+
+// Content of a user message that is more than its text, e.g. an attached screenshot
+type MessagePart struct {
+	Type PartType `json:"type"`
+	// Only set for PartText
+	Text string `json:"text,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	// Base64 in sessions, encoding/json does it
+	Data []byte `json:"data,omitempty"`
+	// File name of documents, some providers want one
+	Name string `json:"name,omitempty"`
+}
+
+func (part MessagePart) dataUrl() string {
+	return "data:" + part.MimeType + ";base64," + base64.StdEncoding.EncodeToString(part.Data)
+}
+
+func (part MessagePart) base64Data() string {
+	return base64.StdEncoding.EncodeToString(part.Data)
+}
+
 type AgnosticConversationMessage struct {
-	Type MessageType
-	Content string
+	Type MessageType `json:"type"`
+	Content string `json:"content"`
+	// Only set for MessageTypeToolCall and MessageTypeToolResult
+	ToolCall *ToolCall `json:"tool_call,omitempty"`
+	// Sent after Content, only user messages have some
+	Parts []MessagePart `json:"parts,omitempty"`
+	// What answered, only set for MessageTypeAssistant and MessageTypeToolCall
+	Provider string `json:"provider,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+// Content as a text part followed by Parts
+func (msg AgnosticConversationMessage) allParts() []MessagePart {
+	parts := make([]MessagePart, 0, len(msg.Parts) + 1)
+	if msg.Content != "" {
+		parts = append(parts, MessagePart{Type: PartText, Text: msg.Content})
+	}
+	return append(parts, msg.Parts...)
+}
+
+// A function the model is allowed to call
+type ToolDefinition struct {
+	Name string
+	Description string
+	// JSON schema of the arguments object, nil if the tool takes no argument
+	Parameters map[string]any
+}
+
+// Some providers insist on having a schema even when there is no argument
+func (t ToolDefinition) schemaOrEmpty() map[string]any {
+	if t.Parameters == nil {
+		return map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	return t.Parameters
+}
+
+type ToolCall struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	// Raw JSON object as produced by the model
+	Arguments string `json:"arguments"`
+}
+
+// Arguments as a raw JSON object, models happily omit them when there are none. A response cut at max_tokens
+// can also leave them unfinished, they would make every later request of the conversation fail to encode
+func (c ToolCall) argumentsOrEmpty() json.RawMessage {
+	arguments := strings.TrimSpace(c.Arguments)
+	if !strings.HasPrefix(arguments, "{") || !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
 }
 
 type StreamingRequestParams struct {
 	Messages []AgnosticConversationMessage
 	ModelPreference  ModelPreference
+	// When set, used instead of the model matching ModelPreference
+	Model string
 	AllowWebSearch bool
+	Tools []ToolDefinition
+	// 0 lets the provider pick
+	MaxTokens int
+	// nil lets the provider pick
+	Temperature *float64
+	// The zero value makes a single attempt
+	Retry RetryPolicy
+	// Called before waiting for each retry, never once a chunk was received
+	OnRetry func(info RetryInfo)
+	// Only called by FallbackProvider, before trying the next provider
+	OnFallback func(info FallbackInfo)
 	OnChunkReceived func(chunk string)
+	// Called for every complete tool call, always before OnStreamingEnd
+	OnToolCallReceived func(call ToolCall)
+	// Called once, right before OnStreamingEnd
+	OnMetadataReceived func(meta ResponseMetadata)
 	OnStreamingEnd func(content string)
 	OnStreamingErr func(err error)
 }
 
-type Provider interface {
-	StartStreamingRequest(ctx context.Context, params StreamingRequestParams)
-}
+// Why the model stopped, each provider has its own vocabulary which is mapped to these
+const (
+	FinishReasonStop string = "stop"
+	FinishReasonLength string = "length"
+	FinishReasonToolCalls string = "tool_calls"
+	FinishReasonContentFilter string = "content_filter"
+)
 
-type sseReader struct {
-	resp *http.Response
-	reader *bufio.Reader
+// What is only known once the response is over
+type ResponseMetadata struct {
+	// Only set by FallbackProvider, as it's the only one that can't be known beforehand
+	Provider string
+	Model string
+	Usage Usage
+	// One of the FinishReason constants, or whatever the provider said if it couldn't be mapped. Empty when the stream ended abruptly
+	FinishReason string
 }
 
-func startSseRequest(req *http.Request) (*sseReader, error) {
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.ResponseHeaderTimeout = 30 * time.Second
-	client := http.Client{Transport: transport}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, ErrRequestSending
+func (params *StreamingRequestParams) selectModel(models *ModelSelector) string {
+	if params.Model != "" {
+		return params.Model
 	}
+	models.SetCurrentSelection(params.ModelPreference)
+	return models.Get()
+}
 
-	if resp.StatusCode != 200 {
-		errReason, _ := io.ReadAll(resp.Body)
-		defer resp.Body.Close()
-		return nil, errors.New(fmt.Sprintf("%s: %s", resp.Status, string(errReason)))
+func (params *StreamingRequestParams) end(content string, meta ResponseMetadata) {
+	if params.OnMetadataReceived != nil {
+		params.OnMetadataReceived(meta)
 	}
-
-	if !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
-		return nil, ErrContentTypeNotEventStream
+	if params.OnStreamingEnd != nil {
+		params.OnStreamingEnd(content)
 	}
+}
 
-	ssereader := sseReader{resp, bufio.NewReader(resp.Body)}
-	return &ssereader, nil
-}
-
-func (reader *sseReader) Close() {
-	reader.resp.Body.Close()
-}
-
-type sseReadResult struct {
-	eventName string
-	eventData string
-}
-
-// Read until an event data is formed and return it
-func (reader *sseReader) Next() (sseReadResult, error) {
-	res := sseReadResult{}
-	eventData := strings.Builder{}
-
-	for {
-		line, err := reader.reader.ReadString('\n')
-		if err != nil {
-			return res, err
-		}
-
-		if strings.TrimSpace(line) == "" {
-			if eventData.Len() > 0 {
-				res.eventData = eventData.String()
-				return res, nil
-			}
-		}
-
-		if strings.HasPrefix(line, ":") {
-			continue
-		}
-
-		if idx := strings.IndexByte(line, ':'); idx != -1 {
-			field := line[:idx]
-			value := line[idx+1:]
-			switch field {
-			case "event":
-				res.eventName = strings.TrimSpace(value)
-			case "data":
-				eventData.WriteString(strings.TrimSpace(value))
-			default:
-			//dont care 😆🍭
-			}
-		}
-	}
+type Provider interface {
+	StartStreamingRequest(ctx context.Context, params StreamingRequestParams)
 }
@@ -0,0 +1,60 @@
+package providers
+
+import (
+	"io"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+// What a provider reported through the callbacks of one request
+type streamResult struct {
+	chunks []string
+	toolCalls []ToolCall
+	meta ResponseMetadata
+	// Given to OnStreamingEnd, ended is false when it wasn't called
+	content string
+	ended bool
+	err error
+}
+
+func runStream(provider Provider, t *testing.T, params StreamingRequestParams) streamResult {
+	result := streamResult{}
+	params.Retry = testRetryPolicy()
+	params.OnChunkReceived = func(chunk string) {
+		result.chunks = append(result.chunks, chunk)
+	}
+	params.OnToolCallReceived = func(call ToolCall) {
+		result.toolCalls = append(result.toolCalls, call)
+	}
+	params.OnMetadataReceived = func(meta ResponseMetadata) {
+		result.meta = meta
+	}
+	params.OnStreamingEnd = func(content string) {
+		result.content = content
+		result.ended = true
+	}
+	params.OnStreamingErr = func(err error) {
+		result.err = err
+	}
+	provider.StartStreamingRequest(t.Context(), params)
+	return result
+}
+
+// Stand-in for a vendor, answers every request with events, written one by one as in a real stream.
+// The body of the last request is stored in body
+func sseServer(t *testing.T, events []string, body *[]byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body != nil {
+			*body, _ = io.ReadAll(r.Body)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for _, event := range events {
+			w.Write([]byte(event + "\n\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
@@ -0,0 +1,134 @@
+package providers
+
+import (
+	"time"
+	"slices"
+	"strings"
+	"strconv"
+	"net/http"
+	"math/rand/v2"
+)
+
+// How a request that failed is attempted again. Only the request is retried, never a response that started streaming
+type RetryPolicy struct {
+	// Total number of attempts, 0 and 1 both mean a single one
+	MaxAttempts int
+	// Wait before the first retry, doubled for each of the following ones
+	BaseDelay time.Duration
+	// Longest wait between attempts, a server asking to wait longer than that is not retried
+	MaxDelay time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay: time.Second,
+		MaxDelay: time.Minute,
+	}
+}
+
+// Given to OnRetry before waiting for the next attempt
+type RetryInfo struct {
+	// Number of the attempt about to be made, 2 for the first retry
+	Attempt int
+	MaxAttempts int
+	Delay time.Duration
+	// Why the previous attempt failed
+	Err error
+}
+
+// First line of the error, error bodies can be whole JSON documents
+func (info RetryInfo) Reason() string {
+	reason, _, _ := strings.Cut(info.Err.Error(), "\n")
+	if runes := []rune(reason); len(runes) > 120 {
+		reason = string(runes[:120]) + "…"
+	}
+	return reason
+}
+
+// Rate limits, overloaded servers and the usual gateway hiccups. Anthropic uses 529 when overloaded
+var retryableStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooEarly,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+	529,
+}
+
+func retryableStatus(status int) bool {
+	return slices.Contains(retryableStatuses, status)
+}
+
+// Exponential with jitter, between half and all of BaseDelay * 2^(attempt-2)
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 2; i < attempt && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, policy.MaxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay / 2 + rand.N(delay / 2 + 1)
+}
+
+// Rate limit buckets, the reset of one is only worth waiting for when it's the one that ran out
+type rateLimitBucket struct {
+	remaining string
+	reset string
+	// e.g. "1s" and "6m0s" for OpenAI, RFC 3339 timestamps for Anthropic
+	parseReset func(value string, now time.Time) (time.Duration, error)
+}
+
+func parseResetDuration(value string, now time.Time) (time.Duration, error) {
+	return time.ParseDuration(value)
+}
+
+func parseResetTime(value string, now time.Time) (time.Duration, error) {
+	at, err := time.Parse(time.RFC3339, value)
+	return at.Sub(now), err
+}
+
+var rateLimitBuckets = []rateLimitBucket{
+	{"x-ratelimit-remaining-requests", "x-ratelimit-reset-requests", parseResetDuration},
+	{"x-ratelimit-remaining-tokens", "x-ratelimit-reset-tokens", parseResetDuration},
+	{"anthropic-ratelimit-requests-remaining", "anthropic-ratelimit-requests-reset", parseResetTime},
+	{"anthropic-ratelimit-tokens-remaining", "anthropic-ratelimit-tokens-reset", parseResetTime},
+	{"anthropic-ratelimit-input-tokens-remaining", "anthropic-ratelimit-input-tokens-reset", parseResetTime},
+	{"anthropic-ratelimit-output-tokens-remaining", "anthropic-ratelimit-output-tokens-reset", parseResetTime},
+}
+
+// Wait the server asked for, 0 when it said nothing and the backoff decides. Retry-After wins. Otherwise, for a 429,
+// the reset of the rate limits of OpenAI and Anthropic that ran out. The others refill on their own schedule,
+// their reset says nothing about when the request would go through, and even less so for overloaded servers
+func retryAfter(status int, header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return max(0, at.Sub(now))
+		}
+	}
+	if status != http.StatusTooManyRequests {
+		return 0
+	}
+
+	// When several ran out, the longest reset is the one that will let the request through
+	delay := time.Duration(0)
+	for _, bucket := range rateLimitBuckets {
+		if remaining, err := strconv.Atoi(header.Get(bucket.remaining)); err != nil || remaining > 0 {
+			continue
+		}
+		if d, err := bucket.parseReset(header.Get(bucket.reset), now); err == nil {
+			delay = max(delay, d)
+		}
+	}
+	return delay
+}
@@ -0,0 +1,101 @@
+package providers
+
+import (
+	"time"
+	"testing"
+	"net/http"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	in := func(d time.Duration) string {
+		return now.Add(d).Format(time.RFC3339)
+	}
+
+	cases := []struct {
+		name string
+		status int
+		header map[string]string
+		want time.Duration
+	}{
+		{"nothing", 429, nil, 0},
+		{"retry-after seconds", 503, map[string]string{"Retry-After": "3"}, 3 * time.Second},
+		{"retry-after date", 503, map[string]string{"Retry-After": now.Add(5 * time.Second).Format(http.TimeFormat)}, 5 * time.Second},
+		{"retry-after date in the past", 429, map[string]string{"Retry-After": now.Add(-time.Minute).Format(http.TimeFormat)}, 0},
+		{"retry-after-ms wins", 429, map[string]string{"retry-after-ms": "1500", "Retry-After": "3"}, 1500 * time.Millisecond},
+		{"invalid retry-after", 429, map[string]string{"Retry-After": "soon"}, 0},
+		{
+			"openai bucket that ran out", 429,
+			map[string]string{
+				"x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "2s",
+				"x-ratelimit-remaining-tokens": "5000", "x-ratelimit-reset-tokens": "6m0s",
+			},
+			2 * time.Second,
+		},
+		{
+			"openai buckets that didn't run out", 429,
+			map[string]string{
+				"x-ratelimit-remaining-requests": "10", "x-ratelimit-reset-requests": "2s",
+				"x-ratelimit-remaining-tokens": "5000", "x-ratelimit-reset-tokens": "6m0s",
+			},
+			0,
+		},
+		{
+			"anthropic longest of the buckets that ran out", 429,
+			map[string]string{
+				"anthropic-ratelimit-requests-remaining": "3", "anthropic-ratelimit-requests-reset": in(50 * time.Second),
+				"anthropic-ratelimit-input-tokens-remaining": "0", "anthropic-ratelimit-input-tokens-reset": in(4 * time.Second),
+				"anthropic-ratelimit-output-tokens-remaining": "0", "anthropic-ratelimit-output-tokens-reset": in(9 * time.Second),
+			},
+			9 * time.Second,
+		},
+		{
+			"reset without remaining", 429,
+			map[string]string{"anthropic-ratelimit-tokens-reset": in(30 * time.Second)},
+			0,
+		},
+		{
+			"resets ignored when overloaded", 529,
+			map[string]string{"anthropic-ratelimit-tokens-remaining": "0", "anthropic-ratelimit-tokens-reset": in(30 * time.Second)},
+			0,
+		},
+		{
+			"resets ignored for server errors", 500,
+			map[string]string{"x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "1m"},
+			0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := http.Header{}
+			for key, value := range c.header {
+				header.Set(key, value)
+			}
+			if got := retryAfter(c.status, header, now); got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	cases := []struct {
+		attempt int
+		max time.Duration
+	}{
+		{2, time.Second},
+		{3, 2 * time.Second},
+		{4, 4 * time.Second},
+		{5, 5 * time.Second},
+		{9, 5 * time.Second},
+	}
+	for _, c := range cases {
+		for range 100 {
+			if got := policy.backoff(c.attempt); got < c.max / 2 || got > c.max {
+				t.Fatalf("attempt %d: %v not between %v and %v", c.attempt, got, c.max / 2, c.max)
+			}
+		}
+	}
+}
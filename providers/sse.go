@@ -0,0 +1,219 @@
+package providers
+
+import (
+	"io"
+	"time"
+	"bufio"
+	"strings"
+	"strconv"
+	"net/http"
+)
+
+// Server-sent events as the WHATWG spec interprets them:
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+type SseEvent struct {
+	// "message" when the server didn't name it
+	Type string
+	// Lines of every data field, joined with '\n'
+	Data string
+	// Last id the stream set, events without an id field keep the previous one
+	LastEventId string
+}
+
+const sseDefaultEventType string = "message"
+
+type SseDecoder struct {
+	reader *bufio.Reader
+	// Only the very first bytes of the stream may be a BOM
+	started bool
+	// The last line ended with '\r', a '\n' right after it belongs to the same line end. Peeking instead
+	// would block until the server sends more, and hold back the event the empty line dispatches
+	lastWasCR bool
+	lastEventId string
+	retry time.Duration
+}
+
+func NewSseDecoder(r io.Reader) *SseDecoder {
+	return &SseDecoder{reader: bufio.NewReader(r)}
+}
+
+// Id to send as Last-Event-ID when reconnecting, empty if the server never gave one
+func (d *SseDecoder) LastEventId() string {
+	return d.lastEventId
+}
+
+// Reconnection delay the server asked for with a retry field, 0 when it didn't
+func (d *SseDecoder) Retry() time.Duration {
+	return d.retry
+}
+
+// A line ends with "\r\n", "\n" or "\r". The returned line doesn't include it.
+// io.EOF is only returned when nothing was read, a last line without an end is returned as is
+func (d *SseDecoder) readLine() (string, error) {
+	line := []byte{}
+	for {
+		b, err := d.reader.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return string(line), nil
+			}
+			return "", err
+		}
+		if d.lastWasCR {
+			d.lastWasCR = false
+			if b == '\n' {
+				continue
+			}
+		}
+		switch b {
+		case '\n':
+			return string(line), nil
+		case '\r':
+			d.lastWasCR = true
+			return string(line), nil
+		}
+		line = append(line, b)
+	}
+}
+
+// Reads until an event is dispatched. At the end of the stream, an event that wasn't followed by an empty line
+// is discarded and io.EOF is returned, as the spec says
+func (d *SseDecoder) Next() (SseEvent, error) {
+	eventType := ""
+	data := strings.Builder{}
+	hasData := false
+
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return SseEvent{}, err
+		}
+		if !d.started {
+			d.started = true
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+
+		if line == "" {
+			if !hasData {
+				// Nothing to dispatch, the event type is reset all the same
+				eventType = ""
+				continue
+			}
+			if eventType == "" {
+				eventType = sseDefaultEventType
+			}
+			return SseEvent{
+				Type: eventType,
+				// Every data line was followed by a '\n', the last one is not part of the data
+				Data: strings.TrimSuffix(data.String(), "\n"),
+				LastEventId: d.lastEventId,
+			}, nil
+		}
+
+		if line[0] == ':' {
+			// Comment, often used as a keep-alive
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		// Only a single space, the rest belongs to the value
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, '\x00') {
+				d.lastEventId = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				d.retry = time.Duration(ms) * time.Millisecond
+			}
+		default:
+			// Unknown fields are ignored
+		}
+	}
+}
+
+type sseReader struct {
+	resp *http.Response
+	*SseDecoder
+}
+
+// Sends req until it gets an event stream, as params.Retry allows. Nothing was streamed yet when this returns,
+// so retrying here can't duplicate any output. Failures are a *ProviderError read with parser
+func startSseRequest(req *http.Request, params *StreamingRequestParams, parser errorParser) (*sseReader, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	client := http.Client{Transport: transport}
+	ctx := req.Context()
+
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		hint := time.Duration(0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			err = networkError(err)
+		} else if resp.StatusCode != 200 {
+			errReason, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			providerErr := parser.parse(resp.StatusCode, errReason)
+			// OpenAI says 429 when out of credits too
+			if !retryableStatus(resp.StatusCode) || providerErr.Kind == ErrorKindQuota {
+				return nil, providerErr
+			}
+			err = providerErr
+			hint = retryAfter(resp.StatusCode, resp.Header, time.Now())
+		} else if !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+			resp.Body.Close()
+			return nil, ErrContentTypeNotEventStream
+		} else {
+			return &sseReader{resp, NewSseDecoder(resp.Body)}, nil
+		}
+
+		policy := params.Retry
+		if attempt >= policy.MaxAttempts || hint > policy.MaxDelay {
+			return nil, err
+		}
+		delay := max(hint, policy.backoff(attempt + 1))
+		if params.OnRetry != nil {
+			params.OnRetry(RetryInfo{Attempt: attempt + 1, MaxAttempts: policy.MaxAttempts, Delay: delay, Err: err})
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		// The body was consumed by the previous attempt
+		retry := req.Clone(ctx)
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
+
+// A connection that breaks in the middle of the stream is a network error, unless the request was cancelled
+func (reader *sseReader) Next() (SseEvent, error) {
+	event, err := reader.SseDecoder.Next()
+	if err != nil && err != io.EOF && reader.resp.Request.Context().Err() == nil {
+		return event, networkError(err)
+	}
+	return event, err
+}
+
+func (reader *sseReader) Close() {
+	reader.resp.Body.Close()
+}
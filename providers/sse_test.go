@@ -0,0 +1,388 @@
+package providers
+
+import (
+	"io"
+	"time"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"net/http"
+	"testing/iotest"
+	"net/http/httptest"
+)
+
+// Every event until the end of the stream
+func decodeAll(r io.Reader) ([]SseEvent, *SseDecoder, error) {
+	decoder := NewSseDecoder(r)
+	events := []SseEvent{}
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return events, decoder, nil
+		}
+		if err != nil {
+			return events, decoder, err
+		}
+		events = append(events, event)
+	}
+}
+
+func TestSseDecoder(t *testing.T) {
+	cases := []struct {
+		name string
+		input string
+		want []SseEvent
+		retry time.Duration
+	}{
+		{
+			name: "lf",
+			input: "event: a\ndata: 1\n\ndata: 2\n\n",
+			want: []SseEvent{{Type: "a", Data: "1"}, {Type: "message", Data: "2"}},
+		},
+		{
+			name: "crlf",
+			input: "event: a\r\ndata: 1\r\n\r\ndata: 2\r\n\r\n",
+			want: []SseEvent{{Type: "a", Data: "1"}, {Type: "message", Data: "2"}},
+		},
+		{
+			name: "cr only",
+			input: "event: a\rdata: 1\r\rdata: 2\r\r",
+			want: []SseEvent{{Type: "a", Data: "1"}, {Type: "message", Data: "2"}},
+		},
+		{
+			name: "mixed line ends",
+			input: "data: 1\r\ndata: 2\rdata: 3\n\r\n",
+			want: []SseEvent{{Type: "message", Data: "1\n2\n3"}},
+		},
+		{
+			name: "bom",
+			input: "\uFEFFdata: 1\n\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+		},
+		{
+			name: "bom only at the start",
+			input: "data: 1\n\n\uFEFFdata: 2\n\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+		},
+		{
+			name: "data without space",
+			input: "data:1\n\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+		},
+		{
+			name: "only one space is stripped",
+			input: "data:  1 \n\n",
+			want: []SseEvent{{Type: "message", Data: " 1 "}},
+		},
+		{
+			name: "multi-line data",
+			input: "data: {\"a\":\ndata: 1}\n\n",
+			want: []SseEvent{{Type: "message", Data: "{\"a\":\n1}"}},
+		},
+		{
+			name: "empty data",
+			input: "data:\n\ndata\n\n",
+			want: []SseEvent{{Type: "message", Data: ""}, {Type: "message", Data: ""}},
+		},
+		{
+			name: "empty data lines are kept",
+			input: "data: 1\ndata:\ndata: 2\n\n",
+			want: []SseEvent{{Type: "message", Data: "1\n\n2"}},
+		},
+		{
+			name: "no data is not dispatched",
+			input: "event: ping\n\nid: 1\n\n",
+			want: []SseEvent{},
+		},
+		{
+			name: "event resets after dispatch",
+			input: "event: a\ndata: 1\n\ndata: 2\n\nevent: b\n\ndata: 3\n\n",
+			want: []SseEvent{{Type: "a", Data: "1"}, {Type: "message", Data: "2"}, {Type: "message", Data: "3"}},
+		},
+		{
+			name: "comments",
+			input: ": keep-alive\ndata: 1\n:\n\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+		},
+		{
+			name: "unknown fields",
+			input: "foo: bar\ndata: 1\nDATA: 2\n\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+		},
+		{
+			name: "id is kept across events",
+			input: "id: 1\ndata: a\n\ndata: b\n\nid\ndata: c\n\n",
+			want: []SseEvent{
+				{Type: "message", Data: "a", LastEventId: "1"},
+				{Type: "message", Data: "b", LastEventId: "1"},
+				{Type: "message", Data: "c", LastEventId: ""},
+			},
+		},
+		{
+			name: "id containing nul is ignored",
+			input: "id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n",
+			want: []SseEvent{{Type: "message", Data: "a", LastEventId: "1"}, {Type: "message", Data: "b", LastEventId: "1"}},
+		},
+		{
+			name: "retry",
+			input: "retry: 1500\ndata: 1\n\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+			retry: 1500 * time.Millisecond,
+		},
+		{
+			name: "retry that is not a number",
+			input: "retry: 1000\nretry: abc\nretry: 1.5\nretry: -1\nretry: +2\nretry: 3s\nretry:\ndata: 1\n\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+			retry: time.Second,
+		},
+		{
+			name: "trailing event without blank line is discarded",
+			input: "data: 1\n\ndata: 2",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+		},
+		{
+			name: "trailing event with a single line end is discarded",
+			input: "data: 1\n\ndata: 2\n",
+			want: []SseEvent{{Type: "message", Data: "1"}},
+		},
+		{
+			name: "empty stream",
+			input: "",
+			want: []SseEvent{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Byte by byte too, line ends split across reads must not change anything
+			readers := map[string]io.Reader{
+				"whole": strings.NewReader(c.input),
+				"bytes": iotest.OneByteReader(strings.NewReader(c.input)),
+			}
+			for readerName, reader := range readers {
+				events, decoder, err := decodeAll(reader)
+				if err != nil {
+					t.Fatalf("%s: unexpected error %v", readerName, err)
+				}
+				if !slices.Equal(events, c.want) {
+					t.Errorf("%s: got %q, want %q", readerName, events, c.want)
+				}
+				if decoder.Retry() != c.retry {
+					t.Errorf("%s: retry %v, want %v", readerName, decoder.Retry(), c.retry)
+				}
+			}
+		})
+	}
+}
+
+// The empty line that ends an event must dispatch it without waiting for the next byte
+func TestSseDecoderDoesNotWaitAfterCR(t *testing.T) {
+	for _, input := range []string{"data: 1\r\r", "data: 1\r\n\r"} {
+		r, w := io.Pipe()
+		go w.Write([]byte(input))
+
+		decoder := NewSseDecoder(r)
+		done := make(chan SseEvent)
+		go func() {
+			event, _ := decoder.Next()
+			done <- event
+		}()
+
+		select {
+		case event := <-done:
+			if event.Data != "1" {
+				t.Errorf("%q: got %q", input, event.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%q: event not dispatched until more data comes", input)
+		}
+		w.Close()
+	}
+}
+
+func FuzzSseDecoder(f *testing.F) {
+	for _, seed := range []string{
+		"data: 1\n\n",
+		"event: a\r\ndata: 1\r\n\r\n",
+		"\uFEFFid: 1\rdata:\rdata\r\r",
+		"retry: 10\n: comment\ndata: x\n\ndata: y",
+		"id: \x00\ndata: \r\n\r",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		events, _, err := decodeAll(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		for _, event := range events {
+			if event.Type == "" {
+				t.Fatalf("event without a type in %q", input)
+			}
+			if strings.ContainsRune(event.LastEventId, '\x00') {
+				t.Fatalf("id with a nul in %q", input)
+			}
+			if strings.ContainsAny(event.Type, "\r\n") || strings.ContainsRune(event.Data, '\r') {
+				t.Fatalf("line end left in %q", input)
+			}
+		}
+
+		split, _, err := decodeAll(iotest.OneByteReader(strings.NewReader(input)))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !slices.Equal(events, split) {
+			t.Fatalf("%q decodes differently byte by byte: %q, %q", input, events, split)
+		}
+	})
+}
+
+// Flushes every chunk on its own, so that lines and line ends are split across reads
+func chunkedSseHandler(chunks []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+}
+
+func TestStartSseRequest(t *testing.T) {
+	parser := errorParser{classifyOpenaiError, "TEST_API_KEY"}
+
+	cases := []struct {
+		name string
+		// One response per attempt, the last one is repeated
+		handlers []http.HandlerFunc
+		want []SseEvent
+		retries int
+		wantKind ErrorKind
+		wantErr error
+	}{
+		{
+			name: "chunks split mid-line",
+			handlers: []http.HandlerFunc{chunkedSseHandler([]string{
+				"da", "ta: hel", "lo\r", "\n\r", "\nevent: done\nda", "ta: [DONE]\n", "\n",
+			})},
+			want: []SseEvent{{Type: "message", Data: "hello"}, {Type: "done", Data: "[DONE]"}},
+		},
+		{
+			name: "cr only split mid-line",
+			handlers: []http.HandlerFunc{chunkedSseHandler([]string{"data: 1\r", "\r", "data", ": 2\r\r"})},
+			want: []SseEvent{{Type: "message", Data: "1"}, {Type: "message", Data: "2"}},
+		},
+		{
+			name: "retried until it works",
+			handlers: []http.HandlerFunc{
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				},
+				chunkedSseHandler([]string{"data: 1\n\n"}),
+			},
+			want: []SseEvent{{Type: "message", Data: "1"}},
+			retries: 1,
+		},
+		{
+			name: "gives up after the last attempt",
+			handlers: []http.HandlerFunc{
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(`{"error": {"message": "oops"}}`))
+				},
+			},
+			retries: 2,
+			wantKind: ErrorKindUnknown,
+		},
+		{
+			name: "not retried when out of credits",
+			handlers: []http.HandlerFunc{
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusTooManyRequests)
+					w.Write([]byte(`{"error": {"code": "insufficient_quota", "message": "no"}}`))
+				},
+			},
+			wantKind: ErrorKindQuota,
+		},
+		{
+			name: "not an event stream",
+			handlers: []http.HandlerFunc{
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(`{}`))
+				},
+			},
+			wantErr: ErrContentTypeNotEventStream,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attempt := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != "{}" {
+					t.Errorf("attempt %d sent %q", attempt, body)
+				}
+				c.handlers[min(attempt, len(c.handlers) - 1)](w, r)
+				attempt += 1
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequestWithContext(t.Context(), "POST", server.URL, strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			retries := 0
+			params := StreamingRequestParams{
+				Retry: testRetryPolicy(),
+				OnRetry: func(info RetryInfo) { retries += 1 },
+			}
+
+			reader, err := startSseRequest(req, &params, parser)
+			if retries != c.retries {
+				t.Errorf("%d retries, want %d", retries, c.retries)
+			}
+			if c.want == nil {
+				if err == nil {
+					reader.Close()
+					t.Fatal("no error")
+				}
+				if c.wantErr != nil && !errors.Is(err, c.wantErr) {
+					t.Errorf("got %v, want %v", err, c.wantErr)
+				}
+				if c.wantErr == nil && ErrorKindOf(err) != c.wantKind {
+					t.Errorf("got %s, want %s", ErrorKindToString(ErrorKindOf(err)), ErrorKindToString(c.wantKind))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			defer reader.Close()
+
+			events := []SseEvent{}
+			for {
+				event, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				events = append(events, event)
+			}
+			if !slices.Equal(events, c.want) {
+				t.Errorf("got %q, want %q", events, c.want)
+			}
+		})
+	}
+}
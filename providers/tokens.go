@@ -0,0 +1,104 @@
+package providers
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"unicode/utf8"
+)
+
+// Context window, input and output together, of the models in the default catalog. The config file may set others
+var knownContextWindows = map[string]int {
+	"gpt-5-nano": 400_000,
+	"gpt-5.2": 400_000,
+	"claude-haiku-4-5": 200_000,
+	"claude-sonnet-4-5": 200_000,
+	"gemini-2.0-flash-lite": 1_048_576,
+	"gemini-2.5-flash": 1_048_576,
+	"grok-4-1-fast-non-reasoning": 2_000_000,
+	"grok-4-1-fast-reasoning": 2_000_000,
+}
+
+// 0 when the model isn't known
+func KnownContextWindow(model string) int {
+	return knownContextWindows[model]
+}
+
+// Role markers and separators every message costs
+const messageTokenOverhead int = 4
+
+// What a model is charged for an image it can't be measured, Anthropic's ceiling for a single image
+const maxImageTokens int = 1600
+
+// Between what OpenAI and Anthropic charge, text and picture of the page included
+const pdfPageTokens int = 2000
+
+// Local estimate, good enough to know when a conversation gets close to the limit without asking the provider.
+// English and code average about 4 bytes per token, other scripts are closer to a token per character
+func EstimateTextTokens(text string) int {
+	ascii := 0
+	other := 0
+	for i := 0; i < len(text); {
+		if text[i] < utf8.RuneSelf {
+			ascii += 1
+			i += 1
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		other += 1
+		i += size
+	}
+	return (ascii + 3) / 4 + other
+}
+
+// Anthropic's (width * height) / 750, capped like it resizes big images
+func estimateImageTokens(data []byte) int {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// e.g. WebP, no decoder in the standard library
+		return maxImageTokens
+	}
+	return min(maxImageTokens, max(1, config.Width * config.Height / 750))
+}
+
+func estimatePdfTokens(data []byte) int {
+	// "/Type /Pages" is the page tree, not a page
+	pages := bytes.Count(data, []byte("/Type /Page")) - bytes.Count(data, []byte("/Type /Pages"))
+	pages += bytes.Count(data, []byte("/Type/Page")) - bytes.Count(data, []byte("/Type/Pages"))
+	return max(1, pages) * pdfPageTokens
+}
+
+// Images have to be decoded and PDFs scanned, callers should keep the result around
+func EstimatePartTokens(part MessagePart) int {
+	switch part.Type {
+	case PartText:
+		return EstimateTextTokens(part.Text)
+	case PartImage:
+		return estimateImageTokens(part.Data)
+	case PartDocument:
+		return estimatePdfTokens(part.Data)
+	default:
+		return 0
+	}
+}
+
+func EstimateMessageTokens(msg AgnosticConversationMessage) int {
+	tokens := messageTokenOverhead + EstimateTextTokens(msg.Content)
+	if msg.ToolCall != nil {
+		tokens += EstimateTextTokens(msg.ToolCall.Name) + EstimateTextTokens(msg.ToolCall.Arguments)
+	}
+	for _, part := range msg.Parts {
+		tokens += EstimatePartTokens(part)
+	}
+	return tokens
+}
+
+func EstimateTokens(msgs []AgnosticConversationMessage) int {
+	tokens := 0
+	for _, msg := range msgs {
+		tokens += EstimateMessageTokens(msg)
+	}
+	return tokens
+}
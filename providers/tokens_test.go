@@ -0,0 +1,74 @@
+package providers
+
+import (
+	"bytes"
+	"image"
+	"testing"
+	"image/png"
+)
+
+func TestEstimateTextTokens(t *testing.T) {
+	cases := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"Hello, world!", 4},
+		// A token per character for other scripts
+		{"日本語", 3},
+		{"héllo", 2},
+		{"🙂🙂", 2},
+		// Invalid UTF-8 counts as a character per byte
+		{"\xff\xfe", 2},
+	}
+	for _, c := range cases {
+		if got := EstimateTextTokens(c.text); got != c.want {
+			t.Errorf("%q: got %d, want %d", c.text, got, c.want)
+		}
+	}
+}
+
+func TestEstimatePartTokens(t *testing.T) {
+	encode := func(width int, height int) []byte {
+		buf := bytes.Buffer{}
+		png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)))
+		return buf.Bytes()
+	}
+	pdf := []byte("%PDF-1.4\n1 0 obj << /Type /Pages /Count 2 >>\n2 0 obj << /Type /Page >>\n3 0 obj <</Type/Page>>\n")
+
+	cases := []struct {
+		name string
+		part MessagePart
+		want int
+	}{
+		{"text", MessagePart{Type: PartText, Text: "abcdefgh"}, 2},
+		{"small image", MessagePart{Type: PartImage, Data: encode(75, 100)}, 10},
+		{"big image is capped", MessagePart{Type: PartImage, Data: encode(2000, 2000)}, maxImageTokens},
+		{"image that can't be decoded", MessagePart{Type: PartImage, Data: []byte("RIFF....WEBP")}, maxImageTokens},
+		{"pdf pages", MessagePart{Type: PartDocument, Data: pdf}, 2 * pdfPageTokens},
+		{"pdf without pages", MessagePart{Type: PartDocument, Data: []byte("%PDF-1.4")}, pdfPageTokens},
+	}
+	for _, c := range cases {
+		if got := EstimatePartTokens(c.part); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestEstimateMessageTokens(t *testing.T) {
+	msg := AgnosticConversationMessage{
+		Type: MessageTypeToolCall,
+		Content: "abcd",
+		ToolCall: &ToolCall{Name: "read", Arguments: `{"a":1}`},
+		Parts: []MessagePart{{Type: PartText, Text: "abcd"}},
+	}
+	if got, want := EstimateMessageTokens(msg), messageTokenOverhead + 1 + 1 + 2 + 1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := EstimateTokens([]AgnosticConversationMessage{msg, msg}), 2 * EstimateMessageTokens(msg); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+// Conversations persisted on disk so they can be resumed later on
+
+package session
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"errors"
+	"strings"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/adrg/xdg"
+
+	"github.com/hello-llm-2/providers"
+)
+
+var (
+	ErrSessionNotFound error = errors.New("Session not found")
+	ErrNoSessions error = errors.New("No session has been saved yet")
+)
+
+type Session struct {
+	Id string `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Provider string `json:"provider"`
+	// Active branch of the conversation, the one resumed by older versions. Without the data of images and
+	// PDFs, Nodes and Attachments have it
+	Messages []providers.AgnosticConversationMessage `json:"messages"`
+	// Whole conversation tree, with edited and regenerated messages
+	Nodes []Node `json:"nodes,omitempty"`
+	// Index in Nodes of the last message of the active branch
+	Head int `json:"head"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// A file attached to the conversation, Messages has it too but only as sent to the provider
+type Attachment struct {
+	Path string `json:"path"`
+	Content string `json:"content"`
+	MimeType string `json:"mime_type,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+type Node struct {
+	Message providers.AgnosticConversationMessage `json:"message"`
+	// Index in Nodes, -1 for messages starting the conversation
+	Parent int `json:"parent"`
+}
+
+// Sessions are stored in $XDG_DATA_HOME/hello-llm/sessions
+func Dir() string {
+	return filepath.Join(xdg.DataHome, "hello-llm", "sessions")
+}
+
+func New(provider string) *Session {
+	now := time.Now()
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+
+	return &Session {
+		Id: now.Format("20060102-150405") + "-" + hex.EncodeToString(suffix),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Provider: provider,
+		Messages: nil,
+	}
+}
+
+func (s *Session) path() string {
+	return filepath.Join(Dir(), s.Id + ".json")
+}
+
+// Returns the first user prompt of the session, useful to give a glimpse of what it is about
+func (s *Session) Title() string {
+	for _, msg := range s.Messages {
+		if msg.Type == providers.MessageTypeUser {
+			title := strings.ReplaceAll(msg.Content, "\n", " ")
+			if len([]rune(title)) > 60 {
+				title = string([]rune(title)[:60]) + "..."
+			}
+			return title
+		}
+	}
+	return ""
+}
+
+// Writes the session to disk, the file is written next to the destination then renamed so a crash never leaves a half written session
+func (s *Session) Save() error {
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return err
+	}
+
+	s.UpdatedAt = time.Now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path())
+}
+
+func Load(id string) (*Session, error) {
+	// Ids never contain path separators, don't let the user wander around the filesystem
+	if id == "" || strings.ContainsAny(id, "/\\") {
+		return nil, ErrSessionNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(Dir(), id + ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &Session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Session %s is corrupted: %w", id, err)
+	}
+	return s, nil
+}
+
+// Returns every readable session, most recently updated first
+func List() ([]*Session, error) {
+	entries, err := os.ReadDir(Dir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0, len(entries))
+	for _, entry := range entries {
+		id, found := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !found {
+			continue
+		}
+
+		s, err := Load(id)
+		if err != nil {
+			// A single broken file shouldn't prevent listing the others
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+	})
+	return sessions, nil
+}
+
+func Last() (*Session, error) {
+	sessions, err := List()
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, ErrNoSessions
+	}
+	return sessions[0], nil
+}
@@ -0,0 +1,19 @@
+package tools
+
+import (
+	"time"
+	"context"
+
+	"github.com/hello-llm-2/providers"
+)
+
+// Models have no clue what day it is
+var CurrentDatetime Tool = Tool {
+	Definition: providers.ToolDefinition {
+		Name: "current_datetime",
+		Description: "Returns the current local date, time and timezone of the user's machine",
+	},
+	Run: func(_ context.Context, _ string) (string, error) {
+		return time.Now().Format("Monday 2006-01-02 15:04:05 MST (-07:00)"), nil
+	},
+}
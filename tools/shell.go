@@ -0,0 +1,133 @@
+package tools
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"os/exec"
+	"strings"
+	"encoding/json"
+
+	"github.com/hello-llm-2/providers"
+)
+
+// Past that, output is cut. Nobody wants to send a whole `find /` to the model
+const shellOutputLimit int = 16 * 1024
+
+type ShellSettings struct {
+	// Commands (or command prefixes such as "git status") that run without asking the user
+	Allowlist []string
+	Timeout time.Duration
+}
+
+type shellArguments struct {
+	Command string `json:"command"`
+}
+
+func parseShellArguments(arguments string) (shellArguments, error) {
+	args := shellArguments{}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return args, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Command) == "" {
+		return args, errors.New("command is empty")
+	}
+	return args, nil
+}
+
+// Anything able to chain or redirect commands disqualifies the command from the allowlist
+func (s ShellSettings) allowed(command string) bool {
+	command = strings.TrimSpace(command)
+	if strings.ContainsAny(command, ";&|`$<>(){}\n\\") {
+		return false
+	}
+
+	for _, entry := range s.Allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if command == entry || strings.HasPrefix(command, entry + " ") {
+			return true
+		}
+	}
+	return false
+}
+
+func truncateOutput(output []byte) string {
+	if len(output) <= shellOutputLimit {
+		return string(output)
+	}
+	return fmt.Sprintf("%s\n[... %d bytes truncated]", output[:shellOutputLimit], len(output) - shellOutputLimit)
+}
+
+func NewShellTool(settings ShellSettings) Tool {
+	return Tool {
+		Definition: providers.ToolDefinition {
+			Name: "run_shell_command",
+			Description: "Runs a command with `sh -c` on the user's machine and returns its exit code, stdout and stderr. The user may reject or edit the command before it runs.",
+			Parameters: map[string]any {
+				"type": "object",
+				"properties": map[string]any {
+					"command": map[string]any {
+						"type": "string",
+						"description": "The shell command to run",
+					},
+				},
+				"required": []string{"command"},
+			},
+		},
+		Confirmation: func(arguments string) string {
+			args, err := parseShellArguments(arguments)
+			if err != nil {
+				// Let it fail without bothering the user
+				return ""
+			}
+			if settings.allowed(args.Command) {
+				return ""
+			}
+			return args.Command
+		},
+		FromConfirmation: func(edited string) string {
+			args, _ := json.Marshal(shellArguments{Command: edited})
+			return string(args)
+		},
+		Run: func(ctx context.Context, arguments string) (string, error) {
+			args, err := parseShellArguments(arguments)
+			if err != nil {
+				return "", err
+			}
+
+			cmdCtx, cancel := context.WithTimeout(ctx, settings.Timeout)
+			defer cancel()
+
+			var stdout, stderr bytes.Buffer
+			cmd := exec.CommandContext(cmdCtx, "sh", "-c", args.Command)
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			// Children may keep the pipes open after sh is killed
+			cmd.WaitDelay = time.Second
+
+			err = cmd.Run()
+			exitCode := 0
+			var exitErr *exec.ExitError
+			switch {
+			case errors.Is(cmdCtx.Err(), context.DeadlineExceeded):
+				return "", fmt.Errorf("command timed out after %s", settings.Timeout)
+			case errors.As(err, &exitErr):
+				exitCode = exitErr.ExitCode()
+			case err != nil:
+				return "", err
+			}
+
+			return fmt.Sprintf(
+				"exit code: %d\nstdout:\n%s\nstderr:\n%s",
+				exitCode,
+				truncateOutput(stdout.Bytes()),
+				truncateOutput(stderr.Bytes()),
+				), nil
+		},
+	}
+}
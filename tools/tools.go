@@ -0,0 +1,88 @@
+// Go functions the model can ask to run
+
+package tools
+
+import (
+	"fmt"
+	"context"
+
+	"github.com/hello-llm-2/providers"
+)
+
+type Tool struct {
+	Definition providers.ToolDefinition
+	// Arguments is the raw JSON object produced by the model
+	Run func(ctx context.Context, arguments string) (string, error)
+	// Optional, returns what the user has to approve before the call runs. Empty when no approval is needed
+	Confirmation func(arguments string) string
+	// Optional, rebuilds the arguments from an edited confirmation text. The user can't edit the call when nil
+	FromConfirmation func(edited string) string
+}
+
+type Registry struct {
+	tools []Tool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Registering a tool with an already used name replaces the previous one
+func (r *Registry) Register(tool Tool) {
+	for i := range r.tools {
+		if r.tools[i].Definition.Name == tool.Definition.Name {
+			r.tools[i] = tool
+			return
+		}
+	}
+	r.tools = append(r.tools, tool)
+}
+
+func (r *Registry) Find(name string) (Tool, bool) {
+	for _, tool := range r.tools {
+		if tool.Definition.Name == name {
+			return tool, true
+		}
+	}
+	return Tool{}, false
+}
+
+func (r *Registry) Definitions() []providers.ToolDefinition {
+	defs := make([]providers.ToolDefinition, 0, len(r.tools))
+	for _, tool := range r.tools {
+		defs = append(defs, tool.Definition)
+	}
+	return defs
+}
+
+// Always returns something to send back to the model, errors included so it can correct itself
+func (r *Registry) Run(ctx context.Context, call providers.ToolCall) string {
+	tool, found := r.Find(call.Name)
+	if !found {
+		return fmt.Sprintf("Error: there is no tool named %q", call.Name)
+	}
+
+	output, err := tool.Run(ctx, call.Arguments)
+	if err != nil {
+		return fmt.Sprintf("Error: %s", err)
+	}
+	return output
+}
+
+// Returns the text the user must approve before running the call, empty if it can run right away
+func (r *Registry) Confirmation(call providers.ToolCall) (text string, editable bool) {
+	tool, found := r.Find(call.Name)
+	if !found || tool.Confirmation == nil {
+		return "", false
+	}
+	return tool.Confirmation(call.Arguments), tool.FromConfirmation != nil
+}
+
+// Applies the user's edit to the call arguments
+func (r *Registry) Edit(call providers.ToolCall, edited string) providers.ToolCall {
+	tool, found := r.Find(call.Name)
+	if found && tool.FromConfirmation != nil {
+		call.Arguments = tool.FromConfirmation(edited)
+	}
+	return call
+}
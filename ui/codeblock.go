@@ -0,0 +1,114 @@
+// A fenced code block, lines are never wrapped so the code can be read as written, what doesn't fit is clipped
+
+package ui
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+type CodeBlockParams struct {
+	UseColor bool
+	Selected bool
+}
+
+type CodeBlock struct {
+	language string
+	code string
+	params CodeBlockParams
+	lines [][]styledRune
+	linesBuilt bool
+}
+
+func NewCodeBlock(language string, code string, params CodeBlockParams) *CodeBlock {
+	return &CodeBlock{
+		language: language,
+		code: code,
+		params: params,
+	}
+}
+
+func (block *CodeBlock) baseStyle() tcell.Style {
+	if block.params.UseColor {
+		return tcell.StyleDefault.Background(tcell.ColorBlack).Foreground(tcell.ColorWhite)
+	}
+	return tcell.StyleDefault
+}
+
+func (block *CodeBlock) headerStyle() tcell.Style {
+	if block.params.Selected {
+		return tcell.StyleDefault.Reverse(true)
+	}
+	return tcell.StyleDefault.Dim(true)
+}
+
+func (block *CodeBlock) BuildLines() {
+	hl := highlighter{
+		syntax: findSyntax(block.language),
+		styles: newHighlightStyles(block.baseStyle(), block.params.UseColor),
+	}
+
+	header := block.language
+	if header == "" {
+		header = "code"
+	}
+	if block.params.Selected {
+		header = "▶ " + header + " · Ctrl-Y copy"
+	}
+
+	block.lines = [][]styledRune{styledString(header, block.headerStyle())}
+	for _, line := range strings.Split(strings.TrimSuffix(block.code, "\n"), "\n") {
+		line = strings.ReplaceAll(line, "\t", "    ")
+		block.lines = append(block.lines, append(styledString(" ", block.baseStyle()), hl.line(line)...))
+	}
+	block.linesBuilt = true
+}
+
+func (block *CodeBlock) ComputeHeight(screen tcell.Screen, availableVoidSpace int) int {
+	if !block.linesBuilt {
+		block.BuildLines()
+	}
+	return len(block.lines)
+}
+
+func (block *CodeBlock) HeightMode() int {
+	return HeightFit
+}
+
+func (block *CodeBlock) Draw(screen tcell.Screen, y int) {
+	screenW, _ := screen.Size()
+
+	if !block.linesBuilt {
+		block.BuildLines()
+	}
+
+	for i, line := range block.lines {
+		lineY := y + i
+		if lineY < 0 {
+			continue
+		}
+
+		fill := block.baseStyle()
+		if i == 0 {
+			fill = block.headerStyle()
+		}
+
+		x := 0
+		for j, sr := range line {
+			w := runewidth.RuneWidth(sr.r)
+			// Keep the last column for the marker if anything is left after this rune
+			if x + w > screenW || (x + w == screenW && j < len(line) - 1) {
+				screen.SetContent(screenW - 1, lineY, '›', nil, fill.Reverse(true))
+				x = screenW
+				break
+			}
+			screen.SetContent(x, lineY, sr.r, nil, sr.style)
+			x += w
+		}
+		for ; x < screenW; x++ {
+			screen.SetContent(x, lineY, ' ', nil, fill)
+		}
+	}
+}
@@ -3,44 +3,63 @@ package ui
 import (
 	"strings"
 	"fmt"
+	"time"
 	"github.com/gdamore/tcell/v2"
 	"github.com/hello-llm-2/providers"
 )
 
-func BuildChatHistory(messages []providers.AgnosticConversationMessage, currentResponse string, useColor bool) *VerticalStack {
+// Which version of a message is shown, Count is 1 for messages that were never edited nor regenerated
+type BranchPosition struct {
+	Index int
+	Count int
+}
+
+func branchLabel(branch BranchPosition) string {
+	return fmt.Sprintf("‹ %d/%d › Alt-Left/Right", branch.Index + 1, branch.Count)
+}
+
+// branches is indexed like messages, selectedCodeBlock indexes the blocks returned by ChatCodeBlocks, -1 when none is selected
+func BuildChatHistory(messages []providers.AgnosticConversationMessage, branches []BranchPosition, currentResponse string, selectedCodeBlock int, useColor bool) *VerticalStack {
 	// Overallocating here
 	elements := make([]StackElement, 0, len(messages) + 1)
+	codeBlockIdx := 0
+
+	appendMarkdown := func(content string) {
+		for _, segment := range SplitMarkdown(content) {
+			if segment.Code {
+				elements = append(elements, NewCodeBlock(segment.Language, segment.Content, CodeBlockParams{
+					UseColor: useColor,
+					Selected: codeBlockIdx == selectedCodeBlock,
+				}))
+				codeBlockIdx += 1
+			} else {
+				elements = append(elements, NewMarkdown(segment.Content, MarkdownParams{UseColor: useColor}))
+			}
+		}
+	}
 
-	builder := strings.Builder{}
-	for _, msg := range messages {
+	for i, msg := range messages {
 		params := TextParams{}
 
+		if i < len(branches) && branches[i].Count > 1 && msg.Type != providers.MessageTypeUserContext {
+			elements = append(elements, NewText(branchLabel(branches[i]) + "\n", TextParams{ColorForeground: tcell.ColorGray}))
+		}
+
 		switch msg.Type {
+		case providers.MessageTypeAssistant:
+			appendMarkdown(msg.Content)
 		case providers.MessageTypeUser:
 			if useColor {
 				params.ColorForeground = tcell.ColorDarkCyan
 			}
-			builder.WriteString("> ")
-		case providers.MessageTypeUserContext, providers.MessageTypeSystem:
-			continue
+			elements = append(elements, NewText("> " + msg.Content + "\n", params))
+		case providers.MessageTypeToolCall:
+			params.ColorForeground = tcell.ColorGray
+			elements = append(elements, NewText(fmt.Sprintf("⚙ %s %s\n", msg.ToolCall.Name, msg.ToolCall.Arguments), params))
 		}
-
-		builder.WriteString(msg.Content)
-		builder.WriteByte('\n')
-
-		elements = append(
-			elements,
-			NewText(builder.String(), params),
-			)
-		builder.Reset()
 	}
 
-	if currentResponse != "" {
-		elements = append(
-			elements,
-			NewText(currentResponse, TextParams{}),
-			)
-	}
+	appendMarkdown(currentResponse)
 
 	return NewVerticalStack(
 		elements,
@@ -48,27 +67,128 @@ func BuildChatHistory(messages []providers.AgnosticConversationMessage, currentR
 		)
 }
 
-func BuildFifoFileUiElement(pipedContent string, pipePath string, pipeFailure bool) *Text {
-	if pipeFailure {
-		return NewText(
-			"Not listening to FIFO file... It is not possible to add context to this conversation. I'll implement error message another day 😴",
-			TextParams{
-				Color: tcell.ColorDarkOrange,
-				ColorForeground: tcell.ColorBlack,
-			})
-	} else {
-		if pipedContent == "" {
-			pipedContent = fmt.Sprintf("FIFO file listening. Writing to \"%s\" will add context to the conversation", pipePath)
-		} else if len(pipedContent) > 30 {
-			pipedContent = pipedContent[:30]+"..."
+// What the context slots list needs to know about a slot
+type ContextSlotInfo struct {
+	Name string
+	Path string
+	Label string
+	Size int
+	// Empty when the slot is listening
+	Failure string
+}
+
+func formatByteSize(size int) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024 * 1024:
+		return fmt.Sprintf("%.1f KB", float64(size) / 1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(size) / (1024 * 1024))
+	}
+}
+
+// One line per slot, those holding context show its size and will be sent with the next prompt
+func BuildContextSlotsUiElement(slots []ContextSlotInfo) *Text {
+	if len(slots) == 0 {
+		return nil
+	}
+
+	content := strings.Builder{}
+	failed := false
+	for i, slot := range slots {
+		if i > 0 {
+			content.WriteByte('\n')
 		}
-		return NewText(
-			pipedContent,
-			TextParams{
-				Color: tcell.ColorDarkBlue,
-				ColorForeground: tcell.ColorWhite,
-			})
+		switch {
+		case slot.Failure != "":
+			failed = true
+			content.WriteString(fmt.Sprintf("⨯ %s: not listening, %s", slot.Name, slot.Failure))
+		case slot.Size == 0:
+			content.WriteString(fmt.Sprintf("◦ %s: writing to \"%s\" adds context to the conversation", slot.Name, slot.Path))
+		case slot.Label != "":
+			content.WriteString(fmt.Sprintf("● %s: %s, %s", slot.Name, slot.Label, formatByteSize(slot.Size)))
+		default:
+			content.WriteString(fmt.Sprintf("● %s: %s", slot.Name, formatByteSize(slot.Size)))
+		}
+	}
+
+	params := TextParams{
+		Color: tcell.ColorDarkBlue,
+		ColorForeground: tcell.ColorWhite,
+	}
+	if failed {
+		params.Color = tcell.ColorDarkOrange
+		params.ColorForeground = tcell.ColorBlack
+	}
+	return NewText(content.String(), params)
+}
+
+type AttachmentInfo struct {
+	Path string
+	Size int
+}
+
+// A single line, /attach lists them one per line
+func BuildAttachmentsUiElement(attachments []AttachmentInfo) *Text {
+	if len(attachments) == 0 {
+		return nil
 	}
+
+	files := make([]string, 0, len(attachments))
+	for _, at := range attachments {
+		files = append(files, fmt.Sprintf("%s %s", at.Path, formatByteSize(at.Size)))
+	}
+	return NewText(
+		fmt.Sprintf("+ %d attached: %s", len(attachments), strings.Join(files, ", ")),
+		TextParams{
+			Color: tcell.ColorDarkBlue,
+			ColorForeground: tcell.ColorWhite,
+		})
+}
+
+func BuildNoticeUiElement(notice string) *Text {
+	if notice == "" {
+		return nil
+	}
+	return NewText(
+		notice,
+		TextParams{
+			Color: tcell.ColorDarkGreen,
+			ColorForeground: tcell.ColorWhite,
+		})
+}
+
+// Countdown until a failed request is sent again
+func BuildRetryUiElement(remaining time.Duration, attempt int, maxAttempts int, reason string) *Text {
+	return NewText(
+		fmt.Sprintf("Retrying in %s (attempt %d/%d): %s", remaining.Round(time.Second), attempt, maxAttempts, reason),
+		TextParams{
+			Color: tcell.ColorDarkGoldenrod,
+			ColorForeground: tcell.ColorWhite,
+		})
+}
+
+func BuildHistorySearchUiElement(query string, match string, found bool) *Text {
+	label := "(reverse-i-search)"
+	if !found && query != "" {
+		label = "(failed reverse-i-search)"
+	}
+	return NewText(
+		fmt.Sprintf("%s`%s': %s", label, query, match),
+		TextParams{
+			Color: tcell.ColorDarkSlateBlue,
+			ColorForeground: tcell.ColorWhite,
+		})
+}
+
+func BuildMessageEditUiElement() *Text {
+	return NewText(
+		"Editing a previous message, [Enter] sends it as a new branch  [Esc] cancel",
+		TextParams{
+			Color: tcell.ColorDarkGoldenrod,
+			ColorForeground: tcell.ColorBlack,
+		})
 }
 
 func BuildUserErrorUiElement(userError string) *Text {
@@ -83,3 +203,103 @@ func BuildUserErrorUiElement(userError string) *Text {
 		return nil
 	}
 }
+
+func BuildToolConfirmationUiElement(toolName string, text string, editable bool, editing bool) *Text {
+	content := strings.Builder{}
+	if editing {
+		content.WriteString("Editing, [Enter] approve  [Esc] stop editing\n")
+		content.WriteString(text)
+		content.WriteString("▏")
+	} else {
+		content.WriteString(fmt.Sprintf("The assistant wants to use %s:\n", toolName))
+		content.WriteString(text)
+		content.WriteString("\n[y] approve  [n] reject")
+		if editable {
+			content.WriteString("  [e] edit")
+		}
+	}
+
+	return NewText(
+		content.String(),
+		TextParams{
+			Color: tcell.ColorDarkGoldenrod,
+			ColorForeground: tcell.ColorBlack,
+		})
+}
+
+func formatTokenCount(count int) string {
+	if count < 1000 {
+		return fmt.Sprintf("%d", count)
+	}
+	return fmt.Sprintf("%.1fk", float64(count) / 1000)
+}
+
+// Estimated size of the next request against the model's context window
+type ContextGauge struct {
+	Tokens int
+	// 0 when unknown, only the estimate is shown then
+	Window int
+	// Oldest turns left out of the request
+	Dropped int
+	Summarized bool
+}
+
+const contextGaugeWidth int = 10
+
+// Past that, the oldest turns are about to be summarized or left out
+const contextGaugeWarning float64 = 0.8
+
+func (g ContextGauge) String() string {
+	status := strings.Builder{}
+	if g.Window == 0 {
+		status.WriteString(fmt.Sprintf("ctx ~%s", formatTokenCount(g.Tokens)))
+	} else {
+		ratio := min(1, float64(g.Tokens) / float64(g.Window))
+		filled := int(ratio * float64(contextGaugeWidth) + 0.5)
+		status.WriteString(fmt.Sprintf(
+			"ctx %s%s %d%% of %s",
+			strings.Repeat("▰", filled),
+			strings.Repeat("▱", contextGaugeWidth - filled),
+			int(ratio * 100),
+			formatTokenCount(g.Window),
+			))
+	}
+	if g.Summarized {
+		status.WriteString(", oldest turns summarized")
+	}
+	if g.Dropped > 0 {
+		status.WriteString(fmt.Sprintf(", %d turns left out", g.Dropped))
+	}
+	return status.String()
+}
+
+func BuildStatusLine(provider string, model string, usage providers.Usage, cost float64, costKnown bool, gauge ContextGauge) *Text {
+	status := strings.Builder{}
+	status.WriteString(provider)
+	if model != "" {
+		status.WriteString(" · " + model)
+	}
+	status.WriteString(fmt.Sprintf(
+		" · %s in (%s cached) / %s out",
+		formatTokenCount(usage.InputTokens),
+		formatTokenCount(usage.CachedTokens),
+		formatTokenCount(usage.OutputTokens),
+		))
+	if costKnown {
+		status.WriteString(fmt.Sprintf(" · $%.4f", cost))
+	} else {
+		status.WriteString(fmt.Sprintf(" · ≥ $%.4f (unknown model price)", cost))
+	}
+	status.WriteString(" · " + gauge.String())
+
+	color := tcell.ColorDarkSlateGray
+	if gauge.Window > 0 && float64(gauge.Tokens) >= contextGaugeWarning * float64(gauge.Window) {
+		color = tcell.ColorDarkGoldenrod
+	}
+	return NewText(
+		status.String(),
+		TextParams{
+			Color: color,
+			ColorForeground: tcell.ColorWhite,
+		})
+}
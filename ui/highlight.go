@@ -0,0 +1,251 @@
+// Good enough syntax highlighting: keywords, strings, numbers and comments, one small table per language
+
+package ui
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+type syntax struct {
+	keywords map[string]bool
+	lineComments []string
+	blockComment [2]string
+	quotes string
+}
+
+func keywordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+var cLikeKeywords = "if else for while do switch case default break continue return goto struct union enum typedef const static void int char float double long short unsigned signed sizeof true false NULL nullptr "
+
+var syntaxes = map[string]*syntax{
+	"go": {
+		keywords: keywordSet("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota string int int64 int32 uint byte rune bool error float64 any"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes: "\"'`",
+	},
+	"python": {
+		keywords: keywordSet("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+		lineComments: []string{"#"},
+		quotes: "\"'",
+	},
+	"javascript": {
+		keywords: keywordSet("async await break case catch class const continue default delete do else export extends finally for function if import in instanceof let new of return static super switch this throw try typeof var void while yield null undefined true false interface type enum implements readonly"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes: "\"'`",
+	},
+	"rust": {
+		keywords: keywordSet("as async await break const continue crate else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while Some None Ok Err"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes: "\"",
+	},
+	"c": {
+		keywords: keywordSet(cLikeKeywords + "class public private protected virtual template typename namespace using new delete auto include define"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes: "\"'",
+	},
+	"java": {
+		keywords: keywordSet(cLikeKeywords + "class public private protected abstract extends final implements import instanceof interface new package super synchronized this throw throws try catch finally boolean var null"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes: "\"'",
+	},
+	"shell": {
+		keywords: keywordSet("if then else elif fi for while until do done case esac in function return export local readonly echo cd exit set unset source"),
+		lineComments: []string{"#"},
+		quotes: "\"'",
+	},
+	"sql": {
+		keywords: keywordSet("select from where insert into values update set delete create table drop alter join left right inner outer on group by order having limit and or not null as distinct union index primary key SELECT FROM WHERE INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AND OR NOT NULL AS DISTINCT UNION INDEX PRIMARY KEY"),
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes: "'\"",
+	},
+	"json": {
+		keywords: keywordSet("true false null"),
+		quotes: "\"",
+	},
+	"yaml": {
+		keywords: keywordSet("true false null yes no"),
+		lineComments: []string{"#"},
+		quotes: "\"'",
+	},
+	"toml": {
+		keywords: keywordSet("true false"),
+		lineComments: []string{"#"},
+		quotes: "\"'",
+	},
+}
+
+var syntaxAliases = map[string]string{
+	"golang": "go",
+	"py": "python",
+	"python3": "python",
+	"js": "javascript",
+	"jsx": "javascript",
+	"ts": "javascript",
+	"tsx": "javascript",
+	"typescript": "javascript",
+	"rs": "rust",
+	"h": "c",
+	"cpp": "c",
+	"c++": "c",
+	"cc": "c",
+	"hpp": "c",
+	"csharp": "java",
+	"cs": "java",
+	"kotlin": "java",
+	"sh": "shell",
+	"bash": "shell",
+	"zsh": "shell",
+	"console": "shell",
+	"yml": "yaml",
+}
+
+func findSyntax(language string) *syntax {
+	language = strings.ToLower(language)
+	if alias, found := syntaxAliases[language]; found {
+		language = alias
+	}
+	return syntaxes[language]
+}
+
+type highlightStyles struct {
+	text tcell.Style
+	keyword tcell.Style
+	str tcell.Style
+	number tcell.Style
+	comment tcell.Style
+}
+
+func newHighlightStyles(base tcell.Style, useColor bool) highlightStyles {
+	if !useColor {
+		return highlightStyles{
+			text: base,
+			keyword: base.Bold(true),
+			str: base,
+			number: base,
+			comment: base.Dim(true),
+		}
+	}
+	return highlightStyles{
+		text: base,
+		keyword: base.Foreground(tcell.ColorCornflowerBlue).Bold(true),
+		str: base.Foreground(tcell.ColorDarkSeaGreen),
+		number: base.Foreground(tcell.ColorPlum),
+		comment: base.Foreground(tcell.ColorGray).Italic(true),
+	}
+}
+
+// Highlights code line by line, a block comment may span several lines hence the state
+type highlighter struct {
+	syntax *syntax
+	styles highlightStyles
+	inBlockComment bool
+}
+
+func (h *highlighter) line(src string) []styledRune {
+	runes := []rune(src)
+	out := make([]styledRune, 0, len(runes))
+	if h.syntax == nil {
+		return styledString(src, h.styles.text)
+	}
+
+	emit := func(from int, to int, style tcell.Style) {
+		for _, r := range runes[from:to] {
+			out = append(out, styledRune{r, style})
+		}
+	}
+	startsWith := func(i int, s string) bool {
+		return s != "" && strings.HasPrefix(string(runes[i:]), s)
+	}
+
+	i := 0
+	for i < len(runes) {
+		if h.inBlockComment {
+			end := i
+			for end < len(runes) && !startsWith(end, h.syntax.blockComment[1]) {
+				end += 1
+			}
+			if end == len(runes) {
+				emit(i, end, h.styles.comment)
+				return out
+			}
+			end += len([]rune(h.syntax.blockComment[1]))
+			emit(i, end, h.styles.comment)
+			i = end
+			h.inBlockComment = false
+			continue
+		}
+
+		r := runes[i]
+		switch {
+		case startsWith(i, h.syntax.blockComment[0]):
+			h.inBlockComment = true
+			emit(i, i + len([]rune(h.syntax.blockComment[0])), h.styles.comment)
+			i += len([]rune(h.syntax.blockComment[0]))
+		case h.isLineComment(runes, i):
+			emit(i, len(runes), h.styles.comment)
+			return out
+		case strings.ContainsRune(h.syntax.quotes, r):
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				if runes[end] == '\\' {
+					end += 1
+				}
+				end += 1
+			}
+			end = min(end + 1, len(runes))
+			emit(i, end, h.styles.str)
+			i = end
+		case unicode.IsDigit(r):
+			end := i
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || unicode.IsLetter(runes[end]) || runes[end] == '.' || runes[end] == '_') {
+				end += 1
+			}
+			emit(i, end, h.styles.number)
+			i = end
+		case unicode.IsLetter(r) || r == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end += 1
+			}
+			style := h.styles.text
+			if h.syntax.keywords[string(runes[i:end])] {
+				style = h.styles.keyword
+			}
+			emit(i, end, style)
+			i = end
+		default:
+			emit(i, i+1, h.styles.text)
+			i += 1
+		}
+	}
+	return out
+}
+
+// "#" is only a comment when it starts a word, so that $# or a#b in shell aren't
+func (h *highlighter) isLineComment(runes []rune, i int) bool {
+	for _, marker := range h.syntax.lineComments {
+		if !strings.HasPrefix(string(runes[i:]), marker) {
+			continue
+		}
+		if marker == "#" && i > 0 && !unicode.IsSpace(runes[i-1]) {
+			continue
+		}
+		return true
+	}
+	return false
+}
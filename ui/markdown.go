@@ -0,0 +1,404 @@
+// Renders the subset of markdown LLMs actually use: headers, emphasis, lists, quotes and inline code
+// Fenced code blocks are split out by SplitMarkdown and drawn by CodeBlock
+// Unterminated markers are shown as is, which keeps a response that is still streaming readable
+
+package ui
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"github.com/hello-llm-2/providers"
+)
+
+type MarkdownParams struct {
+	HeightMode int
+	UseColor bool
+}
+
+type styledRune struct {
+	r rune
+	style tcell.Style
+}
+
+// A source line once block syntax has been interpreted, wrapped lines repeat contPrefix
+type markdownLine struct {
+	prefix []styledRune
+	contPrefix []styledRune
+	content []styledRune
+	// Style of the space left on the right of the line
+	fill tcell.Style
+	// Horizontal rule, drawn across the screen
+	rule bool
+}
+
+type drawnLine struct {
+	runes []styledRune
+	fill tcell.Style
+}
+
+type Markdown struct {
+	buffer string
+	params MarkdownParams
+	lines []drawnLine
+	linesBuilt bool
+}
+
+type markdownStyles struct {
+	text tcell.Style
+	header tcell.Style
+	code tcell.Style
+	quote tcell.Style
+	bullet tcell.Style
+	dim tcell.Style
+}
+
+func newMarkdownStyles(useColor bool) markdownStyles {
+	s := markdownStyles{
+		text: tcell.StyleDefault,
+		header: tcell.StyleDefault.Bold(true),
+		code: tcell.StyleDefault.Bold(true),
+		quote: tcell.StyleDefault.Italic(true),
+		bullet: tcell.StyleDefault,
+		dim: tcell.StyleDefault.Dim(true),
+	}
+	if useColor {
+		s.header = s.header.Foreground(tcell.ColorGoldenrod)
+		s.code = tcell.StyleDefault.Foreground(tcell.ColorDarkSeaGreen)
+		s.quote = s.quote.Foreground(tcell.ColorSilver)
+		s.bullet = s.bullet.Foreground(tcell.ColorDarkCyan)
+	}
+	return s
+}
+
+func NewMarkdown(content string, params MarkdownParams) *Markdown {
+	return &Markdown{
+		buffer: content,
+		params: params,
+	}
+}
+
+func styledString(s string, style tcell.Style) []styledRune {
+	out := make([]styledRune, 0, len(s))
+	for _, r := range s {
+		out = append(out, styledRune{r, style})
+	}
+	return out
+}
+
+func isFence(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "```")
+}
+
+// A piece of a markdown document, either prose or the content of a fenced code block
+type MarkdownSegment struct {
+	Code bool
+	Language string
+	Content string
+}
+
+// Cuts a document around its fenced code blocks, a block still open (streaming) runs to the end
+func SplitMarkdown(src string) []MarkdownSegment {
+	segments := []MarkdownSegment{}
+	current := MarkdownSegment{}
+	lines := []string{}
+
+	flush := func() {
+		current.Content = strings.Join(lines, "\n")
+		if current.Code || strings.TrimSpace(current.Content) != "" {
+			segments = append(segments, current)
+		}
+		lines = lines[:0]
+	}
+
+	for _, line := range strings.Split(src, "\n") {
+		if !isFence(line) {
+			lines = append(lines, line)
+			continue
+		}
+
+		flush()
+		if current.Code {
+			current = MarkdownSegment{}
+		} else {
+			current = MarkdownSegment{
+				Code: true,
+				Language: strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "```")),
+			}
+		}
+	}
+	flush()
+
+	return segments
+}
+
+// Code blocks of all assistant messages followed by the ones of the response being streamed, in the order BuildChatHistory draws them
+func ChatCodeBlocks(messages []providers.AgnosticConversationMessage, currentResponse string) []MarkdownSegment {
+	blocks := []MarkdownSegment{}
+	contents := []string{}
+	for _, msg := range messages {
+		if msg.Type == providers.MessageTypeAssistant {
+			contents = append(contents, msg.Content)
+		}
+	}
+	contents = append(contents, currentResponse)
+
+	for _, content := range contents {
+		for _, segment := range SplitMarkdown(content) {
+			if segment.Code {
+				blocks = append(blocks, segment)
+			}
+		}
+	}
+	return blocks
+}
+
+func isRule(line string) bool {
+	trimmed := strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+	if len(trimmed) < 3 {
+		return false
+	}
+	return strings.Trim(trimmed, "-") == "" || strings.Trim(trimmed, "*") == "" || strings.Trim(trimmed, "_") == ""
+}
+
+// Returns the list marker ("-", "1." ...) and what follows it, found is false when line isn't a list item
+func cutListMarker(line string) (marker string, rest string, found bool) {
+	for _, bullet := range []string{"- ", "* ", "+ "} {
+		if rest, found := strings.CutPrefix(line, bullet); found {
+			return bullet[:1], rest, true
+		}
+	}
+
+	digits := 0
+	for digits < len(line) && line[digits] >= '0' && line[digits] <= '9' {
+		digits += 1
+	}
+	if digits > 0 && digits < len(line) - 1 && (line[digits] == '.' || line[digits] == ')') && line[digits+1] == ' ' {
+		return line[:digits+1], line[digits+2:], true
+	}
+	return "", line, false
+}
+
+// Turns markdown source into lines with their block level decoration
+func parseMarkdown(src string, styles markdownStyles) []markdownLine {
+	lines := []markdownLine{}
+	for _, line := range strings.Split(strings.Trim(src, "\n"), "\n") {
+		if isRule(line) {
+			lines = append(lines, markdownLine{rule: true, fill: styles.dim})
+			continue
+		}
+
+		trimmed := strings.TrimLeft(line, " \t")
+		indent := strings.Repeat(" ", runewidth.StringWidth(line[:len(line)-len(trimmed)]))
+
+		if level := len(trimmed) - len(strings.TrimLeft(trimmed, "#")); level > 0 && level <= 6 && strings.HasPrefix(trimmed[level:], " ") {
+			header := styles.header
+			if level == 1 {
+				header = header.Underline(true)
+			}
+			lines = append(lines, markdownLine{content: parseInline(strings.TrimSpace(trimmed[level:]), header, styles)})
+			continue
+		}
+
+		if rest, found := strings.CutPrefix(trimmed, ">"); found {
+			rest = strings.TrimPrefix(rest, " ")
+			bar := styledString(indent + "│ ", styles.quote)
+			lines = append(lines, markdownLine{prefix: bar, contPrefix: bar, content: parseInline(rest, styles.quote, styles)})
+			continue
+		}
+
+		if marker, rest, found := cutListMarker(trimmed); found {
+			if marker == "-" || marker == "*" || marker == "+" {
+				marker = "•"
+			}
+			prefix := styledString(indent + marker + " ", styles.bullet)
+			cont := styledString(strings.Repeat(" ", len(prefix)), styles.text)
+			lines = append(lines, markdownLine{prefix: prefix, contPrefix: cont, content: parseInline(rest, styles.text, styles)})
+			continue
+		}
+
+		lines = append(lines, markdownLine{
+			prefix: styledString(indent, styles.text),
+			contPrefix: styledString(indent, styles.text),
+			content: parseInline(trimmed, styles.text, styles),
+		})
+	}
+	return lines
+}
+
+// Underscores inside words (snake_case) are not emphasis
+func isWordRune(runes []rune, i int) bool {
+	return i >= 0 && i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))
+}
+
+// Index of the closing delimiter starting the search at from, -1 when there is none
+func findClosing(runes []rune, from int, delim string) int {
+	d := []rune(delim)
+	for i := from; i + len(d) <= len(runes); i++ {
+		if runes[i] == '\\' {
+			i += 1
+			continue
+		}
+		if string(runes[i:i+len(d)]) != delim {
+			continue
+		}
+		// Emphasis can't close right after a space, "a * b * c" isn't italic
+		if i == from || unicode.IsSpace(runes[i-1]) {
+			continue
+		}
+		if d[0] == '_' && isWordRune(runes, i+len(d)) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func parseInline(src string, base tcell.Style, styles markdownStyles) []styledRune {
+	runes := []rune(src)
+	out := make([]styledRune, 0, len(runes))
+
+	var walk func(start int, end int, style tcell.Style)
+	walk = func(start int, end int, style tcell.Style) {
+		for i := start; i < end; i++ {
+			r := runes[i]
+
+			if r == '\\' && i + 1 < end && strings.ContainsRune("\\`*_#>-[]", runes[i+1]) {
+				out = append(out, styledRune{runes[i+1], style})
+				i += 1
+				continue
+			}
+
+			if r == '`' {
+				closing := -1
+				for j := i + 1; j < end; j++ {
+					if runes[j] == '`' {
+						closing = j
+						break
+					}
+				}
+				if closing != -1 {
+					for _, codeRune := range runes[i+1:closing] {
+						out = append(out, styledRune{codeRune, styles.code})
+					}
+					i = closing
+					continue
+				}
+			}
+
+			if r == '*' || r == '_' {
+				if r == '_' && isWordRune(runes, i-1) {
+					out = append(out, styledRune{r, style})
+					continue
+				}
+
+				delim := string(r)
+				if i + 1 < end && runes[i+1] == r {
+					delim += string(r)
+				}
+				contentStart := i + len(delim)
+				if contentStart < end && !unicode.IsSpace(runes[contentStart]) {
+					if closing := findClosing(runes[:end], contentStart, delim); closing != -1 {
+						inner := style.Italic(true)
+						if len(delim) == 2 {
+							inner = style.Bold(true)
+						}
+						walk(contentStart, closing, inner)
+						i = closing + len(delim) - 1
+						continue
+					}
+				}
+			}
+
+			out = append(out, styledRune{r, style})
+		}
+	}
+	walk(0, len(runes), base)
+
+	return out
+}
+
+func (md *Markdown) BuildLines(screen tcell.Screen) {
+	screenWidth, _ := screen.Size()
+	styles := newMarkdownStyles(md.params.UseColor)
+
+	md.lines = md.lines[:0]
+	for _, line := range parseMarkdown(md.buffer, styles) {
+		if line.rule {
+			md.lines = append(md.lines, drawnLine{runes: styledString(strings.Repeat("─", screenWidth), line.fill)})
+			continue
+		}
+
+		current := append([]styledRune{}, line.prefix...)
+		currentWidth := styledWidth(current)
+		contWidth := styledWidth(line.contPrefix)
+		// A prefix wider than the screen would never let content in
+		if contWidth >= screenWidth {
+			line.contPrefix = nil
+			contWidth = 0
+		}
+
+		for _, sr := range line.content {
+			runeWidth := runewidth.RuneWidth(sr.r)
+			if currentWidth + runeWidth > screenWidth && currentWidth > contWidth {
+				md.lines = append(md.lines, drawnLine{runes: current, fill: line.fill})
+				current = append([]styledRune{}, line.contPrefix...)
+				currentWidth = contWidth
+			}
+			current = append(current, sr)
+			currentWidth += runeWidth
+		}
+		md.lines = append(md.lines, drawnLine{runes: current, fill: line.fill})
+	}
+	md.linesBuilt = true
+}
+
+func styledWidth(runes []styledRune) int {
+	width := 0
+	for _, sr := range runes {
+		width += runewidth.RuneWidth(sr.r)
+	}
+	return width
+}
+
+func (md *Markdown) ComputeHeight(screen tcell.Screen, availableVoidSpace int) int {
+	if !md.linesBuilt {
+		md.BuildLines(screen)
+	}
+	switch md.params.HeightMode {
+	case HeightFillOrFit:
+		return max(len(md.lines), availableVoidSpace)
+	default:
+		return len(md.lines)
+	}
+}
+
+func (md *Markdown) HeightMode() int {
+	return md.params.HeightMode
+}
+
+func (md *Markdown) Draw(screen tcell.Screen, y int) {
+	screenW, _ := screen.Size()
+
+	if !md.linesBuilt {
+		md.BuildLines(screen)
+	}
+
+	for i, line := range md.lines {
+		lineY := y + i
+		if lineY < 0 {
+			continue
+		}
+
+		x := 0
+		for _, sr := range line.runes {
+			screen.SetContent(x, lineY, sr.r, nil, sr.style)
+			x += runewidth.RuneWidth(sr.r)
+		}
+		for ; x < screenW; x++ {
+			screen.SetContent(x, lineY, ' ', nil, line.fill)
+		}
+	}
+}
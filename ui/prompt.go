@@ -0,0 +1,114 @@
+// The user prompt, wrapped like Text but aware of the cursor which it places on the terminal
+
+package ui
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	promptPrefix string = "> "
+	promptContinuation string = "  "
+)
+
+type PromptParams struct {
+	// The terminal cursor is left alone when false, e.g. while a confirmation has the focus
+	ShowCursor bool
+}
+
+type Prompt struct {
+	content []rune
+	cursor int
+	params PromptParams
+	lines []string
+	cursorX int
+	cursorY int
+	linesBuilt bool
+}
+
+func NewPrompt(content []rune, cursor int, params PromptParams) *Prompt {
+	return &Prompt{
+		content: content,
+		cursor: cursor,
+		params: params,
+	}
+}
+
+func (prompt *Prompt) BuildLines(screen tcell.Screen) {
+	screenWidth, _ := screen.Size()
+	lines := []string{}
+	currentLine := strings.Builder{}
+	currentLine.WriteString(promptPrefix)
+	currentWidth := runewidth.StringWidth(promptPrefix)
+
+	newLine := func() {
+		lines = append(lines, currentLine.String())
+		currentLine.Reset()
+		currentLine.WriteString(promptContinuation)
+		currentWidth = runewidth.StringWidth(promptContinuation)
+	}
+
+	for i, r := range prompt.content {
+		if r == '\n' {
+			if i == prompt.cursor {
+				// No room left after a full line, sit on its last cell
+				prompt.cursorX, prompt.cursorY = min(currentWidth, screenWidth - 1), len(lines)
+			}
+			newLine()
+			continue
+		}
+
+		runeWidth := runewidth.RuneWidth(r)
+		if currentWidth + runeWidth > screenWidth {
+			newLine()
+		}
+		if i == prompt.cursor {
+			prompt.cursorX, prompt.cursorY = currentWidth, len(lines)
+		}
+		currentLine.WriteRune(r)
+		currentWidth += runeWidth
+	}
+
+	if prompt.cursor >= len(prompt.content) {
+		// The cursor needs a cell of its own after the last rune
+		if currentWidth >= screenWidth {
+			newLine()
+		}
+		prompt.cursorX, prompt.cursorY = currentWidth, len(lines)
+	}
+	lines = append(lines, currentLine.String())
+
+	prompt.lines = lines
+	prompt.linesBuilt = true
+}
+
+func (prompt *Prompt) ComputeHeight(screen tcell.Screen, availableVoidSpace int) int {
+	if !prompt.linesBuilt {
+		prompt.BuildLines(screen)
+	}
+	return len(prompt.lines)
+}
+
+func (prompt *Prompt) HeightMode() int {
+	return HeightFit
+}
+
+func (prompt *Prompt) Draw(screen tcell.Screen, y int) {
+	if !prompt.linesBuilt {
+		prompt.BuildLines(screen)
+	}
+
+	for i, line := range prompt.lines {
+		if y + i < 0 {
+			continue
+		}
+		screen.PutStrStyled(0, y + i, line, tcell.StyleDefault)
+	}
+
+	if prompt.params.ShowCursor && y + prompt.cursorY >= 0 {
+		screen.ShowCursor(prompt.cursorX, y + prompt.cursorY)
+	}
+}
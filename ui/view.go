@@ -28,6 +28,8 @@ func (view *View) Draw(screen tcell.Screen) {
 		} else {
 			view.Yoffset = contentHeight - screenHeight
 		}
+	} else {
+		view.Yoffset = max(0, min(view.Yoffset, contentHeight - screenHeight))
 	}
 
 	if view.Yoffset >= contentHeight - screenHeight {